@@ -1,13 +1,14 @@
 package main
 
 import (
-	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
 
+	"system-transparency.org/stprov/internal/api"
 	"system-transparency.org/stprov/internal/options"
+	"system-transparency.org/stprov/internal/pake"
 	"system-transparency.org/stprov/internal/version"
 	"system-transparency.org/stprov/subcmd/local"
 	"system-transparency.org/stprov/subcmd/remote"
@@ -49,14 +50,53 @@ func main() {
 		fmt.Fprintf(os.Stderr, format, opt.Name(), err.Error())
 
 		if opt.Name() == "local" {
-			// Detect the err we get when user runs:
-			// stprov local run -o incorrect-password
-			testErr := x509.UnknownAuthorityError{}
-			if ok := errors.As(err, &testErr); ok {
-				fmt.Fprintf(os.Stderr, "The one-time password may be incorrect.\n")
+			if h := hint(err); h != "" {
+				fmt.Fprintf(os.Stderr, "%s\n", h)
 			}
 		}
 
 		os.Exit(1)
 	}
 }
+
+// hint outputs an actionable hint for an error from stprov local, if any
+func hint(err error) string {
+	// Detect the err we get when user runs:
+	// stprov local run -o incorrect-password
+	if errors.Is(err, pake.ErrConfirmation) {
+		return "The one-time password may be incorrect."
+	}
+	var incompatible *api.IncompatibleError
+	if errors.As(err, &incompatible) {
+		return "Use the same version of stprov local and stprov remote."
+	}
+
+	var apiErr *api.Error
+	if !errors.As(err, &apiErr) {
+		return ""
+	}
+	switch apiErr.Code {
+	case api.CodeNetwork:
+		return "Allow this host's IP address with -a when starting stprov remote run."
+	case api.CodeBackoff:
+		return "Too many failed attempts from this host, wait a moment and try again."
+	case api.CodeLockout:
+		return "stprov remote shut down after too many failed attempts, restart it with a new one-time password."
+	case api.CodeState:
+		return "Requests were out of order, restart stprov remote run to provision from scratch."
+	case api.CodeNotSetupMode:
+		return "Enter Secure Boot setup mode in the UEFI menu, or provision without Secure Boot keys."
+	case api.CodeSecureBoot:
+		if apiErr.Step == "" {
+			return "Check that PK is self-signed, that KEK is signed by PK, and that db and dbx are signed by KEK."
+		}
+		return fmt.Sprintf("Check the %s file: PK must be self-signed, KEK signed by PK, and db and dbx signed by KEK.", apiErr.Step)
+	case api.CodeNoSecureBoot:
+		return "stprov remote seals to PCR 7, provision without Secure Boot keys or restart it with other --tpm-pcrs."
+	case api.CodeNoPlaintextKeys:
+		return "stprov remote seals the SSH hostkey to the TPM, provision without --derive, --ca or --host-key-passphrase-file."
+	case api.CodeHostCert:
+		return "The host certificate must be signed for the platform's SSH hostkey."
+	}
+	return ""
+}
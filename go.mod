@@ -3,11 +3,15 @@ module system-transparency.org/stprov
 go 1.25.0
 
 require (
+	filippo.io/edwards25519 v1.1.0
 	github.com/go-ping/ping v1.2.0
+	github.com/google/go-tpm v0.9.8
 	github.com/google/uuid v1.6.0
 	github.com/u-root/u-root v0.16.0
 	github.com/vishvananda/netlink v1.3.1
 	golang.org/x/crypto v0.53.0
+	golang.org/x/sys v0.46.0
+	gopkg.in/yaml.v3 v3.0.1
 	system-transparency.org/stboot v0.6.2
 )
 
@@ -22,6 +26,5 @@ require (
 	github.com/vishvananda/netns v0.0.5 // indirect
 	golang.org/x/net v0.55.0 // indirect
 	golang.org/x/sync v0.18.0 // indirect
-	golang.org/x/sys v0.46.0 // indirect
 	sigsum.org/sigsum-go v0.11.2 // indirect
 )
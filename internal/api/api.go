@@ -3,23 +3,122 @@
 package api
 
 import (
+	"crypto/tls"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"slices"
+	"strings"
 	"time"
 
+	"system-transparency.org/stprov/internal/pake"
+	"system-transparency.org/stprov/internal/sas"
 	"system-transparency.org/stprov/internal/secrets"
+	"system-transparency.org/stprov/internal/ssh"
 )
 
 const (
-	Protocol = "stprov/v0.0.1"
+	Protocol = "stprov/v0.0.2"
 
+	// EndpointHello is not prefixed by a protocol version, so that it can
+	// be used to negotiate one, i.e., its URL path is "/hello"
+	EndpointHello = "hello"
+
+	EndpointPAKE          = "pake"
+	EndpointPAKEConfirm   = "pake-confirm"
 	EndpointAddData       = "add-data"
 	EndpointAddSecureBoot = "add-secure-boot"
 	EndpointCommit        = "commit"
+	EndpointAddHostCert   = "add-host-cert"
+	EndpointAddX509Cert   = "add-x509-cert"
+	EndpointState         = "state"
+	EndpointAbort         = "abort"
+
+	// QueryHostCert is set to "true" on a commit request if stprov local will
+	// follow up with an add-host-cert request before stprov remote shuts down
+	QueryHostCert = "host-cert"
+	// QueryX509Cert is set to "true" on a commit request if stprov local will
+	// sign the returned CSR and follow up with an add-x509-cert request
+	QueryX509Cert = "x509-cert"
 
 	BasicAuthUser = "example-user"
+
+	// ExporterLabelPAKE is the RFC 5705 label of the TLS keying material that
+	// the PAKE key confirmations are bound to
+	ExporterLabelPAKE = "EXPORTER-stprov-pake"
+	// ExporterLabelSAS is the RFC 5705 label of the TLS keying material that
+	// the short authentication string is derived from, see ShortAuthString()
+	ExporterLabelSAS = "EXPORTER-stprov-sas"
+	// ExporterLabelUDS is the RFC 5705 label of the TLS keying material that
+	// the unique device secret is bound to
+	ExporterLabelUDS = "EXPORTER-stprov-uds"
+	exporterSize     = 32
+
+	// MaxHostKeyPassphraseSize is the maximum size of a host key passphrase
+	MaxHostKeyPassphraseSize = 1024
 )
 
+// Protocols lists the supported protocol versions in order of preference
+var Protocols = []string{Protocol}
+
+// HelloResponse is the output of a hello request
+type HelloResponse struct {
+	Protocols []string `json:"protocols"`  // supported protocol versions, most preferred first
+	Version   string   `json:"version"`    // stprov version
+	HostName  string   `json:"hostname"`   // platform host name
+	SetupMode *bool    `json:"setup_mode"` // Secure Boot setup mode, nil if unknown
+	Endpoints []string `json:"endpoints"`  // accepted endpoints
+}
+
+// IncompatibleError is returned if stprov local and stprov remote do not
+// support a common protocol version
+type IncompatibleError struct {
+	Local   []string // protocol versions supported by stprov local
+	Remote  []string // protocol versions supported by stprov remote
+	Version string   // stprov remote's version
+}
+
+func (e *IncompatibleError) Error() string {
+	return fmt.Sprintf("no compatible protocol version: stprov local supports %s, stprov remote (version %s) supports %s",
+		strings.Join(e.Local, ", "), e.Version, strings.Join(e.Remote, ", "))
+}
+
+// Negotiate picks the first protocol version in local that remote supports
+func Negotiate(local, remote []string) (string, bool) {
+	for _, l := range local {
+		for _, r := range remote {
+			if l == r {
+				return l, true
+			}
+		}
+	}
+	return "", false
+}
+
+// PAKERequest is the input of a pake request, which starts a SPAKE2 exchange
+// from a one-time password.  All other requests are authenticated with a
+// basic auth password that is derived from the exchange's session key.
+type PAKERequest struct {
+	Message []byte `json:"message"` // pA in RFC 9382
+}
+
+// PAKEResponse is the output of a pake request
+type PAKEResponse struct {
+	Message []byte `json:"message"` // pB in RFC 9382
+}
+
+// PAKEConfirmRequest is the input of a pake-confirm request.  Failed key
+// confirmations count as failed authentication attempts.
+type PAKEConfirmRequest struct {
+	Message      []byte `json:"message"`      // pA, identifies the exchange
+	Confirmation []byte `json:"confirmation"` // cA in RFC 9382
+}
+
+// PAKEConfirmResponse is the output of a pake-confirm request
+type PAKEConfirmResponse struct {
+	Confirmation []byte `json:"confirmation"` // cB in RFC 9382
+}
+
 // AddDataRequest is the input of an add-data request
 type AddDataRequest struct {
 	// Entropy is 256 bits of entropy, used internally by stprov
@@ -31,6 +130,19 @@ type AddDataRequest struct {
 	//
 	// The timestamp is kept here until it is clear if it is not coming back.
 	Timestamp int64 `json:"timestamp"`
+
+	// HostKeyPassphrase optionally encrypts the SSH host key at rest, see
+	// ssh.HostKey.WriteEFIWithPassphrase().  Omitted if the host key should
+	// be stored unencrypted.
+	HostKeyPassphrase []byte `json:"host_key_passphrase,omitempty"`
+
+	// HostKeyType is the type of SSH host key to derive, see ssh.KeyTypes.
+	// Omitted for ssh.DefaultKeyType.
+	HostKeyType string `json:"host_key_type,omitempty"`
+
+	// Derive lists named keys to derive in addition to the SSH host key,
+	// see secrets.Derivations.  Omitted if there are none.
+	Derive []string `json:"derive,omitempty"`
 }
 
 // AddSecureBootRequest is a request to provision Secure Boot keys.  The
@@ -44,6 +156,19 @@ type AddSecureBootRequest struct {
 	RebootIntoUEFIMenu bool   `json:"reboot_into_uefi_menu"`
 }
 
+// AddHostCertRequest is a request to provision an SSH host certificate for the
+// platform's SSH hostkey.  The certificate is in authorized_keys format.
+type AddHostCertRequest struct {
+	Certificate string `json:"certificate"`
+}
+
+// AddX509CertRequest is a request to provision an X.509 identity certificate
+// for the platform's X.509 key, see CommitResponse.CSR.  The certificate is in
+// PEM format.
+type AddX509CertRequest struct {
+	Certificate string `json:"certificate"`
+}
+
 // CommitResponse is the output of a commit request
 type CommitResponse struct {
 	PublicKey      string `json:"publickey"`
@@ -51,15 +176,78 @@ type CommitResponse struct {
 	HostName       string `json:"hostname"`
 	Authentication string `json:"authentication"`
 	Identity       string `json:"identity"`
+
+	// DerivedKeys maps the name of each derived key to its public key, see
+	// AddDataRequest.Derive.  Omitted if there are none.
+	DerivedKeys map[string]string `json:"derived_keys,omitempty"`
+
+	// CSR is a DER-encoded certificate signing request for the platform's
+	// X.509 key, see secrets.UniqueDeviceSecret.X509().  Omitted unless the
+	// commit request has QueryX509Cert.
+	CSR []byte `json:"csr,omitempty"`
+}
+
+// SessionPassword derives a basic auth password from a PAKE session key
+func SessionPassword(keys *pake.Keys) (string, error) {
+	var pw secrets.Entropy
+	_, err := io.ReadFull(secrets.Reader(keys.Session, "pake:basicAuthPassword", 1), pw[:])
+	return hex.EncodeToString(pw[:]), err
 }
 
-// NewAddData generates a new add-data request
-func NewAddDataRequest() (*AddDataRequest, error) {
+// ShortAuthString derives a short authentication string from the entropy of an
+// add-data request and the TLS connection that it was sent on
+func ShortAuthString(cs *tls.ConnectionState, entropy []byte) (string, error) {
+	if cs == nil {
+		return "", fmt.Errorf("no tls connection state")
+	}
+	ekm, err := cs.ExportKeyingMaterial(ExporterLabelSAS, nil, exporterSize)
+	if err != nil {
+		return "", fmt.Errorf("export keying material: %w", err)
+	}
+	return sas.Derive(entropy, ekm), nil
+}
+
+// NewAddDataRequest creates a new add-data request.  The host key type may be
+// empty for ssh.DefaultKeyType, and the host key passphrase and the names of
+// keys to derive may be nil.
+func NewAddDataRequest(hostKeyType string, hostKeyPassphrase []byte, derive []string) (*AddDataRequest, error) {
+	if err := CheckHostKeyType(hostKeyType); err != nil {
+		return nil, fmt.Errorf("api: %w", err)
+	}
+	if err := CheckDerivations(derive); err != nil {
+		return nil, fmt.Errorf("api: %w", err)
+	}
+	if hostKeyPassphrase != nil && (len(hostKeyPassphrase) == 0 || len(hostKeyPassphrase) > MaxHostKeyPassphraseSize) {
+		return nil, fmt.Errorf("api: host key passphrase size %d not in [1, %d]", len(hostKeyPassphrase), MaxHostKeyPassphraseSize)
+	}
 	entropy, err := secrets.NewEntropy()
 	if err != nil {
 		return nil, fmt.Errorf("api: %w", err)
 	}
-	return &AddDataRequest{entropy[:], time.Now().Unix()}, nil
+	return &AddDataRequest{entropy[:], time.Now().Unix(), hostKeyPassphrase, hostKeyType, derive}, nil
+}
+
+// CheckHostKeyType checks that an SSH host key type is supported.  The empty
+// string means ssh.DefaultKeyType.
+func CheckHostKeyType(hostKeyType string) error {
+	if hostKeyType == "" || slices.Contains(ssh.KeyTypes, hostKeyType) {
+		return nil
+	}
+	return fmt.Errorf("unsupported host key type %q, must be one of %s", hostKeyType, strings.Join(ssh.KeyTypes, ", "))
+}
+
+// CheckDerivations checks that named keys to derive are supported and not
+// repeated, see secrets.Derivations
+func CheckDerivations(names []string) error {
+	for i, name := range names {
+		if _, err := secrets.LookupDerivation(name); err != nil {
+			return err
+		}
+		if slices.Contains(names[:i], name) {
+			return fmt.Errorf("derivation %q is repeated", name)
+		}
+	}
+	return nil
 }
 
 // NewAddSecureBootRequest creates a new request to provision Secure Boot keys
@@ -68,8 +256,10 @@ func NewAddSecureBootRequest(pk, kek, db, dbx []byte, rebootIntoUEFIMenu bool) (
 	return &req, req.Check()
 }
 
-func NewCommitResponse(uds *secrets.UniqueDeviceSecret, hostname string) (*CommitResponse, error) {
-	hk, err := uds.SSH()
+// NewCommitResponse creates a new commit response.  The names of keys to
+// derive in addition to the SSH host key may be nil.
+func NewCommitResponse(uds *secrets.UniqueDeviceSecret, hostKeyType, hostname string, derive []string) (*CommitResponse, error) {
+	hk, err := uds.SSH(hostKeyType)
 	if err != nil {
 		return nil, fmt.Errorf("ssh: %w", err)
 	}
@@ -91,13 +281,24 @@ func NewCommitResponse(uds *secrets.UniqueDeviceSecret, hostname string) (*Commi
 	if err != nil {
 		return nil, fmt.Errorf("authentication: %w", err)
 	}
-	return &CommitResponse{
+	cr := &CommitResponse{
 		PublicKey:      pk,
 		Fingerprint:    fpr,
 		HostName:       hostname,
 		Authentication: hex.EncodeToString(auth[:]),
 		Identity:       hex.EncodeToString(id[:]),
-	}, nil
+	}
+	for _, name := range derive {
+		dk, err := uds.Derive(name)
+		if err != nil {
+			return nil, fmt.Errorf("derive: %w", err)
+		}
+		if cr.DerivedKeys == nil {
+			cr.DerivedKeys = make(map[string]string)
+		}
+		cr.DerivedKeys[dk.Name] = dk.PublicKey
+	}
+	return cr, nil
 }
 
 // Check checks that the request has a PK, KEK, and db (dbx is optional)
@@ -3,10 +3,14 @@ package api
 import (
 	"bytes"
 	"context"
+	"errors"
 	"net"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"system-transparency.org/stprov/internal/ssh"
 )
 
 func TestRun(t *testing.T) {
@@ -24,6 +28,9 @@ func TestRun(t *testing.T) {
 	}()
 
 	cli := testClient(t)
+	cli.HostKeyPassphrase = []byte("passphrase")
+	cli.HostKeyType = ssh.KeyTypeECDSAP256
+	cli.Derive = []string{"wireguard", "tls-client"}
 
 	// We race with the server startup, and may get here before
 	// the server goroutine calls listen(2). There's seems to be
@@ -44,6 +51,14 @@ func TestRun(t *testing.T) {
 		t.Logf("client add-data failed: %v, retrying in 1s", err)
 		time.Sleep(time.Second)
 	}
+	if _, err := cli.AddData(); err == nil || !strings.Contains(err.Error(), "not accepted in state") {
+		t.Errorf("client repeated add-data: got error %v, wanted a state error", err)
+	}
+	if state, err := cli.State(); err != nil {
+		t.Errorf("client state failed: %v", err)
+	} else if got, want := state, StateDataAdded; got != want {
+		t.Errorf("got state %q but wanted %q", got, want)
+	}
 	cr, err := cli.Commit()
 	if err != nil {
 		t.Errorf("client commit failed: %v", err)
@@ -56,9 +71,95 @@ func TestRun(t *testing.T) {
 	if got, want := srv.Entropy[:], data.Entropy; !bytes.Equal(got, want) {
 		t.Errorf("got entropy\n%v\nbut wanted\n%v", got, want)
 	}
+	if got, want := srv.HostKeyPassphrase, cli.HostKeyPassphrase; !bytes.Equal(got, want) {
+		t.Errorf("got host key passphrase %q but wanted %q", got, want)
+	}
+	if got, want := srv.HostKeyType, cli.HostKeyType; got != want {
+		t.Errorf("got host key type %q but wanted %q", got, want)
+	}
+	if got, want := len(cr.DerivedKeys), len(cli.Derive); got != want {
+		t.Errorf("got %d derived keys but wanted %d", got, want)
+	}
+	for _, name := range cli.Derive {
+		dk, err := srv.UDS.Derive(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := cr.DerivedKeys[name], dk.PublicKey; got != want {
+			t.Errorf("%s: got public key %q but wanted %q", name, got, want)
+		}
+	}
+	if !strings.HasPrefix(cr.PublicKey, "ecdsa-sha2-nistp256 ") {
+		t.Errorf("got public key %q but wanted an ecdsa key", cr.PublicKey)
+	}
+	if got, want := cli.SAS(), srv.SAS; got == "" || got != want {
+		t.Errorf("got short authentication string %q but wanted %q", got, want)
+	}
 	if got, want := cr.HostName, srv.HostName; got != want {
 		t.Errorf("got host name %q but wanted %q", got, want)
 	}
+	if cli.hello == nil {
+		t.Errorf("client did not say hello")
+	} else if got, want := cli.serverURL, cli.baseURL+Protocol+"/"; got != want {
+		t.Errorf("got server url %q but wanted %q", got, want)
+	}
+}
+
+func TestRunAbort(t *testing.T) {
+	srv := testServer(t)
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.Run(context.Background()) }()
+
+	cli := testClient(t)
+	var err error
+	for try := 0; try < 3; try++ {
+		if _, err = cli.AddData(); err == nil {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		t.Fatalf("client add-data failed: %v", err)
+	}
+	if err := cli.Abort(); err != nil {
+		t.Fatalf("client abort failed: %v", err)
+	}
+	if got, want := <-errCh, ErrAborted; !errors.Is(got, want) {
+		t.Errorf("got error %v but wanted %v", got, want)
+	}
+	if srv.UDS != nil {
+		t.Errorf("got unique device secret after abort")
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	srv := testServer(t)
+	if got, want := srv.Run(ctx), context.DeadlineExceeded; !errors.Is(got, want) {
+		t.Errorf("got error %v but wanted %v", got, want)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	for _, table := range []struct {
+		desc   string
+		local  []string
+		remote []string
+		want   string
+	}{
+		{"none", []string{"v2"}, []string{"v1"}, ""},
+		{"empty", []string{"v2"}, nil, ""},
+		{"single", []string{"v1"}, []string{"v1"}, "v1"},
+		{"local preference", []string{"v3", "v2"}, []string{"v1", "v2", "v3"}, "v3"},
+		{"common", []string{"v3", "v2"}, []string{"v1", "v2"}, "v2"},
+	} {
+		got, ok := Negotiate(table.local, table.remote)
+		if ok != (table.want != "") || got != table.want {
+			t.Errorf("%s: got %q (%v) but wanted %q", table.desc, got, ok, table.want)
+		}
+	}
 }
 
 func testServer(t *testing.T) *Server {
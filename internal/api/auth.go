@@ -0,0 +1,57 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+// Authentication failures are redacted: the reason never includes the
+// credentials, and does not tell if it was the user or the password that was
+// wrong.  This makes it safe to log the reason and to send it to the client.
+var (
+	errNoCredentials  = errors.New("no basic auth credentials")
+	errBadCredentials = errors.New("invalid basic auth credentials")
+)
+
+// checkCredentials checks a request's basic auth credentials in constant time
+func (srv *Server) checkCredentials(r *http.Request) error {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return errNoCredentials
+	}
+	userOK := equal(user, BasicAuthUser)
+	passwordOK := srv.hasSession(password)
+	if !userOK || !passwordOK {
+		return errBadCredentials
+	}
+	return nil
+}
+
+// hasSession checks if a basic auth password belongs to a confirmed session.
+// All sessions are compared to avoid leaking which one matched.
+func (srv *Server) hasSession(password string) bool {
+	srv.sessionsLock.Lock()
+	defer srv.sessionsLock.Unlock()
+
+	found := false
+	for _, s := range srv.sessions {
+		if s.password == "" {
+			continue // unconfirmed
+		}
+		if equal(s.password, password) {
+			found = true
+		}
+	}
+	return found
+}
+
+// equal compares two secrets in constant time.  The secrets are hashed first,
+// so that neither the time nor the outcome of the comparison depends on how
+// many leading bytes match or if the lengths differ.
+func equal(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
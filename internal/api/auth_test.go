@@ -0,0 +1,119 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEqual(t *testing.T) {
+	for _, table := range []struct {
+		desc string
+		a, b string
+		want bool
+	}{
+		{"empty", "", "", true},
+		{"equal", "hotdog", "hotdog", true},
+		{"near miss", "hotdog", "hotdoh", false},
+		{"prefix", "hotdog", "hot", false},
+		{"longer", "hotdog", "hotdogs", false},
+		{"empty and non-empty", "", "hotdog", false},
+	} {
+		if got := equal(table.a, table.b); got != table.want {
+			t.Errorf("%s: got %v but wanted %v", table.desc, got, table.want)
+		}
+	}
+}
+
+func TestCheckCredentials(t *testing.T) {
+	srv := testServer(t)
+	password := testSession(t, srv)
+	nearMiss := password[:len(password)-1] + "0"
+	if nearMiss == password {
+		nearMiss = password[:len(password)-1] + "1"
+	}
+
+	for _, table := range []struct {
+		desc     string
+		auth     bool
+		user     string
+		password string
+		wantErr  error
+	}{
+		{"no credentials", false, "", "", errNoCredentials},
+		{"empty credentials", true, "", "", errBadCredentials},
+		{"bad user", true, "hotdog", password, errBadCredentials},
+		{"bad password", true, BasicAuthUser, "hotdog", errBadCredentials},
+		{"near miss password", true, BasicAuthUser, nearMiss, errBadCredentials},
+		{"password prefix", true, BasicAuthUser, password[:len(password)-1], errBadCredentials},
+		{"unconfirmed session", true, BasicAuthUser, "", errBadCredentials},
+		{"valid", true, BasicAuthUser, password, nil},
+	} {
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		if err != nil {
+			t.Fatalf("create http request: %v", err)
+		}
+		if table.auth {
+			req.SetBasicAuth(table.user, table.password)
+		}
+
+		err = srv.checkCredentials(req)
+		if got, want := err, table.wantErr; !errors.Is(got, want) {
+			t.Errorf("%s: got error %v but wanted %v", table.desc, got, want)
+		}
+		if err == nil {
+			continue
+		}
+		for _, secret := range []string{table.user, table.password} {
+			if len(secret) > 0 && strings.Contains(err.Error(), secret) {
+				t.Errorf("%s: error %q reveals credentials", table.desc, err)
+			}
+		}
+	}
+}
+
+func TestAuthenticateUserRedacted(t *testing.T) {
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	srv := testServer(t)
+	password := testSession(t, srv)
+	handler := getHandler(t, srv, EndpointCommit)
+	secrets := []string{"secret-user", "secret-password", password[:len(password)-1]}
+	for _, creds := range [][2]string{
+		{secrets[0], password},
+		{BasicAuthUser, secrets[1]},
+		{BasicAuthUser, secrets[2]},
+	} {
+		req, err := http.NewRequest(handler.Method, "http://example.com/", nil)
+		if err != nil {
+			t.Fatalf("create http request: %v", err)
+		}
+		req.RemoteAddr = "127.0.0.12:2009"
+		req.SetBasicAuth(creds[0], creds[1])
+
+		w := httptest.NewRecorder()
+		if handler.authenticateUser(w, req) {
+			t.Fatalf("user %q: authenticated with bad credentials", creds[0])
+		}
+		for _, secret := range append(secrets, password) {
+			if strings.Contains(w.Body.String(), secret) {
+				t.Errorf("response %q reveals credentials", w.Body.String())
+			}
+		}
+	}
+
+	for _, secret := range append(secrets, password) {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("log reveals credentials:\n%s", buf.String())
+		}
+	}
+	if got, want := strings.Count(buf.String(), errBadCredentials.Error()), 3; got != want {
+		t.Errorf("got %d redacted reason(s) in log but wanted %d:\n%s", got, want, buf.String())
+	}
+}
@@ -2,14 +2,17 @@ package api
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 
+	"system-transparency.org/stprov/internal/pake"
 	"system-transparency.org/stprov/internal/secrets"
 )
 
@@ -21,71 +24,116 @@ type ClientConfig struct {
 	// Optional Secure Boot keys in authentication_v2 descriptor format
 	PK, KEK, DB, DBX   []byte
 	RebootIntoUEFIMenu bool
+
+	// HostCert is set if an SSH host certificate is added after commit
+	HostCert bool
+
+	// X509Cert is set if an X.509 identity certificate is added after commit,
+	// and after the SSH host certificate if HostCert is also set
+	X509Cert bool
+
+	// Optional passphrase that the SSH host key is encrypted with at rest
+	HostKeyPassphrase []byte
+
+	// Optional SSH host key type, see ssh.KeyTypes (Default: ssh.DefaultKeyType)
+	HostKeyType string
+
+	// Optional names of keys to derive, see secrets.Derivations
+	Derive []string
 }
 
+// maxErrorSize is the maximum number of bytes read from an error response
+const maxErrorSize = 1024
+
 type Client struct {
 	ClientConfig
 	http.Client
 
-	basicAuthPassword string
-	serverURL         string
+	password          *pake.Password
+	pinned            []byte         // stprov remote's TLS certificate after the PAKE exchange
+	basicAuthPassword string         // derived from the PAKE session key
+	baseURL           string         // e.g., "https://10.0.0.1:2009/"
+	serverURL         string         // baseURL and negotiated protocol version
+	hello             *HelloResponse // output of the first hello request
+	sas               string         // short authentication string after AddData()
 }
 
+// NewClient creates a new client.  A PAKE exchange is performed on the first
+// request, after which stprov remote's TLS certificate is pinned.
 func NewClient(cfg *ClientConfig) (*Client, error) {
 	otp, err := secrets.NewOneTimePassword(cfg.Secret)
 	if err != nil {
 		return nil, fmt.Errorf("derive one-time password: %w", err)
 	}
-	crt, err := otp.X509Certificate(cfg.RemoteIP)
-	if err != nil {
-		return nil, fmt.Errorf("derive x509 certificate: %w", err)
-	}
-	basicAuthPassword, err := otp.BasicAuthPassword()
+	pw, err := pake.NewPassword(otp[:])
 	if err != nil {
-		return nil, fmt.Errorf("derive basic auth password: %w", err)
+		return nil, fmt.Errorf("derive pake password: %w", err)
 	}
 
-	crtPool := x509.NewCertPool()
-	crtPool.AddCert(crt)
-	return &Client{
+	c := &Client{
 		ClientConfig: *cfg,
-		Client: http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					RootCAs:    crtPool,
-					ServerName: secrets.DummyServerName,
-				},
+		password:     pw,
+		baseURL:      fmt.Sprintf("https://%s/", net.JoinHostPort(cfg.RemoteIP.String(), fmt.Sprint(cfg.RemotePort))),
+	}
+	c.Client = http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				MinVersion: tls.VersionTLS13,
+				// The certificate is authenticated by the PAKE exchange
+				// instead, see handshake() and verifyConnection()
+				InsecureSkipVerify: true,
+				VerifyConnection:   c.verifyConnection,
 			},
 		},
-		basicAuthPassword: basicAuthPassword,
-		serverURL:         fmt.Sprintf("https://%s:%d/%s/", cfg.RemoteIP, cfg.RemotePort, Protocol),
-	}, nil
+	}
+	return c, nil
 }
 
 func (c *Client) AddData() (*AddDataRequest, error) {
-	data, err := NewAddDataRequest()
+	data, err := NewAddDataRequest(c.HostKeyType, c.HostKeyPassphrase, c.Derive)
 	if err != nil {
 		return nil, fmt.Errorf("create data: %w", err)
 	}
-	if _, err := c.doPost(c.serverURL+EndpointAddData, data); err != nil {
+	rsp, _, err := c.post(EndpointAddData, data)
+	if err != nil {
 		return nil, fmt.Errorf("post data: %w", err)
 	}
+	if c.sas, err = ShortAuthString(rsp.TLS, data.Entropy); err != nil {
+		return nil, fmt.Errorf("short authentication string: %w", err)
+	}
 	return data, nil
 }
 
+// SAS outputs the short authentication string that stprov remote should also
+// show, or the empty string if AddData() did not succeed yet
+func (c *Client) SAS() string {
+	return c.sas
+}
+
 func (c *Client) AddSecureBootKeys() error {
 	req, err := NewAddSecureBootRequest(c.PK, c.KEK, c.DB, c.DBX, c.RebootIntoUEFIMenu)
 	if err != nil {
 		return fmt.Errorf("create secure boot request: %w", err)
 	}
-	if _, err := c.doPost(c.serverURL+EndpointAddSecureBoot, req); err != nil {
+	if _, err := c.doPost(EndpointAddSecureBoot, req); err != nil {
 		return fmt.Errorf("post secure boot keys: %w", err)
 	}
 	return nil
 }
 
 func (c *Client) Commit() (*CommitResponse, error) {
-	b, err := c.doGet(c.serverURL + EndpointCommit)
+	query := url.Values{}
+	if c.HostCert {
+		query.Set(QueryHostCert, "true")
+	}
+	if c.X509Cert {
+		query.Set(QueryX509Cert, "true")
+	}
+	endpoint := EndpointCommit
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	b, err := c.doGet(endpoint)
 	if err != nil {
 		return nil, fmt.Errorf("send commit: %w", err)
 	}
@@ -96,8 +144,215 @@ func (c *Client) Commit() (*CommitResponse, error) {
 	return &cr, nil
 }
 
-func (c *Client) doGet(endpointURL string) ([]byte, error) {
-	req, err := http.NewRequest(http.MethodGet, endpointURL, nil)
+// State queries the state of stprov remote's provisioning session
+func (c *Client) State() (State, error) {
+	b, err := c.doGet(EndpointState)
+	if err != nil {
+		return "", fmt.Errorf("get state: %w", err)
+	}
+	var sr StateResponse
+	if err := json.Unmarshal(b, &sr); err != nil {
+		return "", fmt.Errorf("unmarshal: %w", err)
+	}
+	return sr.State, nil
+}
+
+// Abort stops stprov remote without a commit
+func (c *Client) Abort() error {
+	if _, err := c.doPost(EndpointAbort, struct{}{}); err != nil {
+		return fmt.Errorf("post abort: %w", err)
+	}
+	return nil
+}
+
+// AddHostCert sends an SSH host certificate in authorized_keys format.  The
+// client must be configured with HostCert, and commit must have been called.
+func (c *Client) AddHostCert(cert string) error {
+	if !c.HostCert {
+		return fmt.Errorf("client is not configured to add a host certificate")
+	}
+	if _, err := c.doPost(EndpointAddHostCert, &AddHostCertRequest{Certificate: cert}); err != nil {
+		return fmt.Errorf("post host certificate: %w", err)
+	}
+	return nil
+}
+
+// AddX509Cert sends an X.509 identity certificate in PEM format.  The client
+// must be configured with X509Cert, and commit must have been called.
+func (c *Client) AddX509Cert(cert string) error {
+	if !c.X509Cert {
+		return fmt.Errorf("client is not configured to add an x509 certificate")
+	}
+	if _, err := c.doPost(EndpointAddX509Cert, &AddX509CertRequest{Certificate: cert}); err != nil {
+		return fmt.Errorf("post x509 certificate: %w", err)
+	}
+	return nil
+}
+
+// handshake performs a PAKE exchange, checking that stprov remote knows the
+// same one-time password and that no TLS connection is terminated in between.
+// The TLS certificate is pinned before key confirmation, so that both requests
+// go to the same stprov remote.  It is unpinned if key confirmation fails.
+func (c *Client) handshake() (err error) {
+	st, err := pake.NewClient(c.password, rand.Reader)
+	if err != nil {
+		return err
+	}
+	rsp, b, err := c.postPublic(c.serverURL+EndpointPAKE, &PAKERequest{Message: st.Message()})
+	if err != nil {
+		return err
+	}
+	if rsp.TLS == nil || len(rsp.TLS.PeerCertificates) == 0 {
+		return fmt.Errorf("no tls connection state")
+	}
+	var pr PAKEResponse
+	if err := json.Unmarshal(b, &pr); err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+	aad, err := rsp.TLS.ExportKeyingMaterial(ExporterLabelPAKE, nil, exporterSize)
+	if err != nil {
+		return fmt.Errorf("export keying material: %w", err)
+	}
+	keys, err := st.Finish(pr.Message, aad)
+	if err != nil {
+		return err
+	}
+
+	c.pinned = rsp.TLS.PeerCertificates[0].Raw
+	defer func() {
+		if err != nil {
+			c.pinned = nil
+		}
+	}()
+	rsp, b, err = c.postPublic(c.serverURL+EndpointPAKEConfirm, &PAKEConfirmRequest{
+		Message:      st.Message(),
+		Confirmation: keys.ClientConfirmation,
+	})
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.Code == CodeConfirmation {
+		return fmt.Errorf("%w: %v", pake.ErrConfirmation, err)
+	}
+	if err != nil {
+		return err
+	}
+	var cr PAKEConfirmResponse
+	if err := json.Unmarshal(b, &cr); err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+	if err := keys.CheckServer(cr.Confirmation); err != nil {
+		return err
+	}
+	if c.basicAuthPassword, err = SessionPassword(keys); err != nil {
+		return fmt.Errorf("derive basic auth password: %w", err)
+	}
+	return nil
+}
+
+// postPublic posts to an endpoint that does not require basic auth.  The HTTP
+// response is returned on error too, if there is one.
+func (c *Client) postPublic(endpointURL string, i interface{}) (*http.Response, []byte, error) {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshal: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, endpointURL, bytes.NewBuffer(b))
+	if err != nil {
+		return nil, nil, fmt.Errorf("new request: %w", err)
+	}
+	rsp, err := c.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("do request: %w", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return rsp, nil, readError(rsp)
+	}
+	if b, err = io.ReadAll(rsp.Body); err != nil {
+		return rsp, nil, fmt.Errorf("read response: %w", err)
+	}
+	return rsp, b, nil
+}
+
+// verifyConnection accepts any TLS certificate until a PAKE exchange pinned one
+func (c *Client) verifyConnection(cs tls.ConnectionState) error {
+	if c.pinned == nil {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 || !bytes.Equal(cs.PeerCertificates[0].Raw, c.pinned) {
+		return fmt.Errorf("tls certificate does not match the one pinned after pake")
+	}
+	return nil
+}
+
+// Hello requests information about stprov remote, including its supported
+// protocol versions.  No authentication is required.
+func (c *Client) Hello() (*HelloResponse, error) {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+EndpointHello, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	rsp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %w", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: stprov remote is likely older and does not support %s", http.StatusText(rsp.StatusCode), EndpointHello)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, readError(rsp)
+	}
+	b, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+	var hello HelloResponse
+	if err := json.Unmarshal(b, &hello); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	return &hello, nil
+}
+
+// negotiate picks a protocol version from a hello request, unless one was
+// picked already
+func (c *Client) negotiate() error {
+	if c.hello != nil {
+		return nil
+	}
+	hello, err := c.Hello()
+	if err != nil {
+		return fmt.Errorf("hello: %w", err)
+	}
+	protocol, ok := Negotiate(Protocols, hello.Protocols)
+	if !ok {
+		return &IncompatibleError{Local: Protocols, Remote: hello.Protocols, Version: hello.Version}
+	}
+	c.hello = hello
+	c.serverURL = c.baseURL + protocol + "/"
+	return nil
+}
+
+// session negotiates a protocol version and performs a PAKE exchange, unless
+// this succeeded already
+func (c *Client) session() error {
+	if err := c.negotiate(); err != nil {
+		return err
+	}
+	if c.pinned != nil {
+		return nil
+	}
+	if err := c.handshake(); err != nil {
+		return fmt.Errorf("pake: %w", err)
+	}
+	return nil
+}
+
+// doGet requests an endpoint, optionally followed by a query string
+func (c *Client) doGet(endpoint string) ([]byte, error) {
+	if err := c.session(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, c.serverURL+endpoint, nil)
 	if err != nil {
 		return nil, fmt.Errorf("new request: %w", err)
 	}
@@ -109,29 +364,41 @@ func (c *Client) doGet(endpointURL string) ([]byte, error) {
 	}
 	defer rsp.Body.Close()
 	if rsp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%s", http.StatusText(rsp.StatusCode))
+		return nil, readError(rsp)
 	}
 	return io.ReadAll(rsp.Body)
 }
 
-func (c *Client) doPost(endpointURL string, i interface{}) ([]byte, error) {
+func (c *Client) doPost(endpoint string, i interface{}) ([]byte, error) {
+	_, b, err := c.post(endpoint, i)
+	return b, err
+}
+
+// post is like doPost, but also returns the HTTP response on success
+func (c *Client) post(endpoint string, i interface{}) (*http.Response, []byte, error) {
+	if err := c.session(); err != nil {
+		return nil, nil, err
+	}
 	b, err := json.Marshal(i)
 	if err != nil {
-		return nil, fmt.Errorf("marshal: %w", err)
+		return nil, nil, fmt.Errorf("marshal: %w", err)
 	}
-	req, err := http.NewRequest(http.MethodPost, endpointURL, bytes.NewBuffer(b))
+	req, err := http.NewRequest(http.MethodPost, c.serverURL+endpoint, bytes.NewBuffer(b))
 	if err != nil {
-		return nil, fmt.Errorf("new request: %w", err)
+		return nil, nil, fmt.Errorf("new request: %w", err)
 	}
 	req.SetBasicAuth(BasicAuthUser, c.basicAuthPassword)
 
 	rsp, err := c.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("do request: %w", err)
+		return nil, nil, fmt.Errorf("do request: %w", err)
 	}
 	defer rsp.Body.Close()
 	if rsp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%s", http.StatusText(rsp.StatusCode))
+		return nil, nil, readError(rsp)
 	}
-	return io.ReadAll(rsp.Body)
+	if b, err = io.ReadAll(rsp.Body); err != nil {
+		return nil, nil, fmt.Errorf("read response: %w", err)
+	}
+	return rsp, b, nil
 }
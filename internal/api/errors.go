@@ -0,0 +1,106 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrorCode is a machine-readable reason that a request failed
+type ErrorCode string
+
+const (
+	CodeBadRequest      ErrorCode = "bad-request"       // malformed or invalid input
+	CodeMethod          ErrorCode = "method"            // unexpected HTTP method
+	CodeNetwork         ErrorCode = "network"           // source IP address is not allowed
+	CodeUnauthorized    ErrorCode = "unauthorized"      // missing or invalid basic auth
+	CodeConfirmation    ErrorCode = "pake-confirmation" // PAKE key confirmation failed
+	CodeBackoff         ErrorCode = "backoff"           // must wait after failed authentication
+	CodeLockout         ErrorCode = "lockout"           // too many failed authentication attempts
+	CodeState           ErrorCode = "state"             // request out of order or repeated
+	CodeNotSetupMode    ErrorCode = "not-setup-mode"    // Secure Boot is not in setup mode
+	CodeSecureBoot      ErrorCode = "secure-boot"       // a Secure Boot variable was rejected
+	CodeNoSecureBoot    ErrorCode = "no-secure-boot"    // Secure Boot provisioning is refused
+	CodeNoPlaintextKeys ErrorCode = "no-plaintext-keys" // keys or passphrases that would not be sealed are refused
+	CodeHostCert        ErrorCode = "host-cert"         // invalid SSH host certificate
+	CodeX509Cert        ErrorCode = "x509-cert"         // invalid X.509 identity certificate
+	CodeInternal        ErrorCode = "internal"          // stprov remote failed
+)
+
+// Error is the output of a request that failed, encoded as JSON.  The client
+// decodes it with the response's HTTP status code.
+type Error struct {
+	Status  int       `json:"-"`              // HTTP status code
+	Code    ErrorCode `json:"code"`           // machine-readable reason
+	Step    string    `json:"step,omitempty"` // what failed, e.g., "KEK", if applicable
+	Message string    `json:"message"`        // the underlying error message
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if e.Step != "" {
+		msg = e.Step + ": " + msg
+	}
+	if e.Code == "" {
+		return msg
+	}
+	return fmt.Sprintf("%s (%s)", msg, e.Code)
+}
+
+// newError creates an error that is served with a given status and code
+func newError(status int, code ErrorCode, step string, err error) *Error {
+	return &Error{Status: status, Code: code, Step: step, Message: err.Error()}
+}
+
+// toError converts an error returned by a handler to an Error.  Errors without
+// a more specific code get one that depends on the HTTP status code.
+func toError(status int, err error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	var stateErr *StateError
+	if errors.As(err, &stateErr) {
+		return &Error{Status: status, Code: CodeState, Step: stateErr.Endpoint, Message: stateErr.reason()}
+	}
+
+	code := CodeInternal
+	switch status {
+	case http.StatusBadRequest:
+		code = CodeBadRequest
+	case http.StatusConflict:
+		code = CodeState
+	}
+	return newError(status, code, "", err)
+}
+
+// writeError writes an error as JSON with its HTTP status code
+func writeError(w http.ResponseWriter, e *Error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		http.Error(w, http.StatusText(e.Status), e.Status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	w.Write(b)
+}
+
+// readError decodes an error from a response that is not 200 OK.  Responses
+// that are not structured, e.g., from an older stprov remote, get no code.
+func readError(rsp *http.Response) *Error {
+	e := &Error{Status: rsp.StatusCode, Message: http.StatusText(rsp.StatusCode)}
+	b, err := io.ReadAll(io.LimitReader(rsp.Body, maxErrorSize))
+	if err != nil {
+		return e
+	}
+	var body Error
+	if err := json.Unmarshal(b, &body); err != nil || body.Code == "" {
+		return e
+	}
+	body.Status = rsp.StatusCode
+	return &body
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"system-transparency.org/stprov/internal/secrets"
+	"system-transparency.org/stprov/internal/store"
+)
+
+func TestToError(t *testing.T) {
+	for _, table := range []struct {
+		desc   string
+		status int
+		err    error
+		want   *Error
+	}{
+		{
+			"structured",
+			http.StatusBadRequest,
+			fmt.Errorf("wrapped: %w", newError(http.StatusBadRequest, CodeSecureBoot, "KEK", fmt.Errorf("invalid signature"))),
+			&Error{Status: http.StatusBadRequest, Code: CodeSecureBoot, Step: "KEK", Message: "invalid signature"},
+		},
+		{
+			"state",
+			http.StatusConflict,
+			&StateError{Endpoint: EndpointCommit, State: StateAwaitData, Expected: []State{StateDataAdded}},
+			&Error{Status: http.StatusConflict, Code: CodeState, Step: EndpointCommit, Message: "not accepted in state await-data, expected data-added"},
+		},
+		{
+			"bad request",
+			http.StatusBadRequest,
+			fmt.Errorf("invalid unix timestamp -1"),
+			&Error{Status: http.StatusBadRequest, Code: CodeBadRequest, Message: "invalid unix timestamp -1"},
+		},
+		{
+			"internal",
+			http.StatusInternalServerError,
+			fmt.Errorf("ssh: failed"),
+			&Error{Status: http.StatusInternalServerError, Code: CodeInternal, Message: "ssh: failed"},
+		},
+	} {
+		if got := toError(table.status, table.err); !reflect.DeepEqual(got, table.want) {
+			t.Errorf("%s: got %+v but wanted %+v", table.desc, got, table.want)
+		}
+	}
+}
+
+func TestReadError(t *testing.T) {
+	want := &Error{Status: http.StatusBadRequest, Code: CodeSecureBoot, Step: "KEK", Message: "invalid signature"}
+	w := httptest.NewRecorder()
+	writeError(w, want)
+	if got, want := w.Header().Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("got content type %q but wanted %q", got, want)
+	}
+	if got := readError(w.Result()); !reflect.DeepEqual(got, want) {
+		t.Errorf("structured: got %+v but wanted %+v", got, want)
+	}
+	if got, want := want.Error(), "KEK: invalid signature (secure-boot)"; got != want {
+		t.Errorf("got error string %q but wanted %q", got, want)
+	}
+
+	rsp := &http.Response{
+		StatusCode: http.StatusNotFound,
+		Body:       io.NopCloser(bytes.NewBufferString("404 page not found\n")),
+	}
+	e := readError(rsp)
+	if got, want := e, (&Error{Status: http.StatusNotFound, Message: "Not Found"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("unstructured: got %+v but wanted %+v", got, want)
+	}
+	if got, want := e.Error(), "Not Found"; got != want {
+		t.Errorf("unstructured: got error string %q but wanted %q", got, want)
+	}
+}
+
+func TestNotSetupMode(t *testing.T) {
+	srv := testServer(t)
+	var err error
+	if srv.Store, err = store.NewDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	guid := uuid.MustParse("8be4df61-93ca-11d2-aa0d-00e098032b8c")
+	if err := store.Write(srv.Store, "SetupMode", &guid, []byte{0}); err != nil {
+		t.Fatal(err)
+	}
+
+	apiErr := addSecureBoot(t, srv)
+	if got, want := apiErr.Status, http.StatusForbidden; got != want {
+		t.Errorf("got http status code %d but wanted %d", got, want)
+	}
+	if got, want := apiErr.Code, CodeNotSetupMode; got != want {
+		t.Errorf("got code %q but wanted %q", got, want)
+	}
+}
+
+func TestNoSecureBoot(t *testing.T) {
+	srv := testServer(t)
+	srv.NoSecureBoot = true
+
+	apiErr := addSecureBoot(t, srv)
+	if got, want := apiErr.Status, http.StatusForbidden; got != want {
+		t.Errorf("got http status code %d but wanted %d", got, want)
+	}
+	if got, want := apiErr.Code, CodeNoSecureBoot; got != want {
+		t.Errorf("got code %q but wanted %q", got, want)
+	}
+	if got, want := srv.state, StateDataAdded; got != want {
+		t.Errorf("got state %v but wanted %v", got, want)
+	}
+}
+
+func TestNoPlaintextKeys(t *testing.T) {
+	for _, table := range []struct {
+		desc     string
+		state    State
+		endpoint string
+		query    string
+		body     string
+	}{
+		{"derive", StateAwaitData, EndpointAddData, "", fmt.Sprintf(`{"entropy":"%s","timestamp":1,"derive":["age"]}`, b64Ones(t, secrets.EntropyBytes))},
+		{"host key passphrase", StateAwaitData, EndpointAddData, "", fmt.Sprintf(`{"entropy":"%s","timestamp":1,"host_key_passphrase":"%s"}`, b64Ones(t, secrets.EntropyBytes), b64Ones(t, 8))},
+		{"x509 certificate", StateDataAdded, EndpointCommit, "?" + QueryX509Cert + "=true", ""},
+	} {
+		srv := testServer(t)
+		srv.NoPlaintextKeys = true
+
+		apiErr := request(t, srv, table.state, table.endpoint, table.query, table.body)
+		if got, want := apiErr.Status, http.StatusForbidden; got != want {
+			t.Errorf("%s: got http status code %d but wanted %d", table.desc, got, want)
+		}
+		if got, want := apiErr.Code, CodeNoPlaintextKeys; got != want {
+			t.Errorf("%s: got code %q but wanted %q", table.desc, got, want)
+		}
+		if got, want := srv.state, table.state; got != want {
+			t.Errorf("%s: got state %v but wanted %v", table.desc, got, want)
+		}
+	}
+}
+
+// addSecureBoot sends an empty add-secure-boot request in an authenticated
+// session, outputting the error that the server responded with
+func addSecureBoot(t *testing.T, srv *Server) *Error {
+	t.Helper()
+	return request(t, srv, StateDataAdded, EndpointAddSecureBoot, "", `{}`)
+}
+
+// request sends a request in a given state of an authenticated session,
+// outputting the error that the server responded with
+func request(t *testing.T, srv *Server, state State, endpoint, query, body string) *Error {
+	t.Helper()
+	srv.state = state
+	password := testSession(t, srv)
+
+	handler := getHandler(t, srv, endpoint)
+	req, err := http.NewRequest(handler.Method, "http://example.com"+handler.path()+query, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("create http request: %v", err)
+	}
+	req.RemoteAddr = "127.0.0.12:2009"
+	req.SetBasicAuth(BasicAuthUser, password)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var apiErr *Error
+	if err := error(readError(w.Result())); !errors.As(err, &apiErr) {
+		t.Fatalf("got error %v", err)
+	}
+	return apiErr
+}
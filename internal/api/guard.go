@@ -0,0 +1,151 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxFailures = 10 // failed authentication attempts before lockout
+
+	backoffBase = time.Second // wait after a source's first failure
+	backoffMax  = time.Minute // maximum wait after a source's failure
+)
+
+// ErrLockout is returned by Server.Run if it shut down permanently because of
+// too many failed authentication attempts
+var ErrLockout = errors.New("too many failed authentication attempts")
+
+// Failures summarizes failed authentication attempts
+type Failures struct {
+	Total   int            // failed attempts from all sources
+	Sources map[string]int // failed attempts per source IP address
+	Lockout bool           // true if the maximum number of failures was reached
+}
+
+// String outputs a one-line summary, e.g., "3 (10.0.0.1: 2, 10.0.0.2: 1)"
+func (f Failures) String() string {
+	if f.Total == 0 {
+		return "0"
+	}
+	var ips []string
+	for ip := range f.Sources {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	var sources []string
+	for _, ip := range ips {
+		sources = append(sources, fmt.Sprintf("%s: %d", ip, f.Sources[ip]))
+	}
+	return fmt.Sprintf("%d (%s)", f.Total, strings.Join(sources, ", "))
+}
+
+// guard counts failed authentication attempts per source IP address and in
+// total.  A source must back off exponentially after each of its failures, and
+// the guard locks permanently when the total reaches maxFailures.
+type guard struct {
+	sync.Mutex
+	maxFailures int
+	now         func() time.Time
+
+	total   int
+	sources map[string]*source
+	locked  chan struct{} // closed on lockout
+}
+
+type source struct {
+	failures int
+	last     time.Time // time of the most recent failure
+}
+
+func newGuard(maxFailures int, now func() time.Time) *guard {
+	return &guard{
+		maxFailures: maxFailures,
+		now:         now,
+		sources:     make(map[string]*source),
+		locked:      make(chan struct{}),
+	}
+}
+
+// check outputs how long a source must wait before its next attempt.  An error
+// is returned if the guard is locked.
+func (g *guard) check(ip string) (time.Duration, error) {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.isLocked() {
+		return 0, ErrLockout
+	}
+	src, ok := g.sources[ip]
+	if !ok {
+		return 0, nil
+	}
+	wait := src.last.Add(backoff(src.failures)).Sub(g.now())
+	if wait < 0 {
+		return 0, nil
+	}
+	return wait, nil
+}
+
+// fail records a failed attempt, returning true if it caused a lockout
+func (g *guard) fail(ip string) bool {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.isLocked() {
+		return false
+	}
+	src, ok := g.sources[ip]
+	if !ok {
+		src = &source{}
+		g.sources[ip] = src
+	}
+	src.failures++
+	src.last = g.now()
+	g.total++
+	if g.total < g.maxFailures {
+		return false
+	}
+	close(g.locked)
+	return true
+}
+
+func (g *guard) failures() Failures {
+	g.Lock()
+	defer g.Unlock()
+
+	f := Failures{Total: g.total, Sources: make(map[string]int), Lockout: g.isLocked()}
+	for ip, src := range g.sources {
+		f.Sources[ip] = src.failures
+	}
+	return f
+}
+
+func (g *guard) isLocked() bool {
+	select {
+	case <-g.locked:
+		return true
+	default:
+		return false
+	}
+}
+
+// backoff outputs how long to wait after a given number of failures
+func backoff(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	wait := backoffBase
+	for i := 1; i < failures && wait < backoffMax; i++ {
+		wait *= 2
+	}
+	if wait > backoffMax {
+		return backoffMax
+	}
+	return wait
+}
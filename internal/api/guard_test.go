@@ -0,0 +1,69 @@
+package api
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGuard(t *testing.T) {
+	now := time.Unix(0, 0)
+	g := newGuard(3, func() time.Time { return now })
+	check := func(desc, ip string, wantWait time.Duration, wantErr error) {
+		t.Helper()
+		wait, err := g.check(ip)
+		if got, want := err, wantErr; !errors.Is(got, want) {
+			t.Errorf("%s: got error %v but wanted %v", desc, got, want)
+		}
+		if got, want := wait, wantWait; got != want {
+			t.Errorf("%s: got wait %v but wanted %v", desc, got, want)
+		}
+	}
+
+	check("no failures", "10.0.0.1", 0, nil)
+	if g.fail("10.0.0.1") {
+		t.Errorf("first failure: got lockout")
+	}
+	check("first failure", "10.0.0.1", time.Second, nil)
+	check("other source", "10.0.0.2", 0, nil)
+
+	now = now.Add(time.Second)
+	check("waited", "10.0.0.1", 0, nil)
+	if g.fail("10.0.0.1") {
+		t.Errorf("second failure: got lockout")
+	}
+	check("second failure", "10.0.0.1", 2*time.Second, nil)
+	if !g.fail("10.0.0.2") {
+		t.Errorf("third failure: got no lockout")
+	}
+	check("lockout", "10.0.0.3", 0, ErrLockout)
+	if g.fail("10.0.0.3") {
+		t.Errorf("failure after lockout: got lockout again")
+	}
+
+	f := g.failures()
+	if got, want := f.String(), "3 (10.0.0.1: 2, 10.0.0.2: 1)"; got != want {
+		t.Errorf("got summary %q but wanted %q", got, want)
+	}
+	if !f.Lockout {
+		t.Errorf("got no lockout in summary")
+	}
+}
+
+func TestBackoffDuration(t *testing.T) {
+	for _, table := range []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{6, 32 * time.Second},
+		{7, time.Minute},
+		{100, time.Minute},
+	} {
+		if got := backoff(table.failures); got != table.want {
+			t.Errorf("%d failure(s): got %v but wanted %v", table.failures, got, table.want)
+		}
+	}
+}
@@ -2,17 +2,24 @@ package api
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"time"
 
 	"system-transparency.org/stboot/stlog"
+	"system-transparency.org/stprov/internal/pake"
+	"system-transparency.org/stprov/internal/pki"
 	"system-transparency.org/stprov/internal/sb"
 	"system-transparency.org/stprov/internal/secrets"
+	"system-transparency.org/stprov/internal/ssh"
+	"system-transparency.org/stprov/internal/version"
 )
 
 // Handler implements the http.Handler interface
@@ -20,9 +27,18 @@ type Handler struct {
 	Server      *Server
 	Endpoint    string
 	Method      string
+	Public      bool // no basic auth, only used to start a PAKE exchange
 	HandlerFunc func(context.Context, *Server, http.ResponseWriter, *http.Request) (int, error)
 }
 
+// path outputs the URL path that a handler is served on
+func (h Handler) path() string {
+	if h.Endpoint == EndpointHello {
+		return "/" + EndpointHello
+	}
+	return "/" + Protocol + "/" + h.Endpoint
+}
+
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithDeadline(r.Context(), time.Now().Add(h.Server.Deadline))
 	defer cancel()
@@ -33,12 +49,19 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if ok := h.verifyNetwork(w, r); !ok {
 		return
 	}
-	if ok := h.authenticateUser(w, r); !ok {
+	if ok := h.verifyBackoff(w, r); !ok {
 		return
 	}
+	if !h.Public {
+		if ok := h.authenticateUser(w, r); !ok {
+			return
+		}
+		h.Server.stateLock.Lock()
+		defer h.Server.stateLock.Unlock()
+	}
 
 	if code, err := h.HandlerFunc(ctx, h.Server, w, r); err != nil {
-		http.Error(w, http.StatusText(code), code)
+		writeError(w, toError(code, err))
 	}
 }
 
@@ -56,7 +79,7 @@ func (h Handler) verifyMethod(w http.ResponseWriter, r *http.Request) bool {
 	}
 
 	log.Printf("unexpected http method %s", r.Method)
-	http.Error(w, fmt.Sprintf("%s", http.StatusText(code)), code)
+	writeError(w, newError(code, CodeMethod, "", fmt.Errorf("unexpected http method %s", r.Method)))
 	return false
 }
 
@@ -65,13 +88,13 @@ func (h Handler) verifyNetwork(w http.ResponseWriter, r *http.Request) bool {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		log.Printf("failed parsing request address %s", r.RemoteAddr)
-		http.Error(w, "Malformed address:port format", http.StatusInternalServerError)
+		writeError(w, newError(http.StatusInternalServerError, CodeInternal, "", fmt.Errorf("malformed address:port format")))
 		return false
 	}
 	ip := net.ParseIP(host)
 	if ip == nil {
 		log.Printf("failed parsing request ip %s", r.RemoteAddr)
-		http.Error(w, "Hostname must be an IP address", http.StatusInternalServerError)
+		writeError(w, newError(http.StatusInternalServerError, CodeInternal, "", fmt.Errorf("hostname must be an IP address")))
 		return false
 	}
 	for _, allowedNet := range h.Server.LocalCIDR {
@@ -80,27 +103,137 @@ func (h Handler) verifyNetwork(w http.ResponseWriter, r *http.Request) bool {
 		}
 	}
 	log.Printf("blocked connection attempt from %s", r.RemoteAddr)
-	http.Error(w, "Invalid IP address", http.StatusForbidden)
+	writeError(w, newError(http.StatusForbidden, CodeNetwork, "", fmt.Errorf("source ip address %s is not allowed", ip)))
 	return false
 }
 
-// authenticateUser enforces basic auth as defined in RFC 2617, Section 2.
-func (h Handler) authenticateUser(w http.ResponseWriter, r *http.Request) bool {
-	user, password, ok := r.BasicAuth()
-	if !ok {
-		log.Printf("request without basic auth header from %s", r.RemoteAddr)
-		http.Error(w, "BasicAuth header is required", http.StatusForbidden)
+// verifyBackoff enforces that the client backs off after failed authentication
+// attempts, and that no requests are served after a lockout.  See RFC 6585,
+// Section 4 (Status 429) and RFC 9110, Section 15.6.4 (Status 503).
+func (h Handler) verifyBackoff(w http.ResponseWriter, r *http.Request) bool {
+	wait, err := h.Server.guard.check(sourceIP(r))
+	if err != nil {
+		log.Printf("refused request from %s: %v", r.RemoteAddr, err)
+		writeError(w, newError(http.StatusServiceUnavailable, CodeLockout, "", err))
 		return false
 	}
-	if user != BasicAuthUser || password != h.Server.basicAuthPassword {
-		log.Printf("unauthorized user %q and password %q from %s", user, password, r.RemoteAddr)
-		http.Error(w, "BasicAuth credentials were insufficient", http.StatusForbidden)
+	if wait > 0 {
+		log.Printf("refused request from %s: must back off for %v", r.RemoteAddr, wait.Round(time.Millisecond))
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int64(math.Ceil(wait.Seconds()))))
+		writeError(w, newError(http.StatusTooManyRequests, CodeBackoff, "", fmt.Errorf("retry after %v", wait.Round(time.Second))))
 		return false
 	}
 	return true
 }
 
+// authenticateUser enforces basic auth as defined in RFC 2617, Section 2.  The
+// credentials are never logged, see checkCredentials().
+func (h Handler) authenticateUser(w http.ResponseWriter, r *http.Request) bool {
+	if err := h.Server.checkCredentials(r); err != nil {
+		log.Printf("unauthorized request from %s: %v", r.RemoteAddr, err)
+		h.Server.fail(sourceIP(r))
+		writeError(w, newError(http.StatusForbidden, CodeUnauthorized, "", err))
+		return false
+	}
+	return true
+}
+
+func handleHello(ctx context.Context, s *Server, w http.ResponseWriter, r *http.Request) (int, error) {
+	hello := HelloResponse{
+		Protocols: Protocols,
+		Version:   version.Version,
+		HostName:  s.HostName,
+	}
+	if s.Store != nil {
+		if ok, err := sb.IsSetupMode(s.Store); err == nil {
+			hello.SetupMode = &ok
+		}
+	}
+	for _, handler := range s.handlers() {
+		hello.Endpoints = append(hello.Endpoints, handler.Endpoint)
+	}
+
+	b, err := json.Marshal(hello)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("marshal hello response: %w", err)
+	}
+	if _, err := w.Write(b); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("write hello response: %w", err)
+	}
+	return http.StatusOK, nil
+}
+
+func handlePAKE(ctx context.Context, s *Server, w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.TLS == nil {
+		log.Printf("invalid pake request from %s: no tls connection", r.RemoteAddr)
+		return http.StatusBadRequest, fmt.Errorf("tls is required")
+	}
+	var data PAKERequest
+	if err := unpackPost(r, &data); err != nil {
+		log.Printf("invalid pake request from %s: %v", r.RemoteAddr, err)
+		return http.StatusBadRequest, err
+	}
+
+	st, err := pake.NewServer(s.password, rand.Reader)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("pake: %w", err)
+	}
+	aad, err := r.TLS.ExportKeyingMaterial(ExporterLabelPAKE, nil, exporterSize)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("export keying material: %w", err)
+	}
+	keys, err := st.Finish(data.Message, aad)
+	if err != nil {
+		log.Printf("invalid pake request from %s: %v", r.RemoteAddr, err)
+		return http.StatusBadRequest, err
+	}
+	b, err := json.Marshal(PAKEResponse{Message: st.Message()})
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("marshal pake response: %w", err)
+	}
+
+	s.addSession(data.Message, keys)
+	if _, err := w.Write(b); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("write pake response: %w", err)
+	}
+	return http.StatusOK, nil
+}
+
+func handlePAKEConfirm(ctx context.Context, s *Server, w http.ResponseWriter, r *http.Request) (int, error) {
+	var data PAKEConfirmRequest
+	if err := unpackPost(r, &data); err != nil {
+		log.Printf("invalid pake-confirm request from %s: %v", r.RemoteAddr, err)
+		return http.StatusBadRequest, err
+	}
+	keys, err := s.confirmSession(data.Message, data.Confirmation)
+	if errors.Is(err, errUnknownSession) {
+		log.Printf("invalid pake-confirm request from %s: %v", r.RemoteAddr, err)
+		return http.StatusBadRequest, err
+	}
+	if errors.Is(err, pake.ErrConfirmation) {
+		log.Printf("failed pake key confirmation from %s, is the one-time password correct?", r.RemoteAddr)
+		s.fail(sourceIP(r))
+		return http.StatusForbidden, newError(http.StatusForbidden, CodeConfirmation, "", err)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	b, err := json.Marshal(PAKEConfirmResponse{Confirmation: keys.ServerConfirmation})
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("marshal pake-confirm response: %w", err)
+	}
+	if _, err := w.Write(b); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("write pake-confirm response: %w", err)
+	}
+	return http.StatusOK, nil
+}
+
 func handleAddData(ctx context.Context, s *Server, w http.ResponseWriter, r *http.Request) (int, error) {
+	if err := s.checkState(EndpointAddData, StateAwaitData); err != nil {
+		log.Printf("unexpected add-data request from %s: %v", r.RemoteAddr, err)
+		return http.StatusConflict, err
+	}
 	var data AddDataRequest
 	if err := unpackPost(r, &data); err != nil {
 		log.Printf("invalid add-entropy request from %s: %v", r.RemoteAddr, err)
@@ -114,32 +247,82 @@ func handleAddData(ctx context.Context, s *Server, w http.ResponseWriter, r *htt
 		log.Printf("invalid add-data request from %s: negative timestamp value", r.RemoteAddr)
 		return http.StatusBadRequest, fmt.Errorf("invalid unix timestamp %d", got)
 	}
+	if got := len(data.HostKeyPassphrase); got > MaxHostKeyPassphraseSize {
+		log.Printf("invalid add-data request from %s: host key passphrase too large", r.RemoteAddr)
+		return http.StatusBadRequest, fmt.Errorf("invalid host key passphrase size %d", got)
+	}
+	if err := CheckHostKeyType(data.HostKeyType); err != nil {
+		log.Printf("invalid add-data request from %s: %v", r.RemoteAddr, err)
+		return http.StatusBadRequest, err
+	}
+	if err := CheckDerivations(data.Derive); err != nil {
+		log.Printf("invalid add-data request from %s: %v", r.RemoteAddr, err)
+		return http.StatusBadRequest, err
+	}
+	if len(data.Derive) > 0 && s.NoPlaintextKeys {
+		err := fmt.Errorf("derived keys are refused by stprov remote")
+		log.Printf("add-data request from %s: %v", r.RemoteAddr, err)
+		return http.StatusForbidden, newError(http.StatusForbidden, CodeNoPlaintextKeys, "", err)
+	}
+	if len(data.HostKeyPassphrase) > 0 && s.NoPlaintextKeys {
+		err := fmt.Errorf("host key passphrase is refused by stprov remote")
+		log.Printf("add-data request from %s: %v", r.RemoteAddr, err)
+		return http.StatusForbidden, newError(http.StatusForbidden, CodeNoPlaintextKeys, "", err)
+	}
+
+	sas, err := ShortAuthString(r.TLS, data.Entropy)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("short authentication string: %w", err)
+	}
+	ekm, err := r.TLS.ExportKeyingMaterial(ExporterLabelUDS, nil, exporterSize)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("export keying material: %w", err)
+	}
 
 	s.Timestamp = data.Timestamp
+	s.SAS = sas
+	s.ekm = ekm
+	s.HostKeyPassphrase = data.HostKeyPassphrase
+	s.HostKeyType = data.HostKeyType
+	if s.HostKeyType == "" {
+		s.HostKeyType = ssh.DefaultKeyType
+	}
+	s.Derive = data.Derive
 	copy(s.Entropy[:], data.Entropy)
+	s.state = StateDataAdded
 	return http.StatusOK, nil
 }
 
 func handleAddSecureBoot(ctx context.Context, s *Server, w http.ResponseWriter, r *http.Request) (int, error) {
+	if err := s.checkState(EndpointAddSecureBoot, StateDataAdded); err != nil {
+		log.Printf("unexpected add-secure-boot request from %s: %v", r.RemoteAddr, err)
+		return http.StatusConflict, err
+	}
+	if s.NoSecureBoot {
+		err := fmt.Errorf("secure boot provisioning is refused by stprov remote")
+		log.Printf("add-secure-boot request from %s: %v, aborting", r.RemoteAddr, err)
+		return http.StatusForbidden, newError(http.StatusForbidden, CodeNoSecureBoot, "", err)
+	}
+
 	var rebootIntoUEFIMenu bool
 	defer func() {
 		if !rebootIntoUEFIMenu {
 			return
 		}
-		if err := sb.RequestRebootIntoUEFIMenu(); err != nil {
+		if err := sb.RequestRebootIntoUEFIMenu(s.Store); err != nil {
 			log.Printf("failed to request reboot into UEFI menu: %v", err)
 			return
 		}
 		stlog.Info("requested the firmware to reboot into the UEFI menu on next boot")
 	}()
 
-	ok, err := sb.IsSetupMode()
+	ok, err := sb.IsSetupMode(s.Store)
 	if err != nil {
 		log.Printf("add-secure boot request from %s: failed to read SetupMode EFI variable, trying to proceed anyway", r.RemoteAddr)
 	} else if !ok {
 		err = fmt.Errorf("not in setup mode")
 		log.Printf("add-secure boot request from %s: %v, aborting", r.RemoteAddr, err)
-		return http.StatusForbidden, err
+		return http.StatusForbidden, newError(http.StatusForbidden, CodeNotSetupMode, "", err)
 	}
 
 	var data AddSecureBootRequest
@@ -151,24 +334,48 @@ func handleAddSecureBoot(ctx context.Context, s *Server, w http.ResponseWriter,
 		return http.StatusBadRequest, err
 	}
 	rebootIntoUEFIMenu = data.RebootIntoUEFIMenu
-	if err := sb.Provision(data.PK, data.KEK, data.Db, data.Dbx); err != nil {
+	if err := sb.Provision(s.Store, data.PK, data.KEK, data.Db, data.Dbx); err != nil {
 		log.Printf("failed to provision secure boot request from %s: %v", r.RemoteAddr, err)
-		return http.StatusBadRequest, err
+		var provisionErr *sb.ProvisionError
+		if errors.As(err, &provisionErr) {
+			return http.StatusBadRequest, newError(http.StatusBadRequest, CodeSecureBoot, provisionErr.Variable, provisionErr.Err)
+		}
+		return http.StatusBadRequest, newError(http.StatusBadRequest, CodeSecureBoot, "", err)
 	}
 
 	stlog.Info("efivarfs: Secure Boot keys provisioned")
+	s.state = StateSecureBootAdded
 	return http.StatusOK, nil
 }
 
 func handleCommit(ctx context.Context, s *Server, w http.ResponseWriter, r *http.Request) (int, error) {
-	uds, err := secrets.NewUniqueDeviceSecret(&s.Entropy)
+	if err := s.checkState(EndpointCommit, StateDataAdded, StateSecureBootAdded); err != nil {
+		log.Printf("unexpected commit request from %s: %v", r.RemoteAddr, err)
+		return http.StatusConflict, err
+	}
+	x509Cert := r.URL.Query().Get(QueryX509Cert) == "true"
+	if x509Cert && s.NoPlaintextKeys {
+		err := fmt.Errorf("x509 identity certificates are refused by stprov remote")
+		log.Printf("commit request from %s: %v", r.RemoteAddr, err)
+		return http.StatusForbidden, newError(http.StatusForbidden, CodeNoPlaintextKeys, "", err)
+	}
+	uds, err := secrets.NewUniqueDeviceSecret(&s.Entropy, s.ekm)
 	if err != nil {
 		return http.StatusInternalServerError, fmt.Errorf("new unique device secret: %w", err)
 	}
-	cr, err := NewCommitResponse(uds, s.HostName)
+	cr, err := NewCommitResponse(uds, s.HostKeyType, s.HostName, s.Derive)
 	if err != nil {
 		return http.StatusInternalServerError, fmt.Errorf("new commit response: %w", err)
 	}
+	if x509Cert {
+		key, err := uds.X509()
+		if err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("x509 key: %w", err)
+		}
+		if cr.CSR, err = pki.NewCSR(key, s.HostName); err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("new csr: %w", err)
+		}
+	}
 	b, err := json.Marshal(cr)
 	if err != nil {
 		return http.StatusInternalServerError, fmt.Errorf("marshal commit response: %w", err)
@@ -178,10 +385,109 @@ func handleCommit(ctx context.Context, s *Server, w http.ResponseWriter, r *http
 	}
 
 	s.UDS = uds
+	s.x509Cert = x509Cert
+	if r.URL.Query().Get(QueryHostCert) == "true" {
+		s.state = StateAwaitHostCert
+		return http.StatusOK, nil
+	}
+	if s.x509Cert {
+		s.state = StateAwaitX509Cert
+		return http.StatusOK, nil
+	}
+	s.state = StateCommitted
+	s.commit <- struct{}{}
+	return http.StatusOK, nil
+}
+
+func handleAddHostCert(ctx context.Context, s *Server, w http.ResponseWriter, r *http.Request) (int, error) {
+	if err := s.checkState(EndpointAddHostCert, StateAwaitHostCert); err != nil {
+		log.Printf("unexpected add-host-cert request from %s: %v", r.RemoteAddr, err)
+		return http.StatusConflict, err
+	}
+
+	var data AddHostCertRequest
+	if err := unpackPost(r, &data); err != nil {
+		log.Printf("invalid add-host-cert request from %s: %v", r.RemoteAddr, err)
+		return http.StatusBadRequest, err
+	}
+	hk, err := s.UDS.SSH(s.HostKeyType)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("ssh: %w", err)
+	}
+	if err := hk.CheckHostCert(data.Certificate); err != nil {
+		log.Printf("invalid add-host-cert request from %s: %v", r.RemoteAddr, err)
+		return http.StatusBadRequest, newError(http.StatusBadRequest, CodeHostCert, "", err)
+	}
+
+	s.HostCert = data.Certificate
+	if s.x509Cert {
+		s.state = StateAwaitX509Cert
+		return http.StatusOK, nil
+	}
+	s.state = StateCommitted
 	s.commit <- struct{}{}
 	return http.StatusOK, nil
 }
 
+func handleAddX509Cert(ctx context.Context, s *Server, w http.ResponseWriter, r *http.Request) (int, error) {
+	if err := s.checkState(EndpointAddX509Cert, StateAwaitX509Cert); err != nil {
+		log.Printf("unexpected add-x509-cert request from %s: %v", r.RemoteAddr, err)
+		return http.StatusConflict, err
+	}
+
+	var data AddX509CertRequest
+	if err := unpackPost(r, &data); err != nil {
+		log.Printf("invalid add-x509-cert request from %s: %v", r.RemoteAddr, err)
+		return http.StatusBadRequest, err
+	}
+	key, err := s.UDS.X509()
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("x509 key: %w", err)
+	}
+	if err := pki.CheckCert(data.Certificate, key.Public()); err != nil {
+		log.Printf("invalid add-x509-cert request from %s: %v", r.RemoteAddr, err)
+		return http.StatusBadRequest, newError(http.StatusBadRequest, CodeX509Cert, "", err)
+	}
+
+	s.X509Cert = data.Certificate
+	s.state = StateCommitted
+	s.commit <- struct{}{}
+	return http.StatusOK, nil
+}
+
+func handleAbort(ctx context.Context, s *Server, w http.ResponseWriter, r *http.Request) (int, error) {
+	if err := s.checkState(EndpointAbort, StateAwaitData, StateDataAdded, StateSecureBootAdded, StateAwaitHostCert, StateAwaitX509Cert); err != nil {
+		log.Printf("unexpected abort request from %s: %v", r.RemoteAddr, err)
+		return http.StatusConflict, err
+	}
+
+	log.Printf("aborted by %s", r.RemoteAddr)
+	s.state = StateAborted
+	s.commit <- struct{}{}
+	return http.StatusOK, nil
+}
+
+func handleState(ctx context.Context, s *Server, w http.ResponseWriter, r *http.Request) (int, error) {
+	b, err := json.Marshal(StateResponse{State: s.state})
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("marshal state response: %w", err)
+	}
+	if _, err := w.Write(b); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("write state response: %w", err)
+	}
+	return http.StatusOK, nil
+}
+
+// sourceIP outputs the IP address of a request's source.  The address is
+// expected to be valid, see verifyNetwork().
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func unpackPost(req *http.Request, any interface{}) error {
 	b, err := io.ReadAll(req.Body)
 	if err != nil {
@@ -2,14 +2,35 @@ package api
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+
+	"system-transparency.org/stprov/internal/pake"
+	"system-transparency.org/stprov/internal/pki"
 	"system-transparency.org/stprov/internal/secrets"
+	stssh "system-transparency.org/stprov/internal/ssh"
+	"system-transparency.org/stprov/internal/store"
 )
 
 func TestVerifyMethod(t *testing.T) {
@@ -62,7 +83,6 @@ func TestVerifyMethod(t *testing.T) {
 
 func TestVerifyNetwork(t *testing.T) {
 	srv := testServer(t)
-	defer close(srv.commit)
 	for _, handler := range srv.handlers() {
 		url := "http://example.com/" + Protocol + "/" + handler.Endpoint
 		req, err := http.NewRequest(handler.Method, url, nil)
@@ -93,7 +113,6 @@ func TestVerifyNetwork(t *testing.T) {
 
 func TestAuthenticateUser(t *testing.T) {
 	srv := testServer(t)
-	defer close(srv.commit)
 	for _, handler := range srv.handlers() {
 		url := "http://example.com/" + Protocol + "/" + handler.Endpoint
 		req, err := http.NewRequest(handler.Method, url, nil)
@@ -107,7 +126,7 @@ func TestAuthenticateUser(t *testing.T) {
 		}{
 			{"no password", ""},
 			{"bad password", "hotdog"},
-			{"valid", srv.basicAuthPassword},
+			{"valid", testSession(t, srv)},
 		} {
 			if table.pw != "" {
 				req.SetBasicAuth(BasicAuthUser, table.pw)
@@ -124,8 +143,9 @@ func TestAuthenticateUser(t *testing.T) {
 
 func TestAddData(t *testing.T) {
 	srv := testServer(t)
-	defer close(srv.commit)
 	handler := getHandler(t, srv, EndpointAddData)
+	password := testSession(t, srv)
+	cs := testTLS(t)
 	for _, table := range []struct {
 		desc string
 		body io.Reader
@@ -134,7 +154,11 @@ func TestAddData(t *testing.T) {
 		{"no entropy", bytes.NewBuffer([]byte(fmt.Sprintf(`{"timestamp":1}`)))},
 		{"bad entropy", bytes.NewBuffer([]byte(fmt.Sprintf(`{"entropy":"%s","timestamp":1}`, b64Ones(t, secrets.EntropyBytes+1))))},
 		{"bad timestamp", bytes.NewBuffer([]byte(fmt.Sprintf(`{"entropy":"%s","timestamp":-1}`, b64Ones(t, secrets.EntropyBytes))))},
-		{"valid", bytes.NewBuffer([]byte(fmt.Sprintf(`{"entropy":"%s","timestamp":1}`, b64Ones(t, secrets.EntropyBytes))))},
+		{"bad passphrase", bytes.NewBuffer([]byte(fmt.Sprintf(`{"entropy":"%s","timestamp":1,"host_key_passphrase":"%s"}`, b64Ones(t, secrets.EntropyBytes), b64Ones(t, MaxHostKeyPassphraseSize+1))))},
+		{"bad key type", bytes.NewBuffer([]byte(fmt.Sprintf(`{"entropy":"%s","timestamp":1,"host_key_type":"dsa"}`, b64Ones(t, secrets.EntropyBytes))))},
+		{"bad derive", bytes.NewBuffer([]byte(fmt.Sprintf(`{"entropy":"%s","timestamp":1,"derive":["ssh"]}`, b64Ones(t, secrets.EntropyBytes))))},
+		{"repeated derive", bytes.NewBuffer([]byte(fmt.Sprintf(`{"entropy":"%s","timestamp":1,"derive":["age","age"]}`, b64Ones(t, secrets.EntropyBytes))))},
+		{"valid", bytes.NewBuffer([]byte(fmt.Sprintf(`{"entropy":"%s","timestamp":1,"host_key_passphrase":"%s","host_key_type":"rsa-3072","derive":["wireguard","age"]}`, b64Ones(t, secrets.EntropyBytes), b64Ones(t, 8))))},
 	} {
 		url := "http://example.com/" + Protocol + "/" + handler.Endpoint
 		req, err := http.NewRequest(handler.Method, url, table.body)
@@ -142,7 +166,8 @@ func TestAddData(t *testing.T) {
 			t.Fatalf("create http request: %v", err)
 		}
 		req.RemoteAddr = "127.0.0.12:2009"
-		req.SetBasicAuth(BasicAuthUser, srv.basicAuthPassword)
+		req.SetBasicAuth(BasicAuthUser, password)
+		req.TLS = cs
 
 		w := httptest.NewRecorder()
 		handler.ServeHTTP(w, req)
@@ -159,13 +184,32 @@ func TestAddData(t *testing.T) {
 		if got, want := srv.Entropy[:], bytes.Repeat([]byte{0xff}, secrets.EntropyBytes); !bytes.Equal(got, want) {
 			t.Errorf("%s: got entropy\n%v\nbut wanted\n%v", table.desc, got, want)
 		}
+		sas, err := ShortAuthString(cs, srv.Entropy[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := srv.SAS, sas; got != want {
+			t.Errorf("%s: got short authentication string %q but wanted %q", table.desc, got, want)
+		}
+		if got, want := len(srv.ekm), exporterSize; got != want {
+			t.Errorf("%s: got %d bytes of exported keying material but wanted %d", table.desc, got, want)
+		}
+		if got, want := srv.HostKeyPassphrase, bytes.Repeat([]byte{0xff}, 8); !bytes.Equal(got, want) {
+			t.Errorf("%s: got host key passphrase %x but wanted %x", table.desc, got, want)
+		}
+		if got, want := srv.HostKeyType, stssh.KeyTypeRSA3072; got != want {
+			t.Errorf("%s: got host key type %q but wanted %q", table.desc, got, want)
+		}
+		if got, want := srv.Derive, []string{"wireguard", "age"}; !slices.Equal(got, want) {
+			t.Errorf("%s: got derive %v but wanted %v", table.desc, got, want)
+		}
 	}
 }
 
 func TestCommit(t *testing.T) {
 	srv := testServer(t)
-	defer close(srv.commit)
 	handler := getHandler(t, srv, EndpointCommit)
+	password := testSession(t, srv)
 
 	url := "http://example.com/" + Protocol + "/" + handler.Endpoint
 	req, err := http.NewRequest(handler.Method, url, nil)
@@ -173,13 +217,108 @@ func TestCommit(t *testing.T) {
 		t.Fatalf("create http request: %v", err)
 	}
 	req.RemoteAddr = "127.0.0.12:2009"
-	req.SetBasicAuth(BasicAuthUser, srv.basicAuthPassword)
+	req.SetBasicAuth(BasicAuthUser, password)
 
 	w := httptest.NewRecorder()
 	handler.ServeHTTP(w, req)
+	if got, want := w.Code, http.StatusConflict; got != want {
+		t.Errorf("before add-data: got http status code %d but wanted %d", got, want)
+	}
+
+	srv.state = StateDataAdded
+	srv.ekm = bytes.Repeat([]byte{0x03}, exporterSize)
+	srv.HostKeyType = stssh.DefaultKeyType
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
 	if got, want := w.Code, http.StatusOK; got != want {
 		t.Errorf("got http status code %d but wanted %d", got, want)
 	}
+	if got, want := srv.state, StateCommitted; got != want {
+		t.Errorf("got state %q but wanted %q", got, want)
+	}
+	select {
+	case <-srv.commit:
+	default:
+		t.Errorf("missing commit message")
+	}
+}
+
+func TestAddHostCert(t *testing.T) {
+	srv := testServer(t)
+	commit := getHandler(t, srv, EndpointCommit)
+	handler := getHandler(t, srv, EndpointAddHostCert)
+	password := testSession(t, srv)
+	do := func(h Handler, url string, body io.Reader) int {
+		t.Helper()
+		req, err := http.NewRequest(h.Method, url, body)
+		if err != nil {
+			t.Fatalf("create http request: %v", err)
+		}
+		req.RemoteAddr = "127.0.0.12:2009"
+		req.SetBasicAuth(BasicAuthUser, password)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	url := "http://example.com/" + Protocol + "/" + handler.Endpoint
+	if got, want := do(handler, url, bytes.NewBufferString(`{}`)), http.StatusConflict; got != want {
+		t.Errorf("before commit: got http status code %d but wanted %d", got, want)
+	}
+	srv.state = StateDataAdded
+	srv.ekm = bytes.Repeat([]byte{0x03}, exporterSize)
+	srv.HostKeyType = stssh.KeyTypeECDSAP256
+
+	commitURL := "http://example.com/" + Protocol + "/" + commit.Endpoint + "?" + QueryHostCert + "=true"
+	if got, want := do(commit, commitURL, nil), http.StatusOK; got != want {
+		t.Fatalf("commit: got http status code %d but wanted %d", got, want)
+	}
+	select {
+	case <-srv.commit:
+		t.Fatalf("commit: got commit message before host certificate")
+	default:
+	}
+
+	_, caPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := stssh.HostCA{Signer: signer, Validity: time.Hour}
+	hk, err := srv.UDS.SSH(srv.HostKeyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := hk.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.Sign(pub, []string{"mullis"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []struct {
+		desc string
+		cert string
+	}{
+		{"not a certificate", pub},
+		{"valid", cert},
+	} {
+		b, err := json.Marshal(AddHostCertRequest{Certificate: table.cert})
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := do(handler, url, bytes.NewBuffer(b))
+		if got, want := code == http.StatusOK, table.desc == "valid"; got != want {
+			t.Errorf("%s: got http status code %d", table.desc, code)
+		}
+	}
+	if got, want := srv.HostCert, cert; got != want {
+		t.Errorf("got host certificate %q but wanted %q", got, want)
+	}
 	select {
 	case <-srv.commit:
 	default:
@@ -187,6 +326,405 @@ func TestCommit(t *testing.T) {
 	}
 }
 
+func TestAddX509Cert(t *testing.T) {
+	srv := testServer(t)
+	commit := getHandler(t, srv, EndpointCommit)
+	handler := getHandler(t, srv, EndpointAddX509Cert)
+	password := testSession(t, srv)
+	do := func(h Handler, url string, body io.Reader) *httptest.ResponseRecorder {
+		t.Helper()
+		req, err := http.NewRequest(h.Method, url, body)
+		if err != nil {
+			t.Fatalf("create http request: %v", err)
+		}
+		req.RemoteAddr = "127.0.0.12:2009"
+		req.SetBasicAuth(BasicAuthUser, password)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	url := "http://example.com/" + Protocol + "/" + handler.Endpoint
+	if got, want := do(handler, url, bytes.NewBufferString(`{}`)).Code, http.StatusConflict; got != want {
+		t.Errorf("before commit: got http status code %d but wanted %d", got, want)
+	}
+	srv.state = StateDataAdded
+	srv.ekm = bytes.Repeat([]byte{0x03}, exporterSize)
+	srv.HostKeyType = stssh.DefaultKeyType
+
+	commitURL := "http://example.com/" + Protocol + "/" + commit.Endpoint + "?" + QueryX509Cert + "=true"
+	w := do(commit, commitURL, nil)
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("commit: got http status code %d but wanted %d", got, want)
+	}
+	if got, want := srv.state, StateAwaitX509Cert; got != want {
+		t.Fatalf("commit: got state %q but wanted %q", got, want)
+	}
+	var cr CommitResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &cr); err != nil {
+		t.Fatal(err)
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), BasicConstraintsValid: true, IsCA: true, KeyUsage: x509.KeyUsageCertSign}
+	caDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := pki.CA{Cert: caCert, Signer: caKey, Validity: time.Hour}
+	cert, err := ca.Sign(cr.CSR, "mullis", net.ParseIP("10.0.2.10"), time.Now())
+	if err != nil {
+		t.Fatalf("sign csr: %v", err)
+	}
+	otherCSR, err := pki.NewCSR(caKey, "mullis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert, err := ca.Sign(otherCSR, "mullis", net.ParseIP("10.0.2.10"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []struct {
+		desc string
+		cert string
+	}{
+		{"not a certificate", "mullis"},
+		{"other key", otherCert},
+		{"valid", cert},
+	} {
+		b, err := json.Marshal(AddX509CertRequest{Certificate: table.cert})
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := do(handler, url, bytes.NewBuffer(b)).Code
+		if got, want := code == http.StatusOK, table.desc == "valid"; got != want {
+			t.Errorf("%s: got http status code %d", table.desc, code)
+		}
+	}
+	if got, want := srv.X509Cert, cert; got != want {
+		t.Errorf("got x509 certificate %q but wanted %q", got, want)
+	}
+	select {
+	case <-srv.commit:
+	default:
+		t.Errorf("missing commit message")
+	}
+}
+
+func TestHello(t *testing.T) {
+	srv := testServer(t)
+	var err error
+	if srv.Store, err = store.NewDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	guid := uuid.MustParse("8be4df61-93ca-11d2-aa0d-00e098032b8c")
+	if err := store.Write(srv.Store, "SetupMode", &guid, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := getHandler(t, srv, EndpointHello)
+	if got, want := handler.path(), "/"+EndpointHello; got != want {
+		t.Errorf("got path %q but wanted %q", got, want)
+	}
+	req, err := http.NewRequest(handler.Method, "http://example.com"+handler.path(), nil)
+	if err != nil {
+		t.Fatalf("create http request: %v", err)
+	}
+	req.RemoteAddr = "127.0.0.12:2009"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("got http status code %d but wanted %d", got, want)
+	}
+
+	var hello HelloResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &hello); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if got, want := hello.Protocols, Protocols; !reflect.DeepEqual(got, want) {
+		t.Errorf("got protocols %v but wanted %v", got, want)
+	}
+	if got, want := hello.HostName, srv.HostName; got != want {
+		t.Errorf("got host name %q but wanted %q", got, want)
+	}
+	if hello.SetupMode == nil || !*hello.SetupMode {
+		t.Errorf("got setup mode %v but wanted true", hello.SetupMode)
+	}
+	if got, want := len(hello.Endpoints), len(srv.handlers()); got != want {
+		t.Errorf("got %d endpoints but wanted %d", got, want)
+	}
+}
+
+func TestState(t *testing.T) {
+	srv := testServer(t)
+	password := testSession(t, srv)
+	cs := testTLS(t)
+	do := func(endpoint, query string, body []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		h := getHandler(t, srv, endpoint)
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewBuffer(body)
+		}
+		req, err := http.NewRequest(h.Method, "http://example.com/"+Protocol+"/"+endpoint+query, r)
+		if err != nil {
+			t.Fatalf("create http request: %v", err)
+		}
+		req.RemoteAddr = "127.0.0.12:2009"
+		req.SetBasicAuth(BasicAuthUser, password)
+		req.TLS = cs
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	data := []byte(fmt.Sprintf(`{"entropy":"%s","timestamp":1}`, b64Ones(t, secrets.EntropyBytes)))
+
+	for i, table := range []struct {
+		desc      string
+		endpoint  string
+		query     string
+		body      []byte
+		wantCode  int
+		wantState State
+	}{
+		{"commit before add-data", EndpointCommit, "", nil, http.StatusConflict, StateAwaitData},
+		{"add-secure-boot before add-data", EndpointAddSecureBoot, "", []byte(`{}`), http.StatusConflict, StateAwaitData},
+		{"add-host-cert before add-data", EndpointAddHostCert, "", []byte(`{}`), http.StatusConflict, StateAwaitData},
+		{"add-data", EndpointAddData, "", data, http.StatusOK, StateDataAdded},
+		{"repeated add-data", EndpointAddData, "", data, http.StatusConflict, StateDataAdded},
+		{"add-host-cert before commit", EndpointAddHostCert, "", []byte(`{}`), http.StatusConflict, StateDataAdded},
+		{"add-x509-cert before commit", EndpointAddX509Cert, "", []byte(`{}`), http.StatusConflict, StateDataAdded},
+		{"commit", EndpointCommit, "?" + QueryHostCert + "=true", nil, http.StatusOK, StateAwaitHostCert},
+		{"repeated commit", EndpointCommit, "", nil, http.StatusConflict, StateAwaitHostCert},
+		{"add-data after commit", EndpointAddData, "", data, http.StatusConflict, StateAwaitHostCert},
+		{"add-x509-cert before add-host-cert", EndpointAddX509Cert, "", []byte(`{}`), http.StatusConflict, StateAwaitHostCert},
+		{"abort", EndpointAbort, "", []byte(`{}`), http.StatusOK, StateAborted},
+		{"repeated abort", EndpointAbort, "", []byte(`{}`), http.StatusConflict, StateAborted},
+	} {
+		w := do(table.endpoint, table.query, table.body)
+		if got, want := w.Code, table.wantCode; got != want {
+			t.Errorf("%d: %s: got http status code %d but wanted %d", i, table.desc, got, want)
+		}
+		if w.Code == http.StatusConflict {
+			var e Error
+			if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+				t.Fatalf("%d: %s: unmarshal error: %v", i, table.desc, err)
+			}
+			if e.Code != CodeState || e.Step != table.endpoint || !strings.HasPrefix(e.Message, "not accepted in state") {
+				t.Errorf("%d: %s: got unspecific error %+v", i, table.desc, e)
+			}
+		}
+
+		w = do(EndpointState, "", nil)
+		var sr StateResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &sr); err != nil {
+			t.Fatalf("%d: %s: unmarshal state: %v", i, table.desc, err)
+		}
+		if got, want := sr.State, table.wantState; got != want {
+			t.Errorf("%d: %s: got state %q but wanted %q", i, table.desc, got, want)
+		}
+	}
+}
+
+func TestPAKE(t *testing.T) {
+	srv := testServer(t)
+	handler := getHandler(t, srv, EndpointPAKE)
+	url := "http://example.com/" + Protocol + "/" + handler.Endpoint
+	msg := bytes.Repeat([]byte{0x01}, pake.MessageSize)
+	body, err := json.Marshal(PAKERequest{Message: msg})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(handler.Method, url, bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("create http request: %v", err)
+	}
+	req.RemoteAddr = "127.0.0.12:2009"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if got, want := w.Code, http.StatusBadRequest; got != want {
+		t.Errorf("no tls: got http status code %d but wanted %d", got, want)
+	}
+	if got := len(srv.sessions); got != 0 {
+		t.Errorf("no tls: got %d session(s)", got)
+	}
+}
+
+func TestPAKEConfirm(t *testing.T) {
+	srv := testServer(t)
+	handler := getHandler(t, srv, EndpointPAKEConfirm)
+	url := "http://example.com/" + Protocol + "/" + handler.Endpoint
+	now := time.Now()
+	srv.guard.now = func() time.Time { return now }
+	do := func(id, confirmation []byte) int {
+		t.Helper()
+		b, err := json.Marshal(PAKEConfirmRequest{Message: id, Confirmation: confirmation})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(handler.Method, url, bytes.NewBuffer(b))
+		if err != nil {
+			t.Fatalf("create http request: %v", err)
+		}
+		req.RemoteAddr = "127.0.0.12:2009"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	id, keys := testExchange(t, srv)
+	if got, want := do([]byte("unknown"), keys.ClientConfirmation), http.StatusBadRequest; got != want {
+		t.Errorf("unknown exchange: got http status code %d but wanted %d", got, want)
+	}
+	if got, want := do(id, keys.ServerConfirmation), http.StatusForbidden; got != want {
+		t.Errorf("bad confirmation: got http status code %d but wanted %d", got, want)
+	}
+	now = now.Add(backoffMax)
+	if got, want := do(id, keys.ClientConfirmation), http.StatusBadRequest; got != want {
+		t.Errorf("retry after bad confirmation: got http status code %d but wanted %d", got, want)
+	}
+	if got, want := srv.Failures().Total, 1; got != want {
+		t.Errorf("got %d failure(s) but wanted %d", got, want)
+	}
+
+	id, keys = testExchange(t, srv)
+	if got, want := do(id, keys.ClientConfirmation), http.StatusOK; got != want {
+		t.Errorf("valid: got http status code %d but wanted %d", got, want)
+	}
+	password, err := SessionPassword(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !srv.hasSession(password) {
+		t.Errorf("valid: session is not usable for basic auth")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	srv := testServer(t)
+	var ids [][]byte
+	for i := 0; i < maxSessions+1; i++ {
+		id, _ := testExchange(t, srv)
+		ids = append(ids, id)
+	}
+	for _, s := range srv.sessions {
+		if bytes.Equal(s.id, ids[0]) {
+			t.Errorf("oldest session was not forgotten")
+		}
+	}
+	if got, want := len(srv.sessions), maxSessions; got != want {
+		t.Errorf("got %d sessions but wanted %d", got, want)
+	}
+	if srv.hasSession("") {
+		t.Errorf("unconfirmed session was accepted")
+	}
+
+	srv = testServer(t)
+	id, keys := testExchange(t, srv)
+	if _, err := srv.confirmSession(id, keys.ClientConfirmation); err != nil {
+		t.Fatalf("confirm session: %v", err)
+	}
+	password, err := SessionPassword(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxSessions+1; i++ {
+		testExchange(t, srv)
+	}
+	if !srv.hasSession(password) {
+		t.Errorf("confirmed session was forgotten")
+	}
+	if got, want := len(srv.sessions), maxSessions+1; got != want {
+		t.Errorf("confirmed: got %d sessions but wanted %d", got, want)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	srv := testServer(t)
+	handler := getHandler(t, srv, EndpointCommit)
+	url := "http://example.com/" + Protocol + "/" + handler.Endpoint
+	now := time.Now()
+	srv.guard.now = func() time.Time { return now }
+	do := func(password string) *httptest.ResponseRecorder {
+		t.Helper()
+		req, err := http.NewRequest(handler.Method, url, nil)
+		if err != nil {
+			t.Fatalf("create http request: %v", err)
+		}
+		req.RemoteAddr = "127.0.0.12:2009"
+		req.SetBasicAuth(BasicAuthUser, password)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if got, want := do("hotdog").Code, http.StatusForbidden; got != want {
+		t.Errorf("bad password: got http status code %d but wanted %d", got, want)
+	}
+	w := do("hotdog")
+	if got, want := w.Code, http.StatusTooManyRequests; got != want {
+		t.Errorf("no back off: got http status code %d but wanted %d", got, want)
+	}
+	if got, want := w.Header().Get("Retry-After"), "1"; got != want {
+		t.Errorf("no back off: got Retry-After %q but wanted %q", got, want)
+	}
+
+	for i := 1; i < srv.MaxFailures; i++ {
+		now = now.Add(backoffMax)
+		do("hotdog")
+	}
+	if got, want := srv.Failures().Lockout, true; got != want {
+		t.Errorf("got lockout %v but wanted %v", got, want)
+	}
+	now = now.Add(backoffMax)
+	if got, want := do(testSession(t, srv)).Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("lockout: got http status code %d but wanted %d", got, want)
+	}
+}
+
+// testExchange adds an unconfirmed session as if stprov local started a PAKE
+// exchange, returning the session's id and the keys of stprov local
+func testExchange(t *testing.T, srv *Server) ([]byte, *pake.Keys) {
+	t.Helper()
+	cli, err := pake.NewClient(srv.password, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := pake.NewServer(srv.password, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := st.Finish(cli.Message(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.addSession(cli.Message(), keys)
+	cliKeys, err := cli.Finish(st.Message(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cli.Message(), cliKeys
+}
+
+// testSession adds a session as if a PAKE exchange was confirmed, returning
+// the basic auth password that can be used for authentication
+func testSession(t *testing.T, srv *Server) string {
+	t.Helper()
+	password := hex.EncodeToString(bytes.Repeat([]byte{0x02}, secrets.EntropyBytes))
+	srv.sessionsLock.Lock()
+	defer srv.sessionsLock.Unlock()
+	srv.sessions = append(srv.sessions, &session{password: password})
+	return password
+}
+
 func getHandler(t *testing.T, srv *Server, endpoint string) Handler {
 	t.Helper()
 	for _, handler := range srv.handlers() {
@@ -203,3 +741,29 @@ func b64Ones(t *testing.T, numBytes int) string {
 	t.Helper()
 	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xff}, numBytes))
 }
+
+// testTLS outputs the state of a TLS connection, so that handlers can export
+// keying material
+func testTLS(t *testing.T) *tls.ConnectionState {
+	t.Helper()
+	crt, err := secrets.NewTLSCertificate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	srv := tls.Server(s, &tls.Config{Certificates: []tls.Certificate{*crt}})
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.Handshake() }()
+	cli := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	if err := cli.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	cs := srv.ConnectionState()
+	return &cs
+}
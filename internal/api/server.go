@@ -1,7 +1,9 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -10,19 +12,55 @@ import (
 	"sync"
 	"time"
 
+	"system-transparency.org/stboot/stlog"
+	"system-transparency.org/stprov/internal/pake"
 	"system-transparency.org/stprov/internal/secrets"
+	"system-transparency.org/stprov/internal/store"
 )
 
+// maxSessions is the number of unconfirmed PAKE exchanges that are remembered
+// at once.  Confirmed exchanges are not limited, since confirming requires the
+// one-time password.
+const maxSessions = 16
+
+var errUnknownSession = errors.New("unknown or already confirmed pake exchange")
+
 type Server struct {
 	ServerConfig
 	http.Server
 
 	Entropy   secrets.Entropy             // entropy received from stprov local
 	Timestamp int64                       // timestamp received from stprov local
+	SAS       string                      // short authentication string, see ShortAuthString()
 	UDS       *secrets.UniqueDeviceSecret // UDS generated in handleCommit()
+	HostCert  string                      // SSH host certificate received from stprov local, if any
+	X509Cert  string                      // X.509 identity certificate received from stprov local, if any
+
+	// HostKeyPassphrase is received from stprov local, if any
+	HostKeyPassphrase []byte
+	// HostKeyType is received from stprov local, see ssh.KeyTypes
+	HostKeyType string
+	// Derive lists named keys received from stprov local, if any
+	Derive []string
+
+	password *pake.Password
+	commit   chan struct{} // never closed, handlers may still send during a shutdown
+	ekm      []byte        // keying material exported on add-data, see handleCommit()
+	x509Cert bool          // commit asked for an X.509 identity certificate
 
-	basicAuthPassword string
-	commit            chan struct{}
+	stateLock sync.Mutex // held while serving authenticated requests
+	state     State
+
+	guard        *guard
+	sessionsLock sync.Mutex
+	sessions     []*session // PAKE exchanges, oldest first
+}
+
+// session is a PAKE exchange, which is usable for basic auth once confirmed
+type session struct {
+	id       []byte     // the client's PAKE message
+	keys     *pake.Keys // output of the PAKE exchange
+	password string     // derived basic auth password, set on key confirmation
 }
 
 type ServerConfig struct {
@@ -31,9 +69,23 @@ type ServerConfig struct {
 	RemotePort int         // stprov-remote port
 	LocalCIDR  []net.IPNet // where stprov-local may connect from
 	HostName   string      // host name to give back to stprov local
+	Store      store.Store // where Secure Boot keys are provisioned
 
 	Deadline time.Duration // maximum time to serve an HTTP request
 	Timeout  time.Duration // maximum time to wait on a graceful shutdown
+
+	// MaxFailures is the number of failed authentication attempts that
+	// cause a permanent shutdown (Default: DefaultMaxFailures)
+	MaxFailures int
+
+	// NoSecureBoot refuses add-secure-boot requests, e.g., because a secret
+	// is sealed to a PCR that Secure Boot provisioning would change
+	NoSecureBoot bool
+
+	// NoPlaintextKeys refuses to derive keys, to issue X.509 identity
+	// certificates, and to encrypt the SSH host key with a passphrase, e.g.,
+	// because only the SSH host key is sealed to the TPM
+	NoPlaintextKeys bool
 }
 
 func NewServer(cfg *ServerConfig) (*Server, error) {
@@ -41,39 +93,60 @@ func NewServer(cfg *ServerConfig) (*Server, error) {
 	if err != nil {
 		return nil, fmt.Errorf("derive one-time password: %w", err)
 	}
-	crt, err := otp.TLSCertificate(cfg.RemoteIP)
+	pw, err := pake.NewPassword(otp[:])
 	if err != nil {
-		return nil, fmt.Errorf("derive tls certificate: %w", err)
+		return nil, fmt.Errorf("derive pake password: %w", err)
 	}
-	basicAuthPassword, err := otp.BasicAuthPassword()
+	crt, err := secrets.NewTLSCertificate(rand.Reader)
 	if err != nil {
-		return nil, fmt.Errorf("derive basic auth password: %w", err)
+		return nil, fmt.Errorf("new tls certificate: %w", err)
+	}
+	if cfg.MaxFailures < 0 {
+		return nil, fmt.Errorf("invalid maximum number of failures: %d", cfg.MaxFailures)
+	}
+	if cfg.MaxFailures == 0 {
+		cfg.MaxFailures = DefaultMaxFailures
 	}
 	srv := &Server{
 		ServerConfig: *cfg,
 		Server: http.Server{
 			Addr: fmt.Sprintf("%s:%d", cfg.RemoteIP, cfg.RemotePort),
 			TLSConfig: &tls.Config{
+				MinVersion: tls.VersionTLS13,
 				Certificates: []tls.Certificate{
 					*crt,
 				},
 			},
 		},
-		basicAuthPassword: basicAuthPassword,
-		commit:            make(chan struct{}, 1),
+		password: pw,
+		commit:   make(chan struct{}, 1),
+		state:    StateAwaitData,
+		guard:    newGuard(cfg.MaxFailures, time.Now),
 	}
 	return srv, nil
 }
 
-func (srv *Server) Run(ctx context.Context) error {
+// Run serves requests until a commit, or until the context is cancelled.
+// ErrLockout is returned if there were too many failed authentication attempts,
+// ErrAborted if stprov local aborted, and the context's error if it was done.
+func (srv *Server) Run(parent context.Context) error {
 	var wg sync.WaitGroup
 	defer wg.Wait()
 
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	go func() {
+		select {
+		case <-srv.guard.locked:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	mux := http.NewServeMux()
-	http.Handle("/", mux)
+	srv.Handler = mux
 	for _, handler := range srv.handlers() {
-		path := "/" + Protocol + "/" + handler.Endpoint
-		mux.Handle(path, handler)
+		mux.Handle(handler.path(), handler)
 	}
 
 	wg.Add(1)
@@ -86,22 +159,103 @@ func (srv *Server) Run(ctx context.Context) error {
 		srv.Shutdown(ctx)
 	})
 
-	defer close(srv.commit)
 	if err := srv.ListenAndServeTLS("", ""); !errors.Is(err, http.ErrServerClosed) {
 		return fmt.Errorf("server died: %w", err)
 	}
+	srv.stateLock.Lock()
+	state := srv.state
+	srv.stateLock.Unlock()
+	switch {
+	case srv.guard.isLocked():
+		return ErrLockout
+	case state == StateAborted:
+		return ErrAborted
+	case state != StateCommitted:
+		return fmt.Errorf("stopped in state %s: %w", state, parent.Err())
+	}
 	return nil
 }
 
+// Failures outputs a summary of failed authentication attempts
+func (srv *Server) Failures() Failures {
+	return srv.guard.failures()
+}
+
+// fail records a failed authentication attempt from a source IP address
+func (srv *Server) fail(ip string) {
+	if srv.guard.fail(ip) {
+		stlog.Error("%d failed authentication attempts, shutting down permanently.  "+
+			"Restart stprov remote, preferably with a new one-time password.", srv.MaxFailures)
+	}
+}
+
 func (srv *Server) checkHTTPMethod(m string) bool {
 	return m == http.MethodGet || m == http.MethodPost
 }
 
+// addSession adds an unconfirmed PAKE exchange.  The oldest unconfirmed
+// session is forgotten if there are more than maxSessions.  Confirmed sessions
+// are never forgotten, so that unauthenticated PAKE requests cannot evict a
+// session that stprov local is using.
+func (srv *Server) addSession(id []byte, keys *pake.Keys) {
+	srv.sessionsLock.Lock()
+	defer srv.sessionsLock.Unlock()
+
+	srv.sessions = append(srv.sessions, &session{id: id, keys: keys})
+	unconfirmed := 0
+	for _, s := range srv.sessions {
+		if s.password == "" {
+			unconfirmed++
+		}
+	}
+	if unconfirmed <= maxSessions {
+		return
+	}
+	for i, s := range srv.sessions {
+		if s.password == "" {
+			srv.sessions = append(srv.sessions[:i], srv.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// confirmSession checks the client's key confirmation of a PAKE exchange.  On
+// success, the session becomes usable for basic auth.  On failure, the session
+// is removed so that there is only one attempt per exchange.
+func (srv *Server) confirmSession(id, confirmation []byte) (*pake.Keys, error) {
+	srv.sessionsLock.Lock()
+	defer srv.sessionsLock.Unlock()
+
+	for i, s := range srv.sessions {
+		if s.password != "" || !bytes.Equal(s.id, id) {
+			continue
+		}
+		if err := s.keys.CheckClient(confirmation); err != nil {
+			srv.sessions = append(srv.sessions[:i], srv.sessions[i+1:]...)
+			return nil, err
+		}
+		password, err := SessionPassword(s.keys)
+		if err != nil {
+			return nil, fmt.Errorf("derive basic auth password: %w", err)
+		}
+		s.password = password
+		return s.keys, nil
+	}
+	return nil, errUnknownSession
+}
+
 func (srv *Server) handlers() []Handler {
 	return []Handler{
-		{srv, EndpointAddData, http.MethodPost, handleAddData},
-		{srv, EndpointAddSecureBoot, http.MethodPost, handleAddSecureBoot},
-		{srv, EndpointCommit, http.MethodGet, handleCommit},
+		{srv, EndpointHello, http.MethodGet, true, handleHello},
+		{srv, EndpointPAKE, http.MethodPost, true, handlePAKE},
+		{srv, EndpointPAKEConfirm, http.MethodPost, true, handlePAKEConfirm},
+		{srv, EndpointAddData, http.MethodPost, false, handleAddData},
+		{srv, EndpointAddSecureBoot, http.MethodPost, false, handleAddSecureBoot},
+		{srv, EndpointCommit, http.MethodGet, false, handleCommit},
+		{srv, EndpointAddHostCert, http.MethodPost, false, handleAddHostCert},
+		{srv, EndpointAddX509Cert, http.MethodPost, false, handleAddX509Cert},
+		{srv, EndpointState, http.MethodGet, false, handleState},
+		{srv, EndpointAbort, http.MethodPost, false, handleAbort},
 	}
 }
 
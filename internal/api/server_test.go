@@ -25,9 +25,16 @@ func TestHTTPMethod(t *testing.T) {
 
 func TestHandlers(t *testing.T) {
 	endpoints := map[string]bool{
+		EndpointHello:         false,
+		EndpointPAKE:          false,
+		EndpointPAKEConfirm:   false,
 		EndpointAddData:       false,
 		EndpointAddSecureBoot: false,
 		EndpointCommit:        false,
+		EndpointAddHostCert:   false,
+		EndpointAddX509Cert:   false,
+		EndpointState:         false,
+		EndpointAbort:         false,
 	}
 	srv := Server{}
 	for _, handler := range srv.handlers() {
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// State is the progress of a provisioning session on stprov remote.  The
+// endpoints must be requested in order: add-data, optionally add-secure-boot,
+// commit, then add-host-cert and add-x509-cert if the commit request asked for
+// them.  The abort endpoint is accepted in any state before the session is
+// committed.
+type State string
+
+const (
+	StateAwaitData       State = "await-data"        // initial state
+	StateDataAdded       State = "data-added"        // after add-data
+	StateSecureBootAdded State = "secure-boot-added" // after add-secure-boot
+	StateAwaitHostCert   State = "await-host-cert"   // after commit with QueryHostCert
+	StateAwaitX509Cert   State = "await-x509-cert"   // after commit or add-host-cert with QueryX509Cert
+	StateCommitted       State = "committed"         // after commit, add-host-cert, or add-x509-cert
+	StateAborted         State = "aborted"           // after abort
+)
+
+// ErrAborted is returned by Server.Run if stprov local aborted
+var ErrAborted = errors.New("aborted by stprov local")
+
+// StateResponse is the output of a state request
+type StateResponse struct {
+	State State `json:"state"`
+}
+
+// StateError is returned if an endpoint is requested out of order or more
+// than once.  It is served with HTTP status 409 (Conflict).
+type StateError struct {
+	Endpoint string  // the requested endpoint
+	State    State   // the current state
+	Expected []State // states that the endpoint is accepted in
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Endpoint, e.reason())
+}
+
+// reason outputs the error message without the endpoint
+func (e *StateError) reason() string {
+	var expected []string
+	for _, state := range e.Expected {
+		expected = append(expected, string(state))
+	}
+	return fmt.Sprintf("not accepted in state %s, expected %s", e.State, strings.Join(expected, " or "))
+}
+
+// checkState checks that the current state is one of the expected states.
+// The caller must hold srv.stateLock, see Handler.ServeHTTP().
+func (srv *Server) checkState(endpoint string, expected ...State) error {
+	for _, state := range expected {
+		if srv.state == state {
+			return nil
+		}
+	}
+	return &StateError{Endpoint: endpoint, State: srv.state, Expected: expected}
+}
@@ -34,6 +34,19 @@ func ForEachInterface(f func(link netlink.Link) error) error {
 	return nil
 }
 
+// HardwareAddrs outputs the non-empty MAC addresses of all non-loopback
+// interfaces
+func HardwareAddrs() ([]net.HardwareAddr, error) {
+	var addrs []net.HardwareAddr
+	err := ForEachInterface(func(link netlink.Link) error {
+		if len(link.Attrs().HardwareAddr) != 0 {
+			addrs = append(addrs, link.Attrs().HardwareAddr)
+		}
+		return nil
+	})
+	return addrs, err
+}
+
 type Pinger struct {
 	*ping.Pinger
 
@@ -70,8 +83,8 @@ func (p *Pinger) Stop() {
 	p.ctxCancel()
 }
 
-// try send 3 icmp packets to some ip over 3 seconds
-func testGateway(gw *net.IP) error {
+// TestGateway tries to send 3 icmp packets to some ip over 3 seconds
+func TestGateway(gw *net.IP) error {
 	pinger, err := NewPinger(gw.String())
 	if err != nil {
 		return err
@@ -181,7 +194,7 @@ func TestInterfaces(gw, addr string, interfaceWait time.Duration) ([]netlink.Lin
 		ctx, cancel := context.WithTimeout(context.Background(), interfaceWait)
 		defer cancel()
 		WaitForDeviceEvent(ctx, link.Attrs().Name, netlink.OperUp)
-		if err := testGateway(&gwIP); err != nil {
+		if err := TestGateway(&gwIP); err != nil {
 			log.Println(err)
 		} else {
 			duplex := GetDeviceDuplex(link.Attrs().Name)
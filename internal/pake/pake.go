@@ -0,0 +1,203 @@
+// package pake implements SPAKE2 (RFC 9382) over edwards25519.  It is used by
+// stprov local and stprov remote to establish a shared key from a one-time
+// password, such that an attacker that records the exchange cannot test
+// password guesses offline.  Each guess requires an online exchange.
+//
+// The points M and N are derived by stprov from nothing-up-my-sleeve seeds,
+// see hashToPoint.  They are not the edwards25519 constants listed in RFC 9382.
+package pake
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	IdentityClient = "stprov local"  // identity A in RFC 9382
+	IdentityServer = "stprov remote" // identity B in RFC 9382
+
+	MessageSize      = 32 // size of a compressed edwards25519 point
+	ConfirmationSize = sha256.Size
+
+	passwordSalt = "stprov:pake:password"
+)
+
+// ErrConfirmation is returned if the peer's key confirmation is invalid, which
+// is what happens if the two sides use different passwords
+var ErrConfirmation = errors.New("pake: key confirmation failed")
+
+var (
+	pointM = hashToPoint("stprov:pake:M")
+	pointN = hashToPoint("stprov:pake:N")
+)
+
+// Password is a password that has been stretched into a scalar
+type Password struct {
+	w *edwards25519.Scalar
+}
+
+// NewPassword stretches a password into a scalar using Argon2id
+func NewPassword(password []byte) (*Password, error) {
+	b := argon2.IDKey(password, []byte(passwordSalt), 3, 64*1024, 4, 64)
+	w, err := edwards25519.NewScalar().SetUniformBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("pake: %w", err)
+	}
+	return &Password{w: w}, nil
+}
+
+// State is one side of an ongoing SPAKE2 exchange
+type State struct {
+	pw       *Password
+	isClient bool
+	x        *edwards25519.Scalar
+	msg      []byte
+}
+
+// Keys is the output of a successful SPAKE2 exchange
+type Keys struct {
+	Session            []byte // Ke in RFC 9382
+	ClientConfirmation []byte // cA in RFC 9382
+	ServerConfirmation []byte // cB in RFC 9382
+}
+
+// NewClient starts an exchange as stprov local (A)
+func NewClient(pw *Password, rand io.Reader) (*State, error) {
+	return newState(pw, true, rand)
+}
+
+// NewServer starts an exchange as stprov remote (B)
+func NewServer(pw *Password, rand io.Reader) (*State, error) {
+	return newState(pw, false, rand)
+}
+
+func newState(pw *Password, isClient bool, rand io.Reader) (*State, error) {
+	var b [64]byte
+	if _, err := io.ReadFull(rand, b[:]); err != nil {
+		return nil, fmt.Errorf("pake: %w", err)
+	}
+	x, err := edwards25519.NewScalar().SetUniformBytes(b[:])
+	if err != nil {
+		return nil, fmt.Errorf("pake: %w", err)
+	}
+
+	blind := pointM
+	if !isClient {
+		blind = pointN
+	}
+	p := new(edwards25519.Point).ScalarBaseMult(x)
+	p.Add(p, new(edwards25519.Point).ScalarMult(pw.w, blind))
+	return &State{pw: pw, isClient: isClient, x: x, msg: p.Bytes()}, nil
+}
+
+// Message outputs the message to send to the peer (pA or pB)
+func (s *State) Message() []byte {
+	return append([]byte{}, s.msg...)
+}
+
+// Finish computes the shared keys from the peer's message.  The additional
+// authenticated data (aad) is bound to the key confirmations, and must be the
+// same on both sides.  The keys are only safe to use after the peer's key
+// confirmation has been checked, see Keys.Check*.
+func (s *State) Finish(peerMsg, aad []byte) (*Keys, error) {
+	peer, err := new(edwards25519.Point).SetBytes(peerMsg)
+	if err != nil {
+		return nil, fmt.Errorf("pake: invalid peer message: %w", err)
+	}
+	unblind := pointN
+	if !s.isClient {
+		unblind = pointM
+	}
+
+	// K = h*x*(peer - w*unblind), where h is the cofactor
+	k := new(edwards25519.Point).ScalarMult(s.pw.w, unblind)
+	k.Subtract(peer, k)
+	k.ScalarMult(s.x, k)
+	k.MultByCofactor(k)
+	if k.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return nil, fmt.Errorf("pake: invalid peer message: identity point")
+	}
+
+	pA, pB := s.msg, peerMsg
+	if !s.isClient {
+		pA, pB = peerMsg, s.msg
+	}
+	tt := transcript(
+		[]byte(IdentityClient),
+		[]byte(IdentityServer),
+		pA,
+		pB,
+		k.Bytes(),
+		s.pw.w.Bytes(),
+	)
+
+	h := sha256.Sum256(tt)
+	ke, ka := h[:len(h)/2], h[len(h)/2:]
+	var kc [32]byte
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ka, nil, append([]byte("ConfirmationKeys"), aad...)), kc[:]); err != nil {
+		return nil, fmt.Errorf("pake: %w", err)
+	}
+	return &Keys{
+		Session:            append([]byte{}, ke...),
+		ClientConfirmation: mac(kc[:len(kc)/2], tt),
+		ServerConfirmation: mac(kc[len(kc)/2:], tt),
+	}, nil
+}
+
+// CheckClient checks stprov local's key confirmation in constant time
+func (k *Keys) CheckClient(confirmation []byte) error {
+	if !hmac.Equal(k.ClientConfirmation, confirmation) {
+		return ErrConfirmation
+	}
+	return nil
+}
+
+// CheckServer checks stprov remote's key confirmation in constant time
+func (k *Keys) CheckServer(confirmation []byte) error {
+	if !hmac.Equal(k.ServerConfirmation, confirmation) {
+		return ErrConfirmation
+	}
+	return nil
+}
+
+// transcript encodes each value with an 8-byte little-endian length prefix
+func transcript(values ...[]byte) []byte {
+	var tt []byte
+	for _, v := range values {
+		tt = binary.LittleEndian.AppendUint64(tt, uint64(len(v)))
+		tt = append(tt, v...)
+	}
+	return tt
+}
+
+func mac(key, msg []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// hashToPoint hashes a seed and a counter with SHA256 until the output is a
+// valid point encoding, which is then multiplied by the cofactor.  Nobody knows
+// the discrete logarithm of the resulting point.
+func hashToPoint(seed string) *edwards25519.Point {
+	for i := uint64(0); ; i++ {
+		h := sha256.Sum256(binary.BigEndian.AppendUint64([]byte(seed), i))
+		p, err := new(edwards25519.Point).SetBytes(h[:])
+		if err != nil {
+			continue
+		}
+		p.MultByCofactor(p)
+		if p.Equal(edwards25519.NewIdentityPoint()) == 1 {
+			continue
+		}
+		return p
+	}
+}
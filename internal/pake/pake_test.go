@@ -0,0 +1,84 @@
+package pake
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestExchange(t *testing.T) {
+	pw := testPassword(t, "sikritpassword")
+	for _, table := range []struct {
+		desc      string
+		clientPW  *Password
+		serverPW  *Password
+		clientAAD []byte
+		serverAAD []byte
+		wantOK    bool
+	}{
+		{"valid", pw, pw, []byte("aad"), []byte("aad"), true},
+		{"other password", pw, testPassword(t, "sikritpasswore"), []byte("aad"), []byte("aad"), false},
+		{"other aad", pw, pw, []byte("aad"), []byte("AAD"), false},
+	} {
+		client, err := NewClient(table.clientPW, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := NewServer(table.serverPW, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(client.Message()), MessageSize; got != want {
+			t.Fatalf("%s: got message size %d, want %d", table.desc, got, want)
+		}
+
+		serverKeys, err := server.Finish(client.Message(), table.serverAAD)
+		if err != nil {
+			t.Fatalf("%s: server finish: %v", table.desc, err)
+		}
+		clientKeys, err := client.Finish(server.Message(), table.clientAAD)
+		if err != nil {
+			t.Fatalf("%s: client finish: %v", table.desc, err)
+		}
+
+		errServer := clientKeys.CheckServer(serverKeys.ServerConfirmation)
+		errClient := serverKeys.CheckClient(clientKeys.ClientConfirmation)
+		if got, want := errServer == nil, table.wantOK; got != want {
+			t.Errorf("%s: check server confirmation: got %v, want %v", table.desc, errServer, want)
+		}
+		if got, want := errClient == nil, table.wantOK; got != want {
+			t.Errorf("%s: check client confirmation: got %v, want %v", table.desc, errClient, want)
+		}
+		if got, want := bytes.Equal(clientKeys.Session, serverKeys.Session), table.desc != "other password"; got != want {
+			t.Errorf("%s: got equal session keys %v, want %v", table.desc, got, want)
+		}
+		if bytes.Equal(clientKeys.ClientConfirmation, clientKeys.ServerConfirmation) {
+			t.Errorf("%s: client and server confirmations are equal", table.desc)
+		}
+	}
+}
+
+func TestFinishInvalidMessage(t *testing.T) {
+	client, err := NewClient(testPassword(t, "sikritpassword"), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range [][]byte{
+		nil,
+		make([]byte, MessageSize-1),
+		make([]byte, MessageSize+1),
+	} {
+		if _, err := client.Finish(msg, nil); err == nil {
+			t.Errorf("message %x: expected error", msg)
+		}
+	}
+}
+
+func testPassword(t *testing.T, password string) *Password {
+	t.Helper()
+	pw, err := NewPassword([]byte(password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pw
+}
@@ -0,0 +1,182 @@
+// Package pki issues X.509 identity certificates to platforms.  The platform
+// creates a certificate signing request for a key that it derives from its
+// unique device secret, and stprov local signs it with a CA.
+package pki
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// CA signs X.509 identity certificates
+type CA struct {
+	Cert     *x509.Certificate
+	Signer   crypto.Signer
+	Validity time.Duration // how long a certificate is valid after signing
+}
+
+// ReadCA reads a CA certificate and its unencrypted private key, both in PEM
+// format.  The private key may be in PKCS #8, SEC 1 ("EC PRIVATE KEY"), or
+// PKCS #1 ("RSA PRIVATE KEY") format.
+func ReadCA(certFile, keyFile string, validity time.Duration) (*CA, error) {
+	if validity <= 0 {
+		return nil, fmt.Errorf("validity must be positive")
+	}
+	b, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := ParseCertificate(b)
+	if err != nil {
+		return nil, err
+	}
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return nil, fmt.Errorf("%s: not a CA certificate", certFile)
+	}
+	if b, err = os.ReadFile(keyFile); err != nil {
+		return nil, err
+	}
+	signer, err := ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyFile, err)
+	}
+	if !equalPublicKeys(signer.Public(), cert.PublicKey) {
+		return nil, fmt.Errorf("%s: private key does not match %s", keyFile, certFile)
+	}
+	return &CA{Cert: cert, Signer: signer, Validity: validity}, nil
+}
+
+// NewCSR creates a certificate signing request in DER format.  The hostname
+// is only informational, see CA.Sign().
+func NewCSR(key crypto.Signer, hostname string) ([]byte, error) {
+	tmpl := &x509.CertificateRequest{Subject: pkix.Name{CommonName: hostname}}
+	if len(hostname) > 0 {
+		tmpl.DNSNames = []string{hostname}
+	}
+	return x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+}
+
+// Sign signs a certificate for the public key in a certificate signing request
+// in DER format.  The hostname (if any) and IP address are the certificate's
+// subject alternative names, regardless of what the request asks for.  The
+// certificate is valid from one minute before now, to allow for some clock
+// skew, and can be used for both TLS client and server authentication.  It is
+// output in PEM format.
+func (ca *CA) Sign(csrDER []byte, hostname string, ip net.IP, now time.Time) (string, error) {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return "", fmt.Errorf("parse certificate signing request: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return "", fmt.Errorf("check certificate signing request: %w", err)
+	}
+	if ip == nil {
+		return "", fmt.Errorf("no ip address")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", fmt.Errorf("read random: %w", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: ip.String()},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(ca.Validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{ip},
+	}
+	if len(hostname) > 0 {
+		tmpl.Subject.CommonName = hostname
+		tmpl.DNSNames = []string{hostname}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, csr.PublicKey, ca.Signer)
+	if err != nil {
+		return "", fmt.Errorf("sign: %w", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), nil
+}
+
+// CheckCert checks that a certificate in PEM format is for a given public key.
+// Whether the issuing CA is trusted is not checked, since it is unknown to the
+// platform.  Neither is the validity period, since the platform's clock may
+// not be set yet.
+func CheckCert(certPEM string, pub crypto.PublicKey) error {
+	cert, err := ParseCertificate([]byte(certPEM))
+	if err != nil {
+		return err
+	}
+	if !equalPublicKeys(cert.PublicKey, pub) {
+		return fmt.Errorf("certificate is for a different key")
+	}
+	if len(cert.DNSNames) == 0 && len(cert.IPAddresses) == 0 {
+		return fmt.Errorf("certificate without subject alternative names")
+	}
+	return nil
+}
+
+// ParseCertificate parses the first certificate in PEM format, ignoring any
+// chain that follows it
+func ParseCertificate(b []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no pem-encoded certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// MarshalPrivateKey encodes a private key in PKCS #8 PEM format
+func MarshalPrivateKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// ParsePrivateKey parses an unencrypted private key in PEM format, see ReadCA()
+func ParsePrivateKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no pem-encoded private key")
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported pem type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+func equalPublicKeys(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
@@ -0,0 +1,176 @@
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	ca := testCA(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := NewCSR(key, "st.example.org")
+	if err != nil {
+		t.Fatalf("new csr: %v", err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	ip := net.ParseIP("10.0.2.10")
+	if _, err := ca.Sign(csr[1:], "st.example.org", ip, now); err == nil {
+		t.Errorf("signed a malformed csr")
+	}
+	if _, err := ca.Sign(csr, "st.example.org", nil, now); err == nil {
+		t.Errorf("signed without an ip address")
+	}
+	for _, table := range []struct {
+		hostname string
+		wantCN   string
+		wantDNS  int
+	}{
+		{"st.example.org", "st.example.org", 1},
+		{"", "10.0.2.10", 0},
+	} {
+		str, err := ca.Sign(csr, table.hostname, ip, now)
+		if err != nil {
+			t.Fatalf("%q: sign: %v", table.hostname, err)
+		}
+		cert, err := ParseCertificate([]byte(str))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cert.CheckSignatureFrom(ca.Cert); err != nil {
+			t.Errorf("%q: certificate is not signed by the CA: %v", table.hostname, err)
+		}
+		if got, want := cert.Subject.CommonName, table.wantCN; got != want {
+			t.Errorf("%q: got common name %q but wanted %q", table.hostname, got, want)
+		}
+		if got, want := len(cert.DNSNames), table.wantDNS; got != want {
+			t.Errorf("%q: got %d dns names but wanted %d", table.hostname, got, want)
+		}
+		if got := cert.IPAddresses; len(got) != 1 || !got[0].Equal(ip) {
+			t.Errorf("%q: got ip addresses %v but wanted %v", table.hostname, got, ip)
+		}
+		if got, want := cert.NotAfter, now.Add(ca.Validity); !got.Equal(want) {
+			t.Errorf("%q: got not after %v but wanted %v", table.hostname, got, want)
+		}
+
+		if err := CheckCert(str, key.Public()); err != nil {
+			t.Errorf("%q: check certificate: %v", table.hostname, err)
+		}
+		if err := CheckCert(str, other.Public()); err == nil {
+			t.Errorf("%q: accepted certificate for a different key", table.hostname)
+		}
+	}
+	if err := CheckCert("not a certificate", key.Public()); err == nil {
+		t.Errorf("accepted malformed certificate")
+	}
+}
+
+func TestReadCA(t *testing.T) {
+	ca := testCA(t)
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, certFile, "CERTIFICATE", ca.Cert.Raw)
+	der, err := x509.MarshalPKCS8PrivateKey(ca.Signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "ca.key")
+	writePEM(t, keyFile, "PRIVATE KEY", der)
+	ecDER, err := x509.MarshalECPrivateKey(ca.Signer.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKeyFile := filepath.Join(dir, "ca-ec.key")
+	writePEM(t, ecKeyFile, "EC PRIVATE KEY", ecDER)
+
+	other := testCA(t)
+	otherDER, err := x509.MarshalPKCS8PrivateKey(other.Signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeyFile := filepath.Join(dir, "other.key")
+	writePEM(t, otherKeyFile, "PRIVATE KEY", otherDER)
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{SerialNumber: big.NewInt(2)}, ca.Cert, edKey.Public(), ca.Signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafFile := filepath.Join(dir, "leaf.pem")
+	writePEM(t, leafFile, "CERTIFICATE", leaf)
+
+	for _, table := range []struct {
+		desc     string
+		certFile string
+		keyFile  string
+		validity time.Duration
+		wantOK   bool
+	}{
+		{"invalid: validity", certFile, keyFile, 0, false},
+		{"invalid: missing cert", filepath.Join(dir, "missing"), keyFile, time.Hour, false},
+		{"invalid: cert is a key", keyFile, keyFile, time.Hour, false},
+		{"invalid: not a ca", leafFile, keyFile, time.Hour, false},
+		{"invalid: other key", certFile, otherKeyFile, time.Hour, false},
+		{"valid: pkcs8", certFile, keyFile, time.Hour, true},
+		{"valid: sec1", certFile, ecKeyFile, time.Hour, true},
+	} {
+		_, err := ReadCA(table.certFile, table.keyFile, table.validity)
+		if got, want := err == nil, table.wantOK; got != want {
+			t.Errorf("%s: got ok %v but wanted %v: %v", table.desc, got, want, err)
+		}
+	}
+}
+
+func testCA(t *testing.T) *CA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Unix(0, 0),
+		NotAfter:              time.Unix(1<<31-1, 0),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CA{Cert: cert, Signer: key, Validity: 24 * time.Hour}
+}
+
+func writePEM(t *testing.T, filename, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,69 @@
+// Package sas derives short authentication strings that humans compare on
+// stprov local and stprov remote.  A string is derived from the entropy that
+// stprov local added and TLS keying material, so that it differs on the two
+// sides if a machine-in-the-middle terminates the TLS connection.
+package sas
+
+import (
+	"crypto/sha256"
+	"strings"
+)
+
+const (
+	// NumWords is the number of words in a short authentication string
+	NumWords = 6
+
+	label = "stprov-sas-v1"
+)
+
+// Derive outputs a short authentication string for entropy that was sent on
+// a TLS connection with exported keying material ekm, e.g., "basil comet ..."
+func Derive(entropy, ekm []byte) string {
+	h := sha256.New()
+	h.Write([]byte(label))
+	h.Write(ekm)
+	h.Write(entropy)
+	sum := h.Sum(nil)
+
+	var words []string
+	for _, b := range sum[:NumWords] {
+		words = append(words, wordList[b])
+	}
+	return strings.Join(words, " ")
+}
+
+// wordList has one word per byte value
+var wordList = [256]string{
+	"acid", "acorn", "actor", "adult", "agent", "alarm", "album", "alert",
+	"alien", "alley", "amber", "angle", "ankle", "apple", "april", "apron",
+	"arena", "armor", "arrow", "atlas", "attic", "audio", "avoid", "awake",
+	"badge", "bagel", "baker", "balmy", "bamboo", "banjo", "barn", "basil",
+	"basin", "batch", "beach", "beard", "berry", "bike", "birch", "bison",
+	"blade", "blank", "blaze", "blend", "blimp", "bloom", "blues", "board",
+	"boat", "bonus", "boost", "booth", "boxer", "brain", "brass", "bread",
+	"brick", "bride", "brook", "broom", "brush", "bucket", "buddy", "bugle",
+	"bunny", "cabin", "cable", "cactus", "camel", "candy", "canoe", "canyon",
+	"cargo", "carpet", "cedar", "chalk", "charm", "cheek", "chess", "chief",
+	"chili", "cider", "cinema", "citrus", "clamp", "cliff", "clock", "cloud",
+	"clover", "coach", "cobra", "cocoa", "comet", "coral", "cotton", "couch",
+	"crane", "crayon", "creek", "crisp", "crown", "cubic", "curry", "daisy",
+	"dance", "delta", "denim", "depot", "desk", "diary", "dingo", "disco",
+	"diver", "dock", "dolphin", "donut", "dragon", "drama", "dream", "drift",
+	"drum", "dune", "eagle", "easel", "eclipse", "elbow", "elder", "ember",
+	"empty", "engine", "enjoy", "envoy", "epoch", "equal", "fable", "fairy",
+	"falcon", "fancy", "fern", "ferry", "fiber", "field", "final", "flame",
+	"flask", "fleet", "flute", "focus", "forest", "fossil", "fox", "frost",
+	"fruit", "fudge", "gadget", "galaxy", "garden", "garlic", "gecko", "genie",
+	"ghost", "giant", "ginger", "glove", "goat", "gorilla", "grape", "gravel",
+	"guitar", "habit", "hammer", "harbor", "hazel", "helmet", "hero", "hippo",
+	"hobby", "honey", "hotel", "humble", "husky", "igloo", "index", "iris",
+	"island", "ivory", "jacket", "jaguar", "jelly", "jewel", "jockey", "judge",
+	"juice", "jungle", "kayak", "kettle", "kiwi", "koala", "label", "ladder",
+	"lagoon", "lamp", "laser", "lemon", "level", "lilac", "lime", "linen",
+	"lizard", "lobster", "locket", "lotus", "lunar", "magnet", "mango", "maple",
+	"marble", "meadow", "melon", "metal", "mint", "mirror", "mocha", "monkey",
+	"moose", "mosaic", "motor", "muffin", "museum", "nectar", "needle", "noodle",
+	"oasis", "ocean", "olive", "onion", "opera", "orbit", "otter", "oyster",
+	"paddle", "panda", "parrot", "peach", "pepper", "piano", "pickle", "pilot",
+	"pixel", "planet", "plum", "poem", "polar", "pony", "puzzle", "quartz",
+}
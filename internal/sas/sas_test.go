@@ -0,0 +1,44 @@
+package sas
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDerive(t *testing.T) {
+	entropy := bytes.Repeat([]byte{1}, 32)
+	ekm := bytes.Repeat([]byte{2}, 32)
+	sas := Derive(entropy, ekm)
+	if got, want := len(strings.Fields(sas)), NumWords; got != want {
+		t.Errorf("got %d words but wanted %d: %q", got, want, sas)
+	}
+	if got, want := Derive(entropy, ekm), sas; got != want {
+		t.Errorf("got %q but wanted %q", got, want)
+	}
+	for _, table := range []struct {
+		desc    string
+		entropy []byte
+		ekm     []byte
+	}{
+		{"other entropy", bytes.Repeat([]byte{3}, 32), ekm},
+		{"other keying material", entropy, bytes.Repeat([]byte{3}, 32)},
+	} {
+		if got := Derive(table.entropy, table.ekm); got == sas {
+			t.Errorf("%s: got the same string %q", table.desc, got)
+		}
+	}
+}
+
+func TestWordList(t *testing.T) {
+	seen := make(map[string]bool)
+	for i, word := range wordList {
+		if word == "" || strings.TrimSpace(word) != word {
+			t.Errorf("word %d: invalid %q", i, word)
+		}
+		if seen[word] {
+			t.Errorf("word %d: duplicate %q", i, word)
+		}
+		seen[word] = true
+	}
+}
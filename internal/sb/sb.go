@@ -3,10 +3,13 @@ package sb
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 
 	"github.com/google/uuid"
 	"github.com/u-root/u-root/pkg/efivarfs"
+
+	"system-transparency.org/stprov/internal/store"
 )
 
 var (
@@ -24,8 +27,8 @@ var (
 )
 
 // IsSetupMode outputs true if the system is in SecureBoot setup mode
-func IsSetupMode() (bool, error) {
-	b, err := efiRead(efiGlobalVariableSetupMode, efiGlobalVariableGUID)
+func IsSetupMode(s store.Store) (bool, error) {
+	b, err := efiRead(s, efiGlobalVariableSetupMode, efiGlobalVariableGUID)
 	if err != nil {
 		return false, fmt.Errorf("%s: %w", efiGlobalVariableSetupMode, err)
 	}
@@ -38,34 +41,75 @@ func IsSetupMode() (bool, error) {
 	return b[0] == 1, nil
 }
 
+// State summarizes the Secure Boot variables of a platform
+type State struct {
+	SetupMode *bool `json:"setup_mode"` // nil if SetupMode could not be read
+	PK        bool  `json:"pk"`         // true if PK is present
+	KEK       bool  `json:"kek"`        // true if KEK is present
+	Db        bool  `json:"db"`         // true if db is present
+	Dbx       bool  `json:"dbx"`        // true if dbx is present
+}
+
+// ReadState reads the current Secure Boot state.  Variables that cannot be
+// read are considered absent.
+func ReadState(s store.Store) State {
+	var state State
+	if ok, err := IsSetupMode(s); err == nil {
+		state.SetupMode = &ok
+	}
+	present := func(name, guid string) bool {
+		_, err := efiRead(s, name, guid)
+		return err == nil
+	}
+	state.PK = present(efiGlobalVariablePK, efiGlobalVariableGUID)
+	state.KEK = present(efiGlobalVariableKEK, efiGlobalVariableGUID)
+	state.Db = present(efiImageSecurityDatabaseDb, efiImageSecurityDatabaseGUID)
+	state.Dbx = present(efiImageSecurityDatabaseDbx, efiImageSecurityDatabaseGUID)
+	return state
+}
+
 // Provision writes PK, KEK, db, and dbx (optional) to EFI NVRAM.  The input
 // must be valid authentication_v2 descriptors (PK is self signed, KEK is signed
 // by PK, and db and dbx are signed by KEK). Setup Mode is also required.
 //
 // PK is provisioned *first* so the user can be sure that signing with PK and
 // KEK works.  In other words, there should not be any surprises in the future.
-func Provision(pk, kek, db, dbx []byte) error {
-	if err := efiAuthenticatedWrite(efiGlobalVariablePK, efiGlobalVariableGUID, pk); err != nil {
-		return fmt.Errorf("%s: %w", efiGlobalVariablePK, err)
+func Provision(s store.Store, pk, kek, db, dbx []byte) error {
+	if err := efiAuthenticatedWrite(s, efiGlobalVariablePK, efiGlobalVariableGUID, pk); err != nil {
+		return &ProvisionError{Variable: efiGlobalVariablePK, Err: err}
 	}
-	if err := efiAuthenticatedWrite(efiGlobalVariableKEK, efiGlobalVariableGUID, kek); err != nil {
-		return fmt.Errorf("%s: %w", efiGlobalVariableKEK, err)
+	if err := efiAuthenticatedWrite(s, efiGlobalVariableKEK, efiGlobalVariableGUID, kek); err != nil {
+		return &ProvisionError{Variable: efiGlobalVariableKEK, Err: err}
 	}
-	if err := efiAuthenticatedWrite(efiImageSecurityDatabaseDb, efiImageSecurityDatabaseGUID, db); err != nil {
-		return fmt.Errorf("%s: %w", efiImageSecurityDatabaseDb, err)
+	if err := efiAuthenticatedWrite(s, efiImageSecurityDatabaseDb, efiImageSecurityDatabaseGUID, db); err != nil {
+		return &ProvisionError{Variable: efiImageSecurityDatabaseDb, Err: err}
 	}
 	if len(dbx) != 0 {
-		if err := efiAuthenticatedWrite(efiImageSecurityDatabaseDbx, efiImageSecurityDatabaseGUID, dbx); err != nil {
-			return fmt.Errorf("%s: %w", efiImageSecurityDatabaseDbx, err)
+		if err := efiAuthenticatedWrite(s, efiImageSecurityDatabaseDbx, efiImageSecurityDatabaseGUID, dbx); err != nil {
+			return &ProvisionError{Variable: efiImageSecurityDatabaseDbx, Err: err}
 		}
 	}
 	return nil
 }
 
+// ProvisionError is returned by Provision if a variable could not be written
+type ProvisionError struct {
+	Variable string // "PK", "KEK", "db", or "dbx"
+	Err      error
+}
+
+func (e *ProvisionError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Variable, e.Err)
+}
+
+func (e *ProvisionError) Unwrap() error {
+	return e.Err
+}
+
 // RequestRebootIntoUEFIMenu asks the firmware to go straight into the UEFI menu
 // on next boot
-func RequestRebootIntoUEFIMenu() error {
-	b, err := efiRead(efiGlobalVariableOSIndications, efiGlobalVariableGUID)
+func RequestRebootIntoUEFIMenu(s store.Store) error {
+	b, err := efiRead(s, efiGlobalVariableOSIndications, efiGlobalVariableGUID)
 	if err != nil {
 		b = make([]byte, 8)
 	}
@@ -80,58 +124,63 @@ func RequestRebootIntoUEFIMenu() error {
 	osIndications |= efiOsInditationsBootToFirmwareUI
 	data := make([]byte, 8)
 	binary.LittleEndian.PutUint64(data, osIndications)
-	if err := efiWrite(efiGlobalVariableOSIndications, efiGlobalVariableGUID, data); err != nil {
+	if err := efiWrite(s, efiGlobalVariableOSIndications, efiGlobalVariableGUID, data); err != nil {
 		return fmt.Errorf("%s: %w", efiGlobalVariableOSIndications, err)
 	}
 	return nil
 }
 
-func efiRead(name, guid string) ([]byte, error) {
-	id, err := uuid.Parse(guid)
+// ClearRebootIntoUEFIMenu undoes RequestRebootIntoUEFIMenu.  Other bits in
+// OsIndications are left as is.
+func ClearRebootIntoUEFIMenu(s store.Store) error {
+	b, err := efiRead(s, efiGlobalVariableOSIndications, efiGlobalVariableGUID)
 	if err != nil {
-		return nil, fmt.Errorf("parse guid: %w", err)
+		if errors.Is(err, efivarfs.ErrVarNotExist) {
+			return nil // nothing requested
+		}
+		return fmt.Errorf("%s: %w", efiGlobalVariableOSIndications, err)
+	}
+	if len(b) != 8 {
+		return fmt.Errorf("%s: unexpected data length %d", efiGlobalVariableOSIndications, len(b))
+	}
+	osIndications := binary.LittleEndian.Uint64(b)
+	if osIndications&efiOsInditationsBootToFirmwareUI == 0 {
+		return nil // not requested
 	}
-	desc := efivarfs.VariableDescriptor{Name: name, GUID: id}
-	fs, err := efivarfs.New()
+
+	osIndications &^= efiOsInditationsBootToFirmwareUI
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, osIndications)
+	if err := efiWrite(s, efiGlobalVariableOSIndications, efiGlobalVariableGUID, data); err != nil {
+		return fmt.Errorf("%s: %w", efiGlobalVariableOSIndications, err)
+	}
+	return nil
+}
+
+func efiRead(s store.Store, name, guid string) ([]byte, error) {
+	id, err := uuid.Parse(guid)
 	if err != nil {
-		return nil, fmt.Errorf("new efivarfs: %w", err)
+		return nil, fmt.Errorf("parse guid: %w", err)
 	}
-	_, b, err := efivarfs.ReadVariable(fs, desc)
+	b, err := store.Read(s, name, &id)
 	if err != nil {
 		return nil, fmt.Errorf("read efivarfs: %w", err)
 	}
 	return b, err
 }
 
-func efiWrite(name, guid string, data []byte) error {
-	fs, err := efivarfs.New()
-	if err != nil {
-		return fmt.Errorf("new efivarfs: %w", err)
-	}
+func efiWrite(s store.Store, name, guid string, data []byte) error {
 	id, err := uuid.Parse(guid)
 	if err != nil {
 		return fmt.Errorf("parse guid %s: %w", guid, err)
 	}
-	desc := efivarfs.VariableDescriptor{Name: name, GUID: id}
-	attrs := efivarfs.AttributeNonVolatile
-	attrs |= efivarfs.AttributeBootserviceAccess
-	attrs |= efivarfs.AttributeRuntimeAccess
-	return efivarfs.WriteVariable(fs, desc, attrs, data)
+	return store.Write(s, name, &id, data)
 }
 
-func efiAuthenticatedWrite(name, guid string, authData []byte) error {
-	fs, err := efivarfs.New()
-	if err != nil {
-		return fmt.Errorf("new efivarfs: %w", err)
-	}
+func efiAuthenticatedWrite(s store.Store, name, guid string, authData []byte) error {
 	id, err := uuid.Parse(guid)
 	if err != nil {
 		return fmt.Errorf("parse guid %s: %w", guid, err)
 	}
-	desc := efivarfs.VariableDescriptor{Name: name, GUID: id}
-	attrs := efivarfs.AttributeNonVolatile
-	attrs |= efivarfs.AttributeBootserviceAccess
-	attrs |= efivarfs.AttributeRuntimeAccess
-	attrs |= efivarfs.AttributeTimeBasedAuthenticatedWriteAccess
-	return efivarfs.WriteVariable(fs, desc, attrs, authData)
+	return store.WriteWithAttributes(s, name, &id, efivarfs.AttributeTimeBasedAuthenticatedWriteAccess, authData)
 }
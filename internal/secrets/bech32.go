@@ -0,0 +1,125 @@
+package secrets
+
+// Bech32 encoding as specified in BIP 173, which is what age uses for its
+// recipients and identities.  There is no length limit, same as in age.
+
+import (
+	"fmt"
+	"strings"
+)
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+var bech32Generator = [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+// bech32Encode encodes data with a human-readable part.  The output is upper
+// case if the human-readable part is, and otherwise lower case.
+func bech32Encode(hrp string, data []byte) (string, error) {
+	upper := strings.ToUpper(hrp) == hrp && strings.ToLower(hrp) != hrp
+	if !upper && strings.ToLower(hrp) != hrp {
+		return "", fmt.Errorf("mixed-case human-readable part %q", hrp)
+	}
+	data5, err := convertBits(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	s := bech32Encode5(strings.ToLower(hrp), data5)
+	if upper {
+		return strings.ToUpper(s), nil
+	}
+	return s, nil
+}
+
+// bech32Encode5 encodes 5-bit groups with a lower-case human-readable part
+func bech32Encode5(hrp string, data []byte) string {
+	values := append(bech32HRPExpand(hrp), data...)
+	polymod := bech32Polymod(append(values, 0, 0, 0, 0, 0, 0)) ^ 1
+
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, v := range data {
+		sb.WriteByte(bech32Charset[v])
+	}
+	for i := 0; i < 6; i++ {
+		sb.WriteByte(bech32Charset[(polymod>>uint(5*(5-i)))&31])
+	}
+	return sb.String()
+}
+
+// bech32Decode decodes a string that must have a given human-readable part.
+// Both the string and the human-readable part are case insensitive.
+func bech32Decode(hrp, s string) ([]byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return nil, fmt.Errorf("mixed-case string")
+	}
+	s = strings.ToLower(s)
+	i := strings.LastIndexByte(s, '1')
+	if i < 1 || i+7 > len(s) {
+		return nil, fmt.Errorf("malformed string")
+	}
+	if got, want := s[:i], strings.ToLower(hrp); got != want {
+		return nil, fmt.Errorf("human-readable part %q, expected %q", got, want)
+	}
+	var data []byte
+	for _, c := range s[i+1:] {
+		v := strings.IndexRune(bech32Charset, c)
+		if v < 0 {
+			return nil, fmt.Errorf("invalid character %q", c)
+		}
+		data = append(data, byte(v))
+	}
+	if bech32Polymod(append(bech32HRPExpand(s[:i]), data...)) != 1 {
+		return nil, fmt.Errorf("invalid checksum")
+	}
+	return convertBits(data[:len(data)-6], 5, 8, false)
+}
+
+func bech32Polymod(values []byte) uint32 {
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i, g := range bech32Generator {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= g
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	var values []byte
+	for i := 0; i < len(hrp); i++ {
+		values = append(values, hrp[i]>>5)
+	}
+	values = append(values, 0)
+	for i := 0; i < len(hrp); i++ {
+		values = append(values, hrp[i]&31)
+	}
+	return values
+}
+
+// convertBits regroups bits from groups of size from to groups of size to.  If
+// pad is set, the last group is padded with zeros.  Otherwise, it is an error
+// if there are leftover bits that are not zero padding.
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	var out []byte
+	acc, bits := uint32(0), uint(0)
+	maxv := uint32(1)<<to - 1
+	for _, b := range data {
+		acc = acc<<from | uint32(b)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+	if pad && bits > 0 {
+		out = append(out, byte(acc<<(to-bits)&maxv))
+	} else if !pad && (bits >= from || acc<<(to-bits)&maxv != 0) {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	return out, nil
+}
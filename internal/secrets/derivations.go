@@ -0,0 +1,221 @@
+package secrets
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strings"
+
+	"system-transparency.org/stprov/internal/ssh"
+)
+
+// Key types of named derivations
+const (
+	KeyTypeX25519    = "x25519"
+	KeyTypeECDSAP256 = ssh.KeyTypeECDSAP256
+)
+
+// Derivation is a named key that can be derived from a unique device secret,
+// in addition to the platform's SSH host key
+type Derivation struct {
+	Name    string // selected by stprov local, e.g., "wireguard"
+	Label   string // HKDF label, see Reader()
+	KeyType string // KeyTypeX25519 or KeyTypeECDSAP256
+	EFIName string // EFI variable that stprov remote writes the private key to
+
+	// marshal derives a key from rand, outputting the private key in the
+	// format that is written to EFI NVRAM and the public key as a string
+	marshal func(rand io.Reader) (priv []byte, pub string, err error)
+	// parse outputs the public key of a private key in the format that
+	// marshal outputs
+	parse func(priv []byte) (pub string, err error)
+}
+
+// DerivedKey is the output of a named derivation
+type DerivedKey struct {
+	Name      string // see Derivation
+	EFIName   string // see Derivation
+	Private   []byte // private key in the format of the named derivation
+	PublicKey string // public key in the format of the named derivation
+}
+
+// Derivations lists the supported named derivations.  The private key formats
+// are those of the tools that consume them:
+//
+//   - wireguard: base64-encoded X25519 key as output by "wg genkey", with the
+//     public key as output by "wg pubkey"
+//   - age: X25519 identity as output by "age-keygen", with the recipient
+//     ("age1...") as public key
+//   - tls-client: ECDSA P-256 key in PKCS #8 PEM format, with the
+//     base64-encoded DER SubjectPublicKeyInfo as public key
+var Derivations = []Derivation{
+	{"wireguard", "uds:wireguard", KeyTypeX25519, "STWireGuardKey", marshalWireGuard, parseWireGuard},
+	{"age", "uds:age", KeyTypeX25519, "STAgeKey", marshalAge, parseAge},
+	{"tls-client", "uds:tls-client", KeyTypeECDSAP256, "STTLSClientKey", marshalTLSClient, parseTLSClient},
+}
+
+// DerivationNames outputs the names of all supported named derivations
+func DerivationNames() []string {
+	var names []string
+	for _, d := range Derivations {
+		names = append(names, d.Name)
+	}
+	return names
+}
+
+// LookupDerivation looks up a named derivation
+func LookupDerivation(name string) (*Derivation, error) {
+	for _, d := range Derivations {
+		if d.Name == name {
+			return &d, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown derivation %q, must be one of %s", name, strings.Join(DerivationNames(), ", "))
+}
+
+// Derive derives a named key, see Derivations.  Each name is derived with a
+// separate label, so the resulting keys are unrelated.
+func (uds *UniqueDeviceSecret) Derive(name string) (*DerivedKey, error) {
+	d, err := LookupDerivation(name)
+	if err != nil {
+		return nil, err
+	}
+	priv, pub, err := d.marshal(Reader(uds[:], d.Label, 1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &DerivedKey{Name: d.Name, EFIName: d.EFIName, Private: priv, PublicKey: pub}, nil
+}
+
+// PublicKey parses a private key in the format of the named derivation, e.g.,
+// as read back from EFI NVRAM, outputting its public key
+func (d *Derivation) PublicKey(priv []byte) (string, error) {
+	pub, err := d.parse(priv)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", d.Name, err)
+	}
+	return pub, nil
+}
+
+func deriveX25519(rand io.Reader) (*ecdh.PrivateKey, error) {
+	var b [32]byte
+	if _, err := io.ReadFull(rand, b[:]); err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(b[:])
+}
+
+func marshalWireGuard(rand io.Reader) ([]byte, string, error) {
+	priv, err := deriveX25519(rand)
+	if err != nil {
+		return nil, "", err
+	}
+	// Clamped the same way as "wg genkey", see RFC 7748, Section 5
+	b := priv.Bytes()
+	b[0] &= 248
+	b[31] = (b[31] & 127) | 64
+
+	privB64 := base64.StdEncoding.EncodeToString(b)
+	pubB64 := base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes())
+	return []byte(privB64 + "\n"), pubB64, nil
+}
+
+func marshalAge(rand io.Reader) ([]byte, string, error) {
+	priv, err := deriveX25519(rand)
+	if err != nil {
+		return nil, "", err
+	}
+	identity, err := bech32Encode("AGE-SECRET-KEY-", priv.Bytes())
+	if err != nil {
+		return nil, "", err
+	}
+	recipient, err := bech32Encode("age", priv.PublicKey().Bytes())
+	if err != nil {
+		return nil, "", err
+	}
+	return []byte(fmt.Sprintf("# public key: %s\n%s\n", recipient, identity)), recipient, nil
+}
+
+// deriveECDSAP256 derives an ECDSA P-256 key the same way as an SSH host key
+func deriveECDSAP256(rand io.Reader) (*ecdsa.PrivateKey, error) {
+	hk, err := ssh.NewHostKeyOfType(rand, ssh.KeyTypeECDSAP256, "")
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := hk.Private.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unexpected private key type %T", hk.Private)
+	}
+	return priv, nil
+}
+
+func marshalTLSClient(rand io.Reader) ([]byte, string, error) {
+	priv, err := deriveECDSAP256(rand)
+	if err != nil {
+		return nil, "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, "", fmt.Errorf("marshal private key: %w", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("marshal public key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), base64.StdEncoding.EncodeToString(pub), nil
+}
+
+func parseWireGuard(priv []byte) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(priv)))
+	if err != nil {
+		return "", fmt.Errorf("decode private key: %w", err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+func parseAge(priv []byte) (string, error) {
+	for _, line := range strings.Split(string(priv), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		b, err := bech32Decode("AGE-SECRET-KEY-", line)
+		if err != nil {
+			return "", fmt.Errorf("decode identity: %w", err)
+		}
+		key, err := ecdh.X25519().NewPrivateKey(b)
+		if err != nil {
+			return "", err
+		}
+		return bech32Encode("age", key.PublicKey().Bytes())
+	}
+	return "", fmt.Errorf("no identity")
+}
+
+func parseTLSClient(priv []byte) (string, error) {
+	block, _ := pem.Decode(priv)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return "", fmt.Errorf("no pem-encoded private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("parse private key: %w", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("unexpected private key type %T", key)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("marshal public key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(pub), nil
+}
@@ -3,18 +3,16 @@
 package secrets
 
 import (
+	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/hex"
-	"encoding/pem"
 	"fmt"
 	"io"
 	"math"
 	"math/big"
-	"net"
 	"time"
 
 	"golang.org/x/crypto/hkdf"
@@ -34,10 +32,26 @@ func NewEntropy() (*Entropy, error) {
 	return &entropy, err
 }
 
-// Reader generates randomness using HKDF with SHA256 as the hash function
+// Derivation versions are part of the HKDF info string, so that secrets that
+// are derived in different ways never collide
+const (
+	V1 = 1 // info "stprov:<label>"
+	V2 = 2 // info "stprov/v2:<label>", used for the TLS-bound UDS
+)
+
+// Reader generates randomness using HKDF with SHA256 as the hash function.
+// The derivation version is V1.
 func Reader(secret []byte, label string, context uint) io.Reader {
+	return VersionedReader(V1, secret, label, context)
+}
+
+// VersionedReader is like Reader, but with a given derivation version
+func VersionedReader(version int, secret []byte, label string, context uint) io.Reader {
 	c := fmt.Sprintf("%d", context)
-	l := fmt.Sprintf("stprov:%s", label)
+	l := fmt.Sprintf("stprov/v%d:%s", version, label)
+	if version == V1 {
+		l = fmt.Sprintf("stprov:%s", label)
+	}
 	return hkdf.New(sha256.New, secret, []byte(c), []byte(l))
 }
 
@@ -45,15 +59,21 @@ func Reader(secret []byte, label string, context uint) io.Reader {
 type UniqueDeviceSecret Entropy
 
 // NewUniqueDeviceSecret generates a unique device secret by mixing entropy from
-// an external and an internal source
-func NewUniqueDeviceSecret(ext *Entropy) (*UniqueDeviceSecret, error) {
+// an external and an internal source with keying material exported from the
+// TLS connection that the external entropy was received on (RFC 5705).  The
+// derivation version is V2.
+func NewUniqueDeviceSecret(ext *Entropy, ekm []byte) (*UniqueDeviceSecret, error) {
+	if len(ekm) == 0 {
+		return nil, fmt.Errorf("no exported keying material")
+	}
 	loc, err := NewEntropy()
 	if err != nil {
 		return nil, err
 	}
 
+	secret := append(append(loc[:], ext[:]...), ekm...)
 	uds := UniqueDeviceSecret{}
-	_, err = io.ReadFull(Reader(append(loc[:], ext[:]...), "uds", 1), uds[:])
+	_, err = io.ReadFull(VersionedReader(V2, secret, "uds", 1), uds[:])
 	return &uds, err
 }
 
@@ -73,14 +93,25 @@ func (uds *UniqueDeviceSecret) Authentication() (*Entropy, error) {
 	return &auth, err
 }
 
-// SSH derives a platform's Ed25519 host key (not a general ST parameter)
-func (uds *UniqueDeviceSecret) SSH() (*ssh.HostKey, error) {
-	return ssh.NewHostKey(Reader(uds[:], "uds:ssh", 1), "ospkg@system-transparency")
+// SSH derives a platform's host key of a given type, see ssh.KeyTypes (not a
+// general ST parameter).  Each key type is derived with a separate label, and
+// the Ed25519 label is the same as before other key types were supported.
+func (uds *UniqueDeviceSecret) SSH(keyType string) (*ssh.HostKey, error) {
+	label := "uds:ssh"
+	if keyType != ssh.KeyTypeEd25519 {
+		label += ":" + keyType
+	}
+	return ssh.NewHostKeyOfType(Reader(uds[:], label, 1), keyType, "ospkg@system-transparency")
+}
+
+// X509 derives a platform's ECDSA P-256 key for an X.509 identity certificate
+// (not a general ST parameter), see package pki
+func (uds *UniqueDeviceSecret) X509() (*ecdsa.PrivateKey, error) {
+	return deriveECDSAP256(Reader(uds[:], "uds:x509", 1))
 }
 
-// OneTimePassword is a one time password used to bootstrap mutually
-// authenticated HTTPS.  TLS 1.3 and a proper PSK mode should replace
-// this in the future if the standard Go library adds such support.
+// OneTimePassword is a one time password used as the password of a PAKE
+// exchange between stprov local and stprov remote, see package pake
 type OneTimePassword Entropy
 
 // NewOneTimePassword derives a one-time password from a shared secret
@@ -90,56 +121,23 @@ func NewOneTimePassword(secret string) (*OneTimePassword, error) {
 	return &otp, err
 }
 
-// BasicAuthPassword derives a basic auth password
-func (otp *OneTimePassword) BasicAuthPassword() (string, error) {
-	var pw Entropy
-	_, err := io.ReadFull(Reader(otp[:], "otp:basicAuthPassword", 1), pw[:])
-	return hex.EncodeToString(pw[:]), err
-}
-
-// X509 derives an X509 certificate for a given IP address
-func (otp *OneTimePassword) X509Certificate(ip net.IP) (*x509.Certificate, error) {
-	_, crtDER, err := otp.keyGen(ip)
-	if err != nil {
-		return nil, err
-	}
-	return x509.ParseCertificate(crtDER)
-}
-
-// TLSCertificate derives a TLS certificate struct containing a private key and
-// the same public X.509 certificate that is derived by X509Certificate()
-func (otp OneTimePassword) TLSCertificate(ip net.IP) (*tls.Certificate, error) {
-	privDER, crtDER, err := otp.keyGen(ip)
-	if err != nil {
-		return nil, fmt.Errorf("generate key-pair: %w", err)
-	}
-	privPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: privDER,
-	})
-	crtPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: crtDER,
-	})
-	crt, err := tls.X509KeyPair(crtPEM, privPEM)
-	if err != nil {
-		return nil, fmt.Errorf("encode key-pair: %w", err)
-	}
-	return &crt, nil
-}
-
-func (otp *OneTimePassword) keyGen(_ net.IP) ([]byte, []byte, error) {
-	pub, priv, err := ed25519.GenerateKey(Reader(otp[:], "otp:keygen", 1))
+// NewTLSCertificate generates an ephemeral self-signed TLS certificate.  It is
+// not trusted by itself, but pinned by stprov local after a PAKE exchange that
+// is bound to the TLS connection.
+func NewTLSCertificate(rand io.Reader) (*tls.Certificate, error) {
+	pub, priv, err := ed25519.GenerateKey(rand)
 	if err != nil {
-		return nil, nil, err
+		return nil, fmt.Errorf("generate key: %w", err)
 	}
 	tmpl := template()
-	crtDER, err := x509.CreateCertificate(Reader(otp[:], "otp:keygen", 2), tmpl, tmpl, pub, priv)
+	crtDER, err := x509.CreateCertificate(rand, tmpl, tmpl, pub, priv)
 	if err != nil {
-		return nil, nil, err
+		return nil, fmt.Errorf("create certificate: %w", err)
 	}
-	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
-	return privDER, crtDER, err
+	return &tls.Certificate{
+		Certificate: [][]byte{crtDER},
+		PrivateKey:  priv,
+	}, nil
 }
 
 const DummyServerName = "stprov"
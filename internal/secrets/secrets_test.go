@@ -2,12 +2,16 @@ package secrets
 
 import (
 	"bytes"
-	"crypto/tls"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 	"io"
-	"net"
 	"reflect"
+	"strings"
 	"testing"
 
 	"system-transparency.org/stprov/internal/ssh"
@@ -21,7 +25,9 @@ func TestReader(t *testing.T) {
 		{"other secret ", Reader([]byte("SECRET"), "label", 1), Reader([]byte("secret"), "label", 1)},
 		{"other label  ", Reader([]byte("secret"), "LABEL", 1), Reader([]byte("secret"), "label", 1)},
 		{"other counter", Reader([]byte("secret"), "label", 2), Reader([]byte("secret"), "label", 1)},
+		{"other version", VersionedReader(V2, []byte("secret"), "label", 1), Reader([]byte("secret"), "label", 1)},
 		{"equal readers", Reader([]byte("secret"), "label", 1), Reader([]byte("secret"), "label", 1)},
+		{"equal readers", VersionedReader(V1, []byte("secret"), "label", 1), Reader([]byte("secret"), "label", 1)},
 	} {
 		var b1, b2 [32]byte
 		if _, err := io.ReadFull(table.r1, b1[:]); err != nil {
@@ -37,17 +43,21 @@ func TestReader(t *testing.T) {
 }
 
 func TestNewUniqueDeviceSecret(t *testing.T) {
-	uds, err := NewUniqueDeviceSecret(&Entropy{})
+	ekm := bytes.Repeat([]byte{0x01}, 32)
+	uds, err := NewUniqueDeviceSecret(&Entropy{}, ekm)
 	if err != nil {
 		t.Fatalf("derive uds: %v", err)
 	}
-	udsOther, err := NewUniqueDeviceSecret(&Entropy{})
+	udsOther, err := NewUniqueDeviceSecret(&Entropy{}, ekm)
 	if err != nil {
 		t.Fatalf("derive other uds: %v", err)
 	}
 	if bytes.Equal(uds[:], udsOther[:]) {
 		t.Errorf("uds is identical to another uds")
 	}
+	if _, err := NewUniqueDeviceSecret(&Entropy{}, nil); err == nil {
+		t.Errorf("derived uds without exported keying material")
+	}
 }
 
 func TestUniqueDeviceSecretDerivations(t *testing.T) {
@@ -59,7 +69,7 @@ func TestUniqueDeviceSecretDerivations(t *testing.T) {
 		if auth, err = uds.Authentication(); err != nil {
 			t.Fatalf("derive authentication: %v", err)
 		}
-		if hk, err = uds.SSH(); err != nil {
+		if hk, err = uds.SSH(ssh.DefaultKeyType); err != nil {
 			t.Fatalf("derive ssh host key: %v", err)
 		}
 		return
@@ -91,6 +101,218 @@ func TestUniqueDeviceSecretDerivations(t *testing.T) {
 	}
 }
 
+// TestSSHVectors pins the SSH host keys that are derived from a unique device
+// secret, so that a platform's host key never changes with stprov's version
+func TestSSHVectors(t *testing.T) {
+	for _, table := range []struct {
+		uds         UniqueDeviceSecret
+		keyType     string
+		fingerprint string
+	}{
+		{UniqueDeviceSecret{}, ssh.KeyTypeEd25519, "SHA256:Ttm5qCF2YYhPfNU7c940RF4hS/5esmvrT50psX544AM"},
+		{UniqueDeviceSecret{}, ssh.KeyTypeECDSAP256, "SHA256:bKMRzgqlgtCaXF/1+kBvmI+klcP1J+Nsl1BkUj4Uzeo"},
+		{UniqueDeviceSecret{}, ssh.KeyTypeRSA3072, "SHA256:nrBkouvTySlY7Vo5voKXkRj508WJGGdrUWr00J52s/U"},
+		{UniqueDeviceSecret{1}, ssh.KeyTypeEd25519, "SHA256:e8sh6ebBPh6neDiMtAuv9JdKWZ3hZ59OhfFfLUoNMDY"},
+		{UniqueDeviceSecret{1}, ssh.KeyTypeECDSAP256, "SHA256:fyulT/V71of3BAIfFoks6BRlcH1PtjXi2LFQmk+Zz2g"},
+		{UniqueDeviceSecret{1}, ssh.KeyTypeRSA3072, "SHA256:1/I7upT7v6rAvDxiHNVG6sUrdEwnPQOV84jv/Oe0/qU"},
+	} {
+		hk, err := table.uds.SSH(table.keyType)
+		if err != nil {
+			t.Fatalf("%s: derive ssh host key: %v", table.keyType, err)
+		}
+		if got, want := hk.Type(), table.keyType; got != want {
+			t.Errorf("%s: got key type %q", table.keyType, got)
+		}
+		fpr, err := hk.Fingerprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := fpr, table.fingerprint; got != want {
+			t.Errorf("%s: got fingerprint %s but wanted %s", table.keyType, got, want)
+		}
+	}
+	if _, err := (&UniqueDeviceSecret{}).SSH("dsa"); err == nil {
+		t.Errorf("derived ssh host key of unsupported type")
+	}
+}
+
+func TestBech32Encode(t *testing.T) {
+	var data []byte
+	for i := 0; i < 32; i++ {
+		data = append(data, byte(i))
+	}
+	// Test vectors from BIP 173 and age
+	for _, table := range []struct {
+		hrp  string
+		data []byte
+		want string
+	}{
+		{"a", nil, "a12uel5l"},
+		{"abcdef", data, "abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw"},
+	} {
+		if got := bech32Encode5(table.hrp, table.data); got != table.want {
+			t.Errorf("%s: got %s but wanted %s", table.hrp, got, table.want)
+		}
+	}
+	got, err := bech32Encode("AGE-SECRET-KEY-", bytes.Repeat([]byte{0x42}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "AGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX"; got != want {
+		t.Errorf("got %s but wanted %s", got, want)
+	}
+	if _, err := bech32Encode("Age", nil); err == nil {
+		t.Errorf("encoded with mixed-case human-readable part")
+	}
+}
+
+func TestBech32Decode(t *testing.T) {
+	id := "AGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX"
+	for _, table := range []struct {
+		desc   string
+		hrp    string
+		s      string
+		wantOK bool
+	}{
+		{"valid", "AGE-SECRET-KEY-", id, true},
+		{"valid: lower case", "age-secret-key-", strings.ToLower(id), true},
+		{"invalid: mixed case", "AGE-SECRET-KEY-", "a" + id[1:], false},
+		{"invalid: other hrp", "age", id, false},
+		{"invalid: checksum", "AGE-SECRET-KEY-", id[:len(id)-1] + "Q", false},
+		{"invalid: character", "AGE-SECRET-KEY-", id[:20] + "B" + id[21:], false},
+		{"invalid: too short", "AGE-SECRET-KEY-", "AGE-SECRET-KEY-1Q4EG", false},
+	} {
+		b, err := bech32Decode(table.hrp, table.s)
+		if got, want := err == nil, table.wantOK; got != want {
+			t.Errorf("%s: got ok %v but wanted %v: %v", table.desc, got, want, err)
+		}
+		if err == nil && !bytes.Equal(b, bytes.Repeat([]byte{0x42}, 32)) {
+			t.Errorf("%s: got data %x", table.desc, b)
+		}
+	}
+}
+
+// TestDeriveVectors pins the named keys that are derived from a unique device
+// secret, and checks that each private key matches its public key
+func TestDeriveVectors(t *testing.T) {
+	for _, table := range []struct {
+		uds       UniqueDeviceSecret
+		name      string
+		publicKey string
+	}{
+		{UniqueDeviceSecret{}, "wireguard", "qBGvlp2jjMi6FP+vPA8Pm1kllAexmT4n/0bMwJokn1U="},
+		{UniqueDeviceSecret{}, "age", "age149r56xxq7fd2u22e5yn4xe9g6rdgun43fzunu6cc0rsxcvxxephqzqcmkx"},
+		{UniqueDeviceSecret{}, "tls-client", "MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEqf9ZoLi+gVEA5bhd3wsBCfQ38UOOYnThDibJyDigxegrjsXz6oWdT1M05GEMizzstPy2zxqRuOOBuouLOqEqXg=="},
+		{UniqueDeviceSecret{1}, "wireguard", "gT5at/UVyHGr3vv10CIvyWxZglMj1Kz7L+hvpwuUF08="},
+		{UniqueDeviceSecret{1}, "age", "age1mvg5zsa4fln8g6g800ytvc54z4kpw2e50lgp49l6v0suh47x5fwqpxny6n"},
+		{UniqueDeviceSecret{1}, "tls-client", "MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE1ppZAkewILJjq/L27FI+QuaFF0GqVQAF0+cZoLNSyahMM9Lhg2K0aneJ/HBPZFYDLAJ21G6WO0d+41xhvUfUjA=="},
+	} {
+		dk, err := table.uds.Derive(table.name)
+		if err != nil {
+			t.Fatalf("%s: derive: %v", table.name, err)
+		}
+		if got, want := dk.PublicKey, table.publicKey; got != want {
+			t.Errorf("%s: got public key %s but wanted %s", table.name, got, want)
+		}
+		d, err := LookupDerivation(table.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := dk.EFIName, d.EFIName; got != want {
+			t.Errorf("%s: got EFI name %s but wanted %s", table.name, got, want)
+		}
+		if got, want := publicKey(t, table.name, dk.Private), dk.PublicKey; got != want {
+			t.Errorf("%s: private key does not match public key %s, got %s", table.name, want, got)
+		}
+		if got, err := d.PublicKey(dk.Private); err != nil || got != dk.PublicKey {
+			t.Errorf("%s: parsed public key %s (%v) but wanted %s", table.name, got, err, dk.PublicKey)
+		}
+		if _, err := d.PublicKey(dk.Private[1:]); err == nil {
+			t.Errorf("%s: parsed a malformed private key", table.name)
+		}
+	}
+	if _, err := (&UniqueDeviceSecret{}).Derive("ssh"); err == nil {
+		t.Errorf("derived unknown name")
+	}
+}
+
+// publicKey parses a derived private key, outputting its public key
+func publicKey(t *testing.T, name string, priv []byte) string {
+	t.Helper()
+	switch name {
+	case "wireguard":
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(string(priv), "\n"))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		k, err := ecdh.X25519().NewPrivateKey(b)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return base64.StdEncoding.EncodeToString(k.PublicKey().Bytes())
+	case "age":
+		// The recipient is in a comment, so only check the identity's format
+		lines := strings.Split(strings.TrimSuffix(string(priv), "\n"), "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[1], "AGE-SECRET-KEY-1") {
+			t.Fatalf("%s: malformed identity file:\n%s", name, priv)
+		}
+		return strings.TrimPrefix(lines[0], "# public key: ")
+	case "tls-client":
+		block, _ := pem.Decode(priv)
+		if block == nil || block.Type != "PRIVATE KEY" {
+			t.Fatalf("%s: malformed pem:\n%s", name, priv)
+		}
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		pub, err := x509.MarshalPKIXPublicKey(k.(*ecdsa.PrivateKey).Public())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return base64.StdEncoding.EncodeToString(pub)
+	}
+	t.Fatalf("%s: unknown name", name)
+	return ""
+}
+
+func TestX509(t *testing.T) {
+	key, err := (&UniqueDeviceSecret{}).X509()
+	if err != nil {
+		t.Fatalf("derive x509 key: %v", err)
+	}
+	again, err := (&UniqueDeviceSecret{}).X509()
+	if err != nil {
+		t.Fatalf("derive x509 key again: %v", err)
+	}
+	if !key.Equal(again) {
+		t.Errorf("x509 key is not deterministic")
+	}
+	other, err := (&UniqueDeviceSecret{1}).X509()
+	if err != nil {
+		t.Fatalf("derive other x509 key: %v", err)
+	}
+	if key.Equal(other) {
+		t.Errorf("different uds but equal x509 keys")
+	}
+	dk, err := (&UniqueDeviceSecret{}).Derive("tls-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := publicKey(t, "tls-client", dk.Private); got == spki(t, key) {
+		t.Errorf("x509 key is equal to the tls-client key")
+	}
+}
+
+func spki(t *testing.T, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
 func TestNewOneTimePassword(t *testing.T) {
 	for _, table := range []struct {
 		desc   string
@@ -113,49 +335,26 @@ func TestNewOneTimePassword(t *testing.T) {
 	}
 }
 
-func TestOneTimePasswordDerivation(t *testing.T) {
-	derive := func(otp OneTimePassword) (ba string, xcrt *x509.Certificate, tcrt *tls.Certificate) {
-		var err error
-		if ba, err = otp.BasicAuthPassword(); err != nil {
-			t.Fatalf("derive basic auth password: %v", err)
-		}
-		if xcrt, err = otp.X509Certificate(net.IPv4(192, 168, 0, 1)); err != nil {
-			t.Fatalf("derive x509 certificate: %v", err)
-		}
-		if tcrt, err = otp.TLSCertificate(net.IPv4(192, 168, 0, 1)); err != nil {
-			t.Fatalf("derive tls certificate: %v", err)
-		}
-		return
+func TestNewTLSCertificate(t *testing.T) {
+	crt, err := NewTLSCertificate(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate tls certificate: %v", err)
 	}
-	check := func(ba1, ba2 string, xcrt1, xcrt2 *x509.Certificate, tcrt1, tcrt2 *tls.Certificate) error {
-		if ba1 != ba2 {
-			return fmt.Errorf("basic auth is not equal")
-		}
-		if !reflect.DeepEqual(xcrt1, xcrt2) {
-			return fmt.Errorf("x509 certificate is not equal")
-		}
-		if !reflect.DeepEqual(tcrt1, tcrt2) {
-			return fmt.Errorf("tls certificate is not equal")
-		}
-		if got, want := len(tcrt1.Certificate), 1; got != want {
-			return fmt.Errorf("invalid number of certificates: %d", got)
-		}
-		if !bytes.Equal(xcrt1.Raw, tcrt1.Certificate[0]) {
-			return fmt.Errorf("client-server certificate mismatch")
-		}
-		return nil
+	crtOther, err := NewTLSCertificate(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate other tls certificate: %v", err)
 	}
-
-	otp := OneTimePassword{}
-	otpOther := OneTimePassword{1}
-
-	ba, xcrt, tcrt := derive(otp)
-	baAgain, xcrtAgain, tcrtAgain := derive(otp)
-	baOther, xcrtOther, tcrtOther := derive(otpOther)
-	if err := check(ba, baAgain, xcrt, xcrtAgain, tcrt, tcrtAgain); err != nil {
-		t.Error(err)
+	if got, want := len(crt.Certificate), 1; got != want {
+		t.Fatalf("invalid number of certificates: %d", got)
+	}
+	xcrt, err := x509.ParseCertificate(crt.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	if err := xcrt.CheckSignature(xcrt.SignatureAlgorithm, xcrt.RawTBSCertificate, xcrt.Signature); err != nil {
+		t.Errorf("certificate is not self-signed: %v", err)
 	}
-	if err := check(ba, baOther, xcrt, xcrtOther, tcrt, tcrtOther); err == nil {
-		t.Errorf("other otp but valid derivations")
+	if bytes.Equal(crt.Certificate[0], crtOther.Certificate[0]) {
+		t.Errorf("certificate is identical to another certificate")
 	}
 }
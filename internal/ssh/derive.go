@@ -0,0 +1,137 @@
+package ssh
+
+// The standard library ignores the random source when generating ECDSA and
+// RSA keys since Go 1.26, so these key types are derived deterministically
+// here instead.  This is required to derive a host key from a secret.
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// maxPrimeDelta is the maximum distance from a random starting point that a
+// prime is searched for, before starting over from a new random point
+const maxPrimeDelta = 1 << 20
+
+// smallPrimes and smallPrimesProduct are used to sieve prime candidates, same
+// as crypto/rand.Prime() in Go 1.19 and earlier
+var (
+	smallPrimes        = []uint8{3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53}
+	smallPrimesProduct = new(big.Int).SetUint64(16294579238595022365)
+)
+
+// deriveECDSA derives an ECDSA private key from rand with the "extra random
+// bits" method in FIPS 186-5, Appendix A.2.1
+func deriveECDSA(rand io.Reader, curve elliptic.Curve) (*ecdsa.PrivateKey, error) {
+	n := curve.Params().N
+	b := make([]byte, (n.BitLen()+64+7)/8)
+	if _, err := io.ReadFull(rand, b); err != nil {
+		return nil, err
+	}
+	nMinusOne := new(big.Int).Sub(n, big.NewInt(1))
+	d := new(big.Int).SetBytes(b)
+	d.Mod(d, nMinusOne).Add(d, big.NewInt(1))
+	return ecdsa.ParseRawPrivateKey(curve, d.FillBytes(make([]byte, (n.BitLen()+7)/8)))
+}
+
+// deriveRSA derives an RSA private key with two primes and public exponent
+// 65537 from rand
+func deriveRSA(rand io.Reader, bits int) (*rsa.PrivateKey, error) {
+	e := big.NewInt(65537)
+	one := big.NewInt(1)
+	for {
+		p, err := derivePrime(rand, bits-bits/2)
+		if err != nil {
+			return nil, err
+		}
+		q, err := derivePrime(rand, bits/2)
+		if err != nil {
+			return nil, err
+		}
+		// Same requirement as crypto/rsa, see FIPS 186-5, Appendix A.1.3
+		if diff := new(big.Int).Sub(p, q); diff.BitLen() <= bits/2-100 {
+			continue
+		}
+		n := new(big.Int).Mul(p, q)
+		if n.BitLen() != bits {
+			continue
+		}
+		phi := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+		d := new(big.Int).ModInverse(e, phi)
+		if d == nil {
+			continue // e is not coprime with phi
+		}
+
+		priv := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		if err := priv.Validate(); err != nil {
+			return nil, fmt.Errorf("validate: %w", err)
+		}
+		priv.Precompute()
+		return priv, nil
+	}
+}
+
+// derivePrime derives a prime of a given bit length from rand.  The top two
+// bits are set, so that the product of two such primes has twice the bits.
+// The prime search is incremental from a random starting point.  Mostly
+// copied from crypto/rand.Prime() in Go 1.19, see separate LICENCE.
+func derivePrime(rand io.Reader, bits int) (*big.Int, error) {
+	if bits < 2 {
+		return nil, fmt.Errorf("prime size must be at least 2-bit")
+	}
+	b := uint(bits % 8)
+	if b == 0 {
+		b = 8
+	}
+	bytes := make([]byte, (bits+7)/8)
+	p := new(big.Int)
+	base := new(big.Int)
+	for {
+		if _, err := io.ReadFull(rand, bytes); err != nil {
+			return nil, err
+		}
+
+		// Clear bits in the first byte to make sure the candidate has a
+		// size <= bits, and set the top two bits
+		bytes[0] &= uint8(int(1<<b) - 1)
+		if b >= 2 {
+			bytes[0] |= 3 << (b - 2)
+		} else {
+			bytes[0] |= 1
+			if len(bytes) > 1 {
+				bytes[1] |= 0x80
+			}
+		}
+		// Make the value odd since an even number this large is not prime
+		bytes[len(bytes)-1] |= 1
+
+		base.SetBytes(bytes)
+		mod := new(big.Int).Mod(base, smallPrimesProduct).Uint64()
+
+	NextDelta:
+		for delta := uint64(0); delta < maxPrimeDelta; delta += 2 {
+			m := mod + delta
+			for _, prime := range smallPrimes {
+				if m%uint64(prime) == 0 && (bits > 6 || m != uint64(prime)) {
+					continue NextDelta
+				}
+			}
+			p.SetUint64(delta)
+			p.Add(p, base)
+			if p.BitLen() != bits {
+				break // start over with a new random starting point
+			}
+			if p.ProbablyPrime(20) {
+				return p, nil
+			}
+		}
+	}
+}
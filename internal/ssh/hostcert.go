@@ -0,0 +1,112 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HostCA signs SSH host certificates
+type HostCA struct {
+	Signer   ssh.Signer
+	Validity time.Duration // how long a certificate is valid after signing
+}
+
+// ReadHostCA reads an unencrypted CA private key in any format that
+// ssh.ParsePrivateKey supports, e.g., as output by ssh-keygen
+func ReadHostCA(filename string, validity time.Duration) (*HostCA, error) {
+	if validity <= 0 {
+		return nil, fmt.Errorf("validity must be positive")
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+	return &HostCA{Signer: signer, Validity: validity}, nil
+}
+
+// Sign signs a host certificate for a public key in authorized_keys format.
+// The certificate is valid from one minute before now, to allow for some
+// clock skew, and is output in authorized_keys format without trailing newline.
+func (ca *HostCA) Sign(authorizedKey string, principals []string, now time.Time) (string, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return "", fmt.Errorf("parse public key: %w", err)
+	}
+	if len(principals) == 0 {
+		return "", fmt.Errorf("no principals")
+	}
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return "", fmt.Errorf("read random: %w", err)
+	}
+
+	cert := &ssh.Certificate{
+		Key:             pub,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.HostCert,
+		KeyId:           principals[0],
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(ca.Validity).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca.Signer); err != nil {
+		return "", fmt.Errorf("sign: %w", err)
+	}
+	return strings.TrimRight(string(ssh.MarshalAuthorizedKey(cert)), "\n"), nil
+}
+
+// CheckHostCert checks that a certificate in authorized_keys format is a host
+// certificate for the host key's public key, and that it is signed by the CA
+// key that it carries.  Whether the CA is trusted is not checked.  Neither is
+// the validity period, since the platform's clock may not be set yet.
+func (hk *HostKey) CheckHostCert(authorizedCert string) error {
+	cert, err := ParseHostCert(authorizedCert)
+	if err != nil {
+		return err
+	}
+	pub, err := hk.publicKey()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(cert.Key.Marshal(), pub.Marshal()) {
+		return fmt.Errorf("certificate is for a different key")
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return fmt.Errorf("certificate without principals")
+	}
+
+	checker := ssh.CertChecker{
+		Clock: func() time.Time { return time.Unix(int64(cert.ValidAfter), 0) },
+	}
+	if err := checker.CheckCert(cert.ValidPrincipals[0], cert); err != nil {
+		return fmt.Errorf("check certificate: %w", err)
+	}
+	return nil
+}
+
+// ParseHostCert parses a host certificate in authorized_keys format
+func ParseHostCert(authorizedCert string) (*ssh.Certificate, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedCert))
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate: %w", err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("not a certificate")
+	}
+	if cert.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("not a host certificate")
+	}
+	return cert, nil
+}
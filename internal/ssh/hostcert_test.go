@@ -0,0 +1,73 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHostCert(t *testing.T) {
+	_, caPriv, err := ed25519.GenerateKey(bytes.NewReader(bytes.Repeat([]byte{9}, 64)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := HostCA{Signer: signer, Validity: 24 * time.Hour}
+
+	hk, err := NewHostKey(bytes.NewReader(bytes.Repeat([]byte{1}, 64)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := hk.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewHostKey(bytes.NewReader(bytes.Repeat([]byte{2}, 64)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	principals := []string{"st.example.org", "10.0.2.10"}
+	str, err := ca.Sign(pub, principals, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(str))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := key.(*ssh.Certificate)
+	if got, want := cert.CertType, uint32(ssh.HostCert); got != want {
+		t.Errorf("got cert type %d, want %d", got, want)
+	}
+	if got, want := cert.ValidPrincipals, principals; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got principals %v, want %v", got, want)
+	}
+	if got, want := cert.ValidBefore, uint64(now.Add(24*time.Hour).Unix()); got != want {
+		t.Errorf("got valid before %d, want %d", got, want)
+	}
+	if !bytes.Equal(cert.SignatureKey.Marshal(), signer.PublicKey().Marshal()) {
+		t.Errorf("certificate is not signed by the CA")
+	}
+
+	if err := hk.CheckHostCert(str); err != nil {
+		t.Errorf("check host cert: %v", err)
+	}
+	if err := other.CheckHostCert(str); err == nil {
+		t.Errorf("check host cert of other key: expected error")
+	}
+	if err := hk.CheckHostCert(pub); err == nil {
+		t.Errorf("check plain public key: expected error")
+	}
+	cert.Signature.Blob[0] ^= 1
+	if err := hk.CheckHostCert(string(ssh.MarshalAuthorizedKey(cert))); err == nil {
+		t.Errorf("check host cert with bad signature: expected error")
+	}
+}
@@ -0,0 +1,173 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// hashMagic prefixes hashed host names, see HashKnownHosts in ssh_config(5)
+const hashMagic = "|1|"
+
+// AddKnownHost adds a known_hosts line for a public key to the content of a
+// known_hosts file.  The line lists each address (a host name or IP address,
+// optionally with port), which are hashed if hash is set.  Existing lines for
+// the same addresses and key type are removed, and addresses are removed from
+// existing lines of the same key type that also list other addresses.  Lines
+// with other key types are left as is, since OpenSSH permits one key per type.
+// So are lines with markers such as @cert-authority.  It is an error if an
+// address is already pinned to a different key of the same type, unless
+// replace is set.
+func AddKnownHost(content []byte, addresses []string, authorizedKey string, hash, replace bool) ([]byte, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return nil, fmt.Errorf("parse public key: %w", err)
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no addresses")
+	}
+	var normalized []string
+	for _, addr := range addresses {
+		normalized = append(normalized, knownhosts.Normalize(addr))
+	}
+
+	var buf bytes.Buffer
+	lines := strings.SplitAfter(string(content), "\n")
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		newLine, err := removeHosts(line, normalized, pub, replace)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		buf.WriteString(newLine)
+	}
+	if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteString("\n")
+	}
+
+	hosts := normalized
+	if hash {
+		hosts = nil
+		for _, addr := range normalized {
+			hosts = append(hosts, knownhosts.HashHostname(addr))
+		}
+	}
+	fmt.Fprintf(&buf, "%s %s\n", strings.Join(hosts, ","), strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))))
+	return buf.Bytes(), nil
+}
+
+// WriteKnownHost is like AddKnownHost, but reads and writes a known_hosts file
+// that is created if it does not exist.  The file is replaced atomically.
+func WriteKnownHost(filename string, addresses []string, authorizedKey string, hash, replace bool) error {
+	content, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	b, err := AddKnownHost(content, addresses, authorizedKey, hash, replace)
+	if err != nil {
+		return err
+	}
+
+	fp, err := os.CreateTemp(filepath.Dir(filename), ".known_hosts-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	if _, err := fp.Write(b); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Chmod(0o644); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fp.Name(), filename)
+}
+
+// removeHosts removes addresses from a single known_hosts line
+func removeHosts(line string, addresses []string, pub ssh.PublicKey, replace bool) (string, error) {
+	marker, hosts, key, _, _, err := ssh.ParseKnownHosts([]byte(line))
+	if err != nil || marker != "" {
+		return line, nil // comments, empty lines, markers, and lines we cannot parse are kept
+	}
+	if key.Type() != pub.Type() {
+		return line, nil
+	}
+
+	var keep []string
+	for _, host := range hosts {
+		if !matchesAny(host, addresses) {
+			keep = append(keep, host)
+			continue
+		}
+		if !bytes.Equal(key.Marshal(), pub.Marshal()) && !replace {
+			return "", fmt.Errorf("%s is already pinned to a different %s key (%s)",
+				hostForError(host, addresses), key.Type(), ssh.FingerprintSHA256(key))
+		}
+	}
+	if len(keep) == len(hosts) {
+		return line, nil
+	}
+	if len(keep) == 0 {
+		return "", nil
+	}
+
+	// Only the host field is rewritten, the key and comment are kept as is
+	trimmed := strings.TrimLeft(line, " \t")
+	rest := strings.TrimLeft(trimmed[strings.IndexAny(trimmed, " \t"):], " \t")
+	return strings.Join(keep, ",") + " " + rest, nil
+}
+
+// matchesAny checks if a plain or hashed host name equals any address
+func matchesAny(host string, addresses []string) bool {
+	for _, addr := range addresses {
+		if strings.HasPrefix(host, hashMagic) {
+			if matchHashed(host, addr) {
+				return true
+			}
+		} else if knownhosts.Normalize(host) == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHashed(host, addr string) bool {
+	parts := strings.Split(strings.TrimPrefix(host, hashMagic), "|")
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(addr))
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+func hostForError(host string, addresses []string) string {
+	for _, addr := range addresses {
+		if matchesAny(host, []string{addr}) {
+			return addr
+		}
+	}
+	return host
+}
@@ -0,0 +1,161 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func testAuthorizedKey(t *testing.T, seed byte) string {
+	t.Helper()
+	hk, err := NewHostKey(bytes.NewReader(bytes.Repeat([]byte{seed}, 64)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := hk.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func TestAddKnownHost(t *testing.T) {
+	key := testAuthorizedKey(t, 1)
+	other := testAuthorizedKey(t, 2)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPub, err := ssh.NewPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherType := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ecPub)))
+	addrs := []string{"st.example.org", "10.0.2.10"}
+	for _, table := range []struct {
+		desc    string
+		content string
+		replace bool
+		wantErr bool
+		want    string
+	}{
+		{
+			desc: "empty file",
+			want: "st.example.org,10.0.2.10 " + key + "\n",
+		},
+		{
+			desc:    "keep unrelated lines",
+			content: "# comment\nother.example.org " + other + "\n@cert-authority st.example.org " + other,
+			want:    "# comment\nother.example.org " + other + "\n@cert-authority st.example.org " + other + "\nst.example.org,10.0.2.10 " + key + "\n",
+		},
+		{
+			desc:    "replace same key",
+			content: "10.0.2.10 " + key + "\nst.example.org " + key + " comment\n",
+			want:    "st.example.org,10.0.2.10 " + key + "\n",
+		},
+		{
+			desc:    "remove host from shared line",
+			content: "other.example.org,st.example.org " + key + " comment\n",
+			want:    "other.example.org " + key + " comment\nst.example.org,10.0.2.10 " + key + "\n",
+		},
+		{
+			desc:    "remove host from tab-separated line",
+			content: "other.example.org,st.example.org\t" + key + " comment\n",
+			want:    "other.example.org " + key + " comment\nst.example.org,10.0.2.10 " + key + "\n",
+		},
+		{
+			desc:    "refuse different key",
+			content: "10.0.2.10 " + other + "\n",
+			wantErr: true,
+		},
+		{
+			desc:    "replace different key",
+			content: "10.0.2.10 " + other + "\n",
+			replace: true,
+			want:    "st.example.org,10.0.2.10 " + key + "\n",
+		},
+		{
+			desc:    "keep key of other type",
+			content: "st.example.org,10.0.2.10 " + otherType + "\n",
+			want:    "st.example.org,10.0.2.10 " + otherType + "\nst.example.org,10.0.2.10 " + key + "\n",
+		},
+		{
+			desc:    "other port is a different host",
+			content: "[10.0.2.10]:2222 " + other + "\n",
+			want:    "[10.0.2.10]:2222 " + other + "\nst.example.org,10.0.2.10 " + key + "\n",
+		},
+	} {
+		b, err := AddKnownHost([]byte(table.content), addrs, key, false, table.replace)
+		if got, want := err != nil, table.wantErr; got != want {
+			t.Errorf("%s: got error %v but wanted %v: %v", table.desc, got, want, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got, want := string(b), table.want; got != want {
+			t.Errorf("%s: got\n%s\nbut wanted\n%s", table.desc, got, want)
+		}
+	}
+}
+
+func TestAddKnownHostHashed(t *testing.T) {
+	key := testAuthorizedKey(t, 1)
+	other := testAuthorizedKey(t, 2)
+	addrs := []string{"st.example.org", "10.0.2.10"}
+
+	b, err := AddKnownHost(nil, addrs, key, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, hosts, pub, _, _, err := ssh.ParseKnownHosts(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(hosts), len(addrs); got != want {
+		t.Fatalf("got %d hosts, want %d", got, want)
+	}
+	for i, host := range hosts {
+		if !strings.HasPrefix(host, hashMagic) || !matchHashed(host, addrs[i]) {
+			t.Errorf("host %d: %q is not a hash of %q", i, host, addrs[i])
+		}
+	}
+	if got, want := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))), key; got != want {
+		t.Errorf("got key %q, want %q", got, want)
+	}
+
+	if _, err := AddKnownHost(b, addrs[1:], other, false, false); err == nil {
+		t.Errorf("hashed host with different key: expected error")
+	}
+	b, err = AddKnownHost(b, addrs[1:], other, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Count(string(b), "\n"), 2; got != want {
+		t.Errorf("got %d lines, want %d:\n%s", got, want, b)
+	}
+}
+
+func TestWriteKnownHost(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "known_hosts")
+	key := testAuthorizedKey(t, 1)
+	for i := 0; i < 2; i++ {
+		if err := WriteKnownHost(filename, []string{"10.0.2.10"}, key, false, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "10.0.2.10 "+key+"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
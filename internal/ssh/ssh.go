@@ -1,38 +1,81 @@
-// package ssh provides utilities to manage SSH host keys in Ed25519 format.
+// package ssh provides utilities to manage SSH host keys in Ed25519, ECDSA
+// P-256, and RSA-3072 format.
 // Some code is copied with minor edits from golang.org/x/crypto/ssh, see
 // separate LICENCE which applies from the write() method and forward.
 package ssh
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/binary"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"strings"
 
 	"github.com/google/uuid"
-	"github.com/u-root/u-root/pkg/efivarfs"
 	"golang.org/x/crypto/ssh"
+
+	"system-transparency.org/stprov/internal/store"
 )
 
 const (
 	PEMTypePrivateKey = "OPENSSH PRIVATE KEY"
+
+	// Host key types, see NewHostKeyOfType()
+	KeyTypeEd25519   = "ed25519"
+	KeyTypeECDSAP256 = "ecdsa-p256"
+	KeyTypeRSA3072   = "rsa-3072"
+	DefaultKeyType   = KeyTypeEd25519
+
+	curveNameP256 = "nistp256" // OpenSSH's name of P-256
 )
 
-// HostKey represents the private output of the following command:
+// KeyTypes lists the supported host key types
+var KeyTypes = []string{KeyTypeEd25519, KeyTypeECDSAP256, KeyTypeRSA3072}
+
+// ErrEncrypted is returned when reading an encrypted host key without passphrase
+var ErrEncrypted = errors.New("ssh: host key is encrypted")
+
+// HostKey represents the private output of one of the following commands:
 //
 //	ssh-keygen -t ed25519 -c "some comment"
+//	ssh-keygen -t ecdsa -b 256 -c "some comment"
+//	ssh-keygen -t rsa -b 3072 -c "some comment"
 type HostKey struct {
-	Private ed25519.PrivateKey
+	Private crypto.Signer // ed25519.PrivateKey, *ecdsa.PrivateKey, or *rsa.PrivateKey
 	Check   uint32
 	Comment string
 }
 
 // NewHostKey generates a new host key in Ed25519 format
 func NewHostKey(rand io.Reader, comment string) (*HostKey, error) {
-	_, priv, err := ed25519.GenerateKey(rand)
+	return NewHostKeyOfType(rand, KeyTypeEd25519, comment)
+}
+
+// NewHostKeyOfType generates a new host key of a given type, see KeyTypes.
+// The host key is a deterministic function of what is read from rand, which
+// makes it possible to derive a host key from a secret.
+func NewHostKeyOfType(rand io.Reader, keyType, comment string) (*HostKey, error) {
+	var priv crypto.Signer
+	var err error
+	switch keyType {
+	case KeyTypeEd25519:
+		_, priv, err = ed25519.GenerateKey(rand)
+	case KeyTypeECDSAP256:
+		priv, err = deriveECDSA(rand, elliptic.P256())
+	case KeyTypeRSA3072:
+		priv, err = deriveRSA(rand, 3072)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q, must be one of %s", keyType, strings.Join(KeyTypes, ", "))
+	}
 	if err != nil {
 		return nil, fmt.Errorf("generate key: %w", err)
 	}
@@ -66,70 +109,164 @@ func (hk *HostKey) PublicKey() (string, error) {
 	return strings.TrimRight(string(authKeyBytes), "\n"), nil
 }
 
+// Type outputs a host key's type, see KeyTypes
+func (hk *HostKey) Type() string {
+	switch priv := hk.Private.(type) {
+	case ed25519.PrivateKey:
+		return KeyTypeEd25519
+	case *ecdsa.PrivateKey:
+		if priv.Curve == elliptic.P256() {
+			return KeyTypeECDSAP256
+		}
+	case *rsa.PrivateKey:
+		if priv.N.BitLen() == 3072 {
+			return KeyTypeRSA3072
+		}
+	}
+	return ""
+}
+
 func (hk *HostKey) publicKey() (ssh.PublicKey, error) {
-	pub, err := ssh.NewPublicKey(hk.Private.Public().(ed25519.PublicKey))
+	pub, err := ssh.NewPublicKey(hk.Private.Public())
 	if err != nil {
 		return nil, fmt.Errorf("derive public key: %w", err)
 	}
 	return pub, nil
 }
 
-// WriteEFI writes a host key to EFI-NVRAM in PEM format
-func (hk *HostKey) WriteEFI(varUUID *uuid.UUID, name string) error {
+// WriteEFI writes a host key to an EFI variable store in PEM format
+func (hk *HostKey) WriteEFI(s store.Store, varUUID *uuid.UUID, name string) error {
+	return hk.WriteEFIWithPassphrase(s, varUUID, name, nil)
+}
+
+// WriteEFIWithPassphrase is like WriteEFI, but the host key is encrypted with
+// a passphrase unless it is nil.  The encryption is aes256-ctr with a key from
+// the bcrypt KDF, same as "ssh-keygen -N PASSPHRASE".
+func (hk *HostKey) WriteEFIWithPassphrase(s store.Store, varUUID *uuid.UUID, name string, passphrase []byte) error {
 	buf := bytes.NewBuffer(nil)
-	if err := hk.writePEM(buf); err != nil {
-		return fmt.Errorf("marshal: %w", err)
-	}
-	desc := efivarfs.VariableDescriptor{Name: name, GUID: *varUUID}
-	attrs := efivarfs.AttributeBootserviceAccess
-	attrs |= efivarfs.AttributeRuntimeAccess
-	attrs |= efivarfs.AttributeNonVolatile
-	e, err := efivarfs.New()
-	if err != nil {
+	if err := hk.writePEMWithPassphrase(buf, passphrase); err != nil {
 		return fmt.Errorf("marshal: %w", err)
 	}
-	if err := efivarfs.WriteVariable(e, desc, attrs, buf.Bytes()); err != nil {
+	if err := store.Write(s, name, varUUID, buf.Bytes()); err != nil {
 		return fmt.Errorf("write: %w", err)
 	}
 	return nil
 }
 
-// write writes an Ed25519 host key
-func (hk *HostKey) write(w io.Writer) error {
-	key := ed25519KeyBody{
-		Pub:     make([]byte, ed25519.PublicKeySize),
-		Priv:    make([]byte, ed25519.PrivateKeySize),
-		Comment: hk.Comment,
+// MarshalPEM outputs a host key in PEM format, i.e., as an OpenSSH private key
+func (hk *HostKey) MarshalPEM() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := hk.writePEM(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadEFI reads a host key in PEM format from an EFI variable store.
+// ErrEncrypted is returned if the host key is encrypted.
+func (hk *HostKey) ReadEFI(s store.Store, varUUID *uuid.UUID, name string) error {
+	return hk.ReadEFIWithPassphrase(s, varUUID, name, nil)
+}
+
+// ReadEFIWithPassphrase is like ReadEFI, but decrypts the host key with a
+// passphrase unless it is nil.  The comment of a decrypted host key is lost.
+func (hk *HostKey) ReadEFIWithPassphrase(s store.Store, varUUID *uuid.UUID, name string, passphrase []byte) error {
+	b, err := store.Read(s, name, varUUID)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return fmt.Errorf("ssh: no pem block")
 	}
-	copy(key.Pub, (hk.Private.Public().(ed25519.PublicKey))[:])
-	copy(key.Priv, hk.Private[:])
-	key.addPad()
+	if block.Type != PEMTypePrivateKey {
+		return fmt.Errorf("ssh: unexpected pem type %s", block.Type)
+	}
+	return hk.readWithPassphrase(bytes.NewReader(block.Bytes), passphrase)
+}
 
+// ReadPublicKeyEFI reads the public key and SHA256 fingerprint of a host key in
+// PEM format from an EFI variable store.  Unlike ReadEFI, this works without
+// passphrase if the host key is encrypted.
+func ReadPublicKeyEFI(s store.Store, varUUID *uuid.UUID, name string) (publicKey, fingerprint string, err error) {
+	b, err := store.Read(s, name, varUUID)
+	if err != nil {
+		return "", "", fmt.Errorf("read: %w", err)
+	}
+	var pub ssh.PublicKey
+	signer, err := ssh.ParsePrivateKey(b)
+	var missing *ssh.PassphraseMissingError
+	switch {
+	case err == nil:
+		pub = signer.PublicKey()
+	case errors.As(err, &missing):
+		pub = missing.PublicKey
+	default:
+		return "", "", fmt.Errorf("ssh: %w", err)
+	}
+	return strings.TrimRight(string(ssh.MarshalAuthorizedKey(pub)), "\n"), ssh.FingerprintSHA256(pub), nil
+}
+
+// write writes an unencrypted host key
+func (hk *HostKey) write(w io.Writer) error {
+	pub, err := hk.publicKey()
+	if err != nil {
+		return err
+	}
 	pk1 := keyBody{
 		Check1:  hk.Check,
 		Check2:  hk.Check,
-		Keytype: ssh.KeyAlgoED25519,
-		Rest:    ssh.Marshal(&key),
-	}
-
-	// Where is this format defined in the specs?  Had to look at the output of
-	//
-	//   ssh-keygen -t ed25519
-	//
-	// to figure out the appropriate bytes.
-	pub := struct {
-		Name  string
-		Bytes []byte
-	}{
-		Name:  ssh.KeyAlgoED25519,
-		Bytes: key.Pub,
+		Keytype: pub.Type(),
 	}
+	switch priv := hk.Private.(type) {
+	case ed25519.PrivateKey:
+		key := ed25519KeyBody{
+			Pub:     make([]byte, ed25519.PublicKeySize),
+			Priv:    make([]byte, ed25519.PrivateKeySize),
+			Comment: hk.Comment,
+		}
+		copy(key.Pub, (priv.Public().(ed25519.PublicKey))[:])
+		copy(key.Priv, priv[:])
+		key.Pad = pad(&pk1, ssh.Marshal(&key))
+		pk1.Rest = ssh.Marshal(&key)
+	case *ecdsa.PrivateKey:
+		q, err := priv.PublicKey.Bytes()
+		if err != nil {
+			return fmt.Errorf("marshal public key: %w", err)
+		}
+		key := ecdsaKeyBody{
+			Curve:   curveNameP256,
+			Pub:     q,
+			D:       priv.D,
+			Comment: hk.Comment,
+		}
+		key.Pad = pad(&pk1, ssh.Marshal(&key))
+		pk1.Rest = ssh.Marshal(&key)
+	case *rsa.PrivateKey:
+		if len(priv.Primes) != 2 {
+			return fmt.Errorf("ssh: rsa keys must have two primes")
+		}
+		key := rsaKeyBody{
+			N:       priv.N,
+			E:       big.NewInt(int64(priv.E)),
+			D:       priv.D,
+			Iqmp:    new(big.Int).ModInverse(priv.Primes[1], priv.Primes[0]),
+			P:       priv.Primes[0],
+			Q:       priv.Primes[1],
+			Comment: hk.Comment,
+		}
+		key.Pad = pad(&pk1, ssh.Marshal(&key))
+		pk1.Rest = ssh.Marshal(&key)
+	default:
+		return fmt.Errorf("ssh: unhandled key type %T", hk.Private)
+	}
+
 	l := authBody{
 		CipherName:   "none",
 		KdfName:      "none",
 		KdfOpts:      "",
 		NumKeys:      1,
-		PubKey:       ssh.Marshal(pub),
+		PubKey:       pub.Marshal(),
 		PrivKeyBlock: ssh.Marshal(&pk1),
 	}
 
@@ -147,15 +284,30 @@ func (hk *HostKey) write(w io.Writer) error {
 	return nil
 }
 
-// writePem writes and Ed25519 host key in PEM format
+// writePem writes a host key in PEM format
 func (hk *HostKey) writePEM(w io.Writer) error {
-	buf := bytes.NewBuffer(nil)
-	if err := hk.write(buf); err != nil {
-		return err
-	}
-	block := &pem.Block{
-		Type:  PEMTypePrivateKey,
-		Bytes: buf.Bytes(),
+	return hk.writePEMWithPassphrase(w, nil)
+}
+
+// writePEMWithPassphrase writes a host key in PEM format, encrypted with a
+// passphrase unless it is nil.  Encryption is left to golang.org/x/crypto/ssh,
+// which picks its own check integers and ignores hk.Check.
+func (hk *HostKey) writePEMWithPassphrase(w io.Writer, passphrase []byte) error {
+	var block *pem.Block
+	if passphrase != nil {
+		var err error
+		if block, err = ssh.MarshalPrivateKeyWithPassphrase(hk.Private, hk.Comment, passphrase); err != nil {
+			return fmt.Errorf("encrypt: %w", err)
+		}
+	} else {
+		buf := bytes.NewBuffer(nil)
+		if err := hk.write(buf); err != nil {
+			return err
+		}
+		block = &pem.Block{
+			Type:  PEMTypePrivateKey,
+			Bytes: buf.Bytes(),
+		}
 	}
 	b := pem.EncodeToMemory(block)
 	if b == nil {
@@ -167,10 +319,16 @@ func (hk *HostKey) writePEM(w io.Writer) error {
 	return nil
 }
 
-// Read reads an Ed25519 SSH host key after PEM decoding.  Mostly copied from:
+// Read reads an SSH host key after PEM decoding.  Mostly copied from:
 //
 //   - https://cs.opensource.google/go/x/crypto/+/master:ssh/keys.go;l=1434-1565;drc=42c83fffffc70640068263e765db9c9b09cd2ba2
 func (hk *HostKey) read(r io.Reader) error {
+	return hk.readWithPassphrase(r, nil)
+}
+
+// readWithPassphrase reads an SSH host key, decrypting it with a passphrase
+// unless it is nil
+func (hk *HostKey) readWithPassphrase(r io.Reader, passphrase []byte) error {
 	key, err := io.ReadAll(r)
 	if err != nil {
 		return fmt.Errorf("ssh: %w", err)
@@ -185,8 +343,15 @@ func (hk *HostKey) read(r io.Reader) error {
 	if err := ssh.Unmarshal(remaining, &w); err != nil {
 		return err
 	}
-	if w.KdfName != "none" || w.CipherName != "none" {
-		return fmt.Errorf("ssh: cannot decode encrypted private keys")
+	switch {
+	case w.KdfName == "none" && w.CipherName == "none":
+		if passphrase != nil {
+			return fmt.Errorf("ssh: host key is not encrypted")
+		}
+	case passphrase == nil:
+		return ErrEncrypted
+	default:
+		return hk.decrypt(key, passphrase)
 	}
 
 	var pk1 keyBody
@@ -197,7 +362,10 @@ func (hk *HostKey) read(r io.Reader) error {
 		return fmt.Errorf("ssh: checkint mismatch")
 	}
 
-	// we only handle ed25519
+	// we only handle ed25519, ecdsa p-256, and rsa
+	var priv crypto.Signer
+	var comment string
+	var keyPad []byte
 	switch pk1.Keytype {
 	case ssh.KeyAlgoED25519:
 		var key ed25519KeyBody
@@ -207,19 +375,58 @@ func (hk *HostKey) read(r io.Reader) error {
 		if len(key.Priv) != ed25519.PrivateKeySize {
 			return fmt.Errorf("ssh: private key unexpected length")
 		}
-		for i, b := range key.Pad {
-			if int(b) != i+1 {
-				return fmt.Errorf("ssh: padding not as expected")
-			}
+		priv, comment, keyPad = ed25519.PrivateKey(key.Priv), key.Comment, key.Pad
+	case ssh.KeyAlgoECDSA256:
+		var key ecdsaKeyBody
+		if err := ssh.Unmarshal(pk1.Rest, &key); err != nil {
+			return err
+		}
+		if key.Curve != curveNameP256 {
+			return fmt.Errorf("ssh: unexpected curve %q", key.Curve)
+		}
+		d := make([]byte, 32)
+		if key.D.Sign() <= 0 || key.D.BitLen() > 8*len(d) {
+			return fmt.Errorf("ssh: private key unexpected length")
+		}
+		ecdsaPriv, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), key.D.FillBytes(d))
+		if err != nil {
+			return fmt.Errorf("ssh: %w", err)
 		}
-
-		hk.Private = ed25519.PrivateKey(key.Priv)
-		hk.Check = pk1.Check1
-		hk.Comment = key.Comment
-		return nil
+		if q, err := ecdsaPriv.PublicKey.Bytes(); err != nil || !bytes.Equal(q, key.Pub) {
+			return fmt.Errorf("ssh: public key does not match private key")
+		}
+		priv, comment, keyPad = ecdsaPriv, key.Comment, key.Pad
+	case ssh.KeyAlgoRSA:
+		var key rsaKeyBody
+		if err := ssh.Unmarshal(pk1.Rest, &key); err != nil {
+			return err
+		}
+		if !key.E.IsInt64() || key.E.Int64() > 1<<31-1 {
+			return fmt.Errorf("ssh: rsa public exponent too large")
+		}
+		rsaPriv := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: key.N, E: int(key.E.Int64())},
+			D:         key.D,
+			Primes:    []*big.Int{key.P, key.Q},
+		}
+		if err := rsaPriv.Validate(); err != nil {
+			return fmt.Errorf("ssh: %w", err)
+		}
+		rsaPriv.Precompute()
+		priv, comment, keyPad = rsaPriv, key.Comment, key.Pad
 	default:
-		return fmt.Errorf("ssh: unhandled key type")
+		return fmt.Errorf("ssh: unhandled key type %q", pk1.Keytype)
 	}
+	for i, b := range keyPad {
+		if int(b) != i+1 {
+			return fmt.Errorf("ssh: padding not as expected")
+		}
+	}
+
+	hk.Private = priv
+	hk.Check = pk1.Check1
+	hk.Comment = comment
+	return nil
 }
 
 // authMagic is defined here:
@@ -263,8 +470,67 @@ type ed25519KeyBody struct {
 	Pad     []byte `ssh:"rest"`
 }
 
-// addPad computes the padding for a single Ed25519 key manually.  The blob to
-// compute the padding for is defined and implemented by OpenSSH here:
+// ecdsaKeyBody is encoded using the same rules as SSH agent:
+//
+//   - https://cs.opensource.google/go/x/crypto/+/refs/tags/v0.53.0:ssh/keys.go;l=1595-1601
+type ecdsaKeyBody struct {
+	Curve   string
+	Pub     []byte // uncompressed point
+	D       *big.Int
+	Comment string
+	Pad     []byte `ssh:"rest"`
+}
+
+// rsaKeyBody is encoded using the same rules as SSH agent:
+//
+//   - https://cs.opensource.google/go/x/crypto/+/refs/tags/v0.53.0:ssh/keys.go;l=1577-1586
+type rsaKeyBody struct {
+	N       *big.Int
+	E       *big.Int
+	D       *big.Int
+	Iqmp    *big.Int // q^-1 mod p
+	P       *big.Int
+	Q       *big.Int
+	Comment string
+	Pad     []byte `ssh:"rest"`
+}
+
+// decrypt reads an encrypted SSH host key after PEM decoding, leaving the
+// decryption to golang.org/x/crypto/ssh.  The comment and check integers are
+// not output by golang.org/x/crypto/ssh, so hk.Comment and hk.Check are reset.
+func (hk *HostKey) decrypt(key, passphrase []byte) error {
+	b := pem.EncodeToMemory(&pem.Block{Type: PEMTypePrivateKey, Bytes: key})
+	raw, err := ssh.ParseRawPrivateKeyWithPassphrase(b, passphrase)
+	if errors.Is(err, x509.IncorrectPasswordError) {
+		return fmt.Errorf("ssh: decryption failed, wrong passphrase?")
+	}
+	if err != nil {
+		return fmt.Errorf("ssh: %w", err)
+	}
+
+	var priv crypto.Signer
+	switch k := raw.(type) {
+	case *ed25519.PrivateKey:
+		priv = *k
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return fmt.Errorf("ssh: unexpected curve %q", k.Curve.Params().Name)
+		}
+		priv = k
+	case *rsa.PrivateKey:
+		priv = k
+	default:
+		return fmt.Errorf("ssh: unhandled key type %T", raw)
+	}
+
+	hk.Private = priv
+	hk.Check = 0
+	hk.Comment = ""
+	return nil
+}
+
+// pad computes the padding of a single key.  The blob to compute the padding
+// for is defined and implemented by OpenSSH here:
 //
 //   - https://github.com/openssh/openssh-portable/blob/8241b9c0529228b4b86d88b1a6076fb9f97e4a99/PROTOCOL.key#L36-L49
 //   - https://github.com/openssh/openssh-portable/blob/8241b9c0529228b4b86d88b1a6076fb9f97e4a99/sshkey.c#L2812-L2831
@@ -273,21 +539,29 @@ type ed25519KeyBody struct {
 //
 //   - https://github.com/openssh/openssh-portable/blob/0d96b1506b2f4757fefa5d1f884d49e96a6fd4c3/cipher.c#L108
 //
-// Which means that the only things that end up counting towards padding are:
+// Which means that the things that end up counting towards padding are:
 //
+//	uint32 checkint1
+//	uint32 checkint2
 //	byte[] privatekey1
 //	string comment1
 //
-// Note that what the spec refers to here as privatekey1 is not the raw Ed25519
-// private key.  It is the serialization of "ssh-ed25519", pubkey (32 bytes),
-// and private key (64 bytes).  As all these types are serialized as strings and
-// then contactenated with each other, that sums up to 119 bytes in total.  The
-// comment is also a string, and thus its size will be 4 + the comment length.
+// Note that what the spec refers to here as privatekey1 is not the raw private
+// key.  It is the serialization of the key type as a string, followed by the
+// key-type specific fields.  For example, an Ed25519 key is "ssh-ed25519",
+// pubkey (32 bytes), and private key (64 bytes).  As all these types are
+// serialized as strings and then contactenated with each other, that sums up
+// to 119 bytes in total.  The comment is also a string, and thus its size will
+// be 4 + the comment length.
 //
-// So, what we need to pad is 119 + 4+len(comment) so that we get zero mod 8.
-// If padding is required, it is the pad bytes 1, 2, ..., k that are added.
-func (b *ed25519KeyBody) addPad() {
-	for i := 0; (119+4+len(b.Comment)+i)%8 != 0; i++ {
-		b.Pad = append(b.Pad, byte(i+1))
+// So, what we need to pad is 8 + 4+len(keytype) + len(rest) so that we get
+// zero mod 8, where rest is the marshalled key body with comment
+// but without padding.  If padding is required, it is the pad bytes 1, 2, ...,
+// k that are added.
+func pad(pk1 *keyBody, rest []byte) []byte {
+	var p []byte
+	for i := 0; (8+4+len(pk1.Keytype)+len(rest)+i)%8 != 0; i++ {
+		p = append(p, byte(i+1))
 	}
+	return p
 }
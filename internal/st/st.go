@@ -7,11 +7,11 @@ import (
 	"strings"
 
 	"github.com/google/uuid"
-	"github.com/u-root/u-root/pkg/efivarfs"
 	"system-transparency.org/stboot/host"
+	"system-transparency.org/stprov/internal/store"
 )
 
-func WriteHostConfigEFI(cfg *host.Config) error {
+func WriteHostConfigEFI(s store.Store, cfg *host.Config) error {
 	b, err := json.Marshal(cfg)
 	if err != nil {
 		return fmt.Errorf("marshal: %w", err)
@@ -22,16 +22,16 @@ func WriteHostConfigEFI(cfg *host.Config) error {
 		return fmt.Errorf("invalid host config EFI var name: %s", host.HostConfigEFIVarName)
 	}
 
-	return writeEFI(b, efiGuid, efiName)
+	return store.Write(s, efiName, efiGuid, b)
 }
 
-func HostConfigEFI() (*host.Config, error) {
+func HostConfigEFI(s store.Store) (*host.Config, error) {
 	efiName, efiGuid, err := HostConfigEFIVariableName()
 	if err != nil {
 		return nil, fmt.Errorf("invalid host config EFI var name: %s", host.HostConfigEFIVarName)
 	}
 
-	b, err := readEFI(efiGuid, efiName)
+	b, err := store.Read(s, efiName, efiGuid)
 	if err != nil {
 		return nil, fmt.Errorf("read: %w", err)
 	}
@@ -58,13 +58,13 @@ func HostConfigEFIVariableName() (string, *uuid.UUID, error) {
 // HostName is a host name
 type HostName string
 
-// WriteEFI writes a host name to EFI-NVRAM
-func (hn *HostName) WriteEFI(varUUID *uuid.UUID, efiName string) error {
-	return writeEFI([]byte(*hn), varUUID, efiName)
+// WriteEFI writes a host name to an EFI variable store
+func (hn *HostName) WriteEFI(s store.Store, varUUID *uuid.UUID, efiName string) error {
+	return store.Write(s, efiName, varUUID, []byte(*hn))
 }
 
-func (hn *HostName) ReadEFI(varUUID *uuid.UUID, efiName string) error {
-	b, err := readEFI(varUUID, efiName)
+func (hn *HostName) ReadEFI(s store.Store, varUUID *uuid.UUID, efiName string) error {
+	b, err := store.Read(s, efiName, varUUID)
 	if err != nil {
 		return fmt.Errorf("read: %w", err)
 	}
@@ -72,24 +72,22 @@ func (hn *HostName) ReadEFI(varUUID *uuid.UUID, efiName string) error {
 	return nil
 }
 
-func writeEFI(b []byte, varUUID *uuid.UUID, efiName string) error {
-	desc := efivarfs.VariableDescriptor{Name: efiName, GUID: *varUUID}
-	attrs := efivarfs.AttributeBootserviceAccess
-	attrs |= efivarfs.AttributeRuntimeAccess
-	attrs |= efivarfs.AttributeNonVolatile
-	e, err := efivarfs.New()
-	if err != nil {
-		return fmt.Errorf("marshal: %w", err)
-	}
-	return efivarfs.WriteVariable(e, desc, attrs, b)
+// EFIVariables names the EFI variables that stprov manages.  All variables
+// have the same vendor UUID as the host configuration.
+type EFIVariables struct {
+	UUID          *uuid.UUID
+	HostConfig    string   // host configuration, see HostConfigEFIVariableName()
+	HostName      string   // hostname
+	HostKey       string   // SSH host key, possibly encrypted
+	HostKeySealed string   // unique device secret sealed to the TPM
+	HostCert      string   // SSH host certificate
+	X509Key       string   // X.509 identity key
+	X509Cert      string   // X.509 identity certificate
+	Derived       []string // derived keys, one per named derivation
 }
 
-func readEFI(varUUID *uuid.UUID, efiName string) ([]byte, error) {
-	desc := efivarfs.VariableDescriptor{Name: efiName, GUID: *varUUID}
-	e, err := efivarfs.New()
-	if err != nil {
-		return nil, fmt.Errorf("marshal: %w", err)
-	}
-	_, b, err := efivarfs.ReadVariable(e, desc)
-	return b, err
+// Names outputs the names of all variables
+func (v *EFIVariables) Names() []string {
+	names := []string{v.HostConfig, v.HostName, v.HostKey, v.HostKeySealed, v.HostCert, v.X509Key, v.X509Cert}
+	return append(names, v.Derived...)
 }
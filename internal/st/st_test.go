@@ -5,6 +5,9 @@ import (
 	"testing"
 
 	"github.com/google/uuid"
+
+	"system-transparency.org/stboot/host"
+	"system-transparency.org/stprov/internal/store"
 )
 
 func TestReadWriteHostName(t *testing.T) {
@@ -12,13 +15,42 @@ func TestReadWriteHostName(t *testing.T) {
 		t.Skip("Skipping tests associated with TEST_CLOBBER_EFI_NVRAM")
 	}
 
+	s, err := store.NewEFI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testReadWriteHostName(t, s)
+}
+
+func TestReadWriteHostNameDir(t *testing.T) {
+	testReadWriteHostName(t, testDir(t))
+}
+
+func TestReadWriteHostConfigDir(t *testing.T) {
+	s := testDir(t)
+	pointer := "https://example.org/ospkg.json"
+	mode := host.IPDynamic
+	if err := WriteHostConfigEFI(s, &host.Config{IPAddrMode: &mode, OSPkgPointer: &pointer}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := HostConfigEFI(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.OSPkgPointer == nil || *cfg.OSPkgPointer != pointer {
+		t.Errorf("got OS package pointer %v, want %q", cfg.OSPkgPointer, pointer)
+	}
+}
+
+func testReadWriteHostName(t *testing.T, s store.Store) {
+	t.Helper()
 	hn := HostName("mullis")
-	if err := hn.WriteEFI(testUUID(t), "STHostName"); err != nil {
+	if err := hn.WriteEFI(s, testUUID(t), "STHostName"); err != nil {
 		t.Errorf("%v", err)
 		return
 	}
 	var hnAgain HostName
-	if err := hnAgain.ReadEFI(testUUID(t), "STHostName"); err != nil {
+	if err := hnAgain.ReadEFI(s, testUUID(t), "STHostName"); err != nil {
 		t.Errorf("%v", err)
 		return
 	}
@@ -27,6 +59,15 @@ func TestReadWriteHostName(t *testing.T) {
 	}
 }
 
+func testDir(t *testing.T) *store.Dir {
+	t.Helper()
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
 func testUUID(t *testing.T) *uuid.UUID {
 	t.Helper()
 	varUUID, err := uuid.Parse("f401f2c1-b005-4be0-8cee-f2e5945bcbe7")
@@ -0,0 +1,189 @@
+// package store provides backends that provisioned EFI variables are read from
+// and written to.  The default backend is EFI NVRAM.  A directory backend
+// persists the same variables as regular files, which is useful on platforms
+// without writable NVRAM and for testing without root privileges.
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/u-root/u-root/pkg/efivarfs"
+)
+
+const (
+	NameEFI   = "efi"  // selects EFI NVRAM
+	PrefixDir = "dir:" // selects a directory, e.g., "dir:/tmp/stprov"
+)
+
+// Store is a backend for EFI variables.  It is satisfied by efivarfs.EFIVarFS,
+// which targets EFI NVRAM, and by Dir.
+type Store interface {
+	efivarfs.EFIVar
+}
+
+// Open opens a store from a string specification, which is either "efi" or
+// "dir:PATH".  A directory is created if it does not exist already.
+func Open(spec string) (Store, error) {
+	switch {
+	case spec == NameEFI:
+		return NewEFI()
+	case strings.HasPrefix(spec, PrefixDir):
+		return NewDir(strings.TrimPrefix(spec, PrefixDir))
+	default:
+		return nil, fmt.Errorf("invalid store %q: must be %q or %q", spec, NameEFI, PrefixDir+"PATH")
+	}
+}
+
+// NewEFI opens EFI NVRAM via efivarfs
+func NewEFI() (Store, error) {
+	e, err := efivarfs.New()
+	if err != nil {
+		return nil, fmt.Errorf("new efivarfs: %w", err)
+	}
+	return e, nil
+}
+
+// Read reads the data of a variable, ignoring its attributes
+func Read(s Store, name string, guid *uuid.UUID) ([]byte, error) {
+	desc := efivarfs.VariableDescriptor{Name: name, GUID: *guid}
+	_, b, err := efivarfs.ReadVariable(s, desc)
+	return b, err
+}
+
+// Write writes a non-volatile variable that is accessible during boot
+// services and at runtime
+func Write(s Store, name string, guid *uuid.UUID, data []byte) error {
+	return WriteWithAttributes(s, name, guid, 0, data)
+}
+
+// WriteWithAttributes is like Write, but adds extra attributes such as
+// efivarfs.AttributeTimeBasedAuthenticatedWriteAccess
+func WriteWithAttributes(s Store, name string, guid *uuid.UUID, extra efivarfs.VariableAttributes, data []byte) error {
+	desc := efivarfs.VariableDescriptor{Name: name, GUID: *guid}
+	attrs := efivarfs.AttributeNonVolatile
+	attrs |= efivarfs.AttributeBootserviceAccess
+	attrs |= efivarfs.AttributeRuntimeAccess
+	attrs |= extra
+	return efivarfs.WriteVariable(s, desc, attrs, data)
+}
+
+// Remove removes a variable
+func Remove(s Store, name string, guid *uuid.UUID) error {
+	return efivarfs.RemoveVariable(s, efivarfs.VariableDescriptor{Name: name, GUID: *guid})
+}
+
+// Dir stores variables as regular files in a directory.  The file layout
+// matches efivarfs: the file is named NAME-GUID, and its content is four bytes
+// of little-endian attributes followed by the variable's data.
+//
+// Authenticated variables, such as Secure Boot keys, are stored as is.  No
+// signatures are verified and no authentication descriptors are stripped.
+type Dir struct {
+	path string
+}
+
+var _ Store = &Dir{}
+
+// NewDir opens a directory store, creating the directory if needed
+func NewDir(path string) (*Dir, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("directory path is required")
+	}
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return nil, fmt.Errorf("create directory: %w", err)
+	}
+	return &Dir{path: path}, nil
+}
+
+func (d *Dir) Get(desc efivarfs.VariableDescriptor) (efivarfs.VariableAttributes, []byte, error) {
+	b, err := os.ReadFile(d.filename(desc))
+	if err != nil {
+		return 0, nil, d.mapErr(err)
+	}
+
+	var attrs efivarfs.VariableAttributes
+	r := bytes.NewReader(b)
+	if err := binary.Read(r, binary.LittleEndian, &attrs); err != nil {
+		return 0, nil, fmt.Errorf("%s: truncated variable file", d.filename(desc))
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	return attrs, data, nil
+}
+
+func (d *Dir) Set(desc efivarfs.VariableDescriptor, attrs efivarfs.VariableAttributes, data []byte) error {
+	if attrs&efivarfs.AttributeAppendWrite != 0 {
+		oldAttrs, oldData, err := d.Get(desc)
+		if err == nil {
+			attrs = oldAttrs
+			data = append(oldData, data...)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, attrs); err != nil {
+		return err
+	}
+	buf.Write(data)
+	return d.mapErr(os.WriteFile(d.filename(desc), buf.Bytes(), 0o600))
+}
+
+func (d *Dir) Remove(desc efivarfs.VariableDescriptor) error {
+	return d.mapErr(os.Remove(d.filename(desc)))
+}
+
+func (d *Dir) List() ([]efivarfs.VariableDescriptor, error) {
+	const guidLength = 36
+	dirents, err := os.ReadDir(d.path)
+	if err != nil {
+		return nil, d.mapErr(err)
+	}
+
+	var entries []efivarfs.VariableDescriptor
+	for _, dirent := range dirents {
+		if !dirent.Type().IsRegular() {
+			continue
+		}
+		name := dirent.Name()
+		if len(name) < guidLength+1 || name[len(name)-guidLength-1] != '-' {
+			continue
+		}
+		guid, err := uuid.Parse(name[len(name)-guidLength:])
+		if err != nil {
+			continue
+		}
+		entries = append(entries, efivarfs.VariableDescriptor{Name: name[:len(name)-guidLength-1], GUID: guid})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name+"-"+entries[i].GUID.String() < entries[j].Name+"-"+entries[j].GUID.String()
+	})
+	return entries, nil
+}
+
+func (d *Dir) filename(desc efivarfs.VariableDescriptor) string {
+	return filepath.Join(d.path, fmt.Sprintf("%s-%s", desc.Name, desc.GUID.String()))
+}
+
+// mapErr maps file-system errors to the errors that efivarfs would return
+func (d *Dir) mapErr(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case os.IsNotExist(err):
+		return efivarfs.ErrVarNotExist
+	case os.IsPermission(err):
+		return efivarfs.ErrVarPermission
+	default:
+		return err
+	}
+}
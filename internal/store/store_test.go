@@ -0,0 +1,144 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/u-root/u-root/pkg/efivarfs"
+)
+
+func TestOpen(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "vars")
+	for _, table := range []struct {
+		desc string
+		spec string
+	}{
+		{"invalid: empty", ""},
+		{"invalid: unknown", "nvram"},
+		{"invalid: no path", "dir:"},
+		{"valid", "dir:" + dir},
+	} {
+		_, err := Open(table.spec)
+		if got, want := err != nil, table.desc != "valid"; got != want {
+			t.Errorf("%s: got error %v but wanted %v: %v", table.desc, got, want, err)
+		}
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("directory was not created: %v", err)
+	}
+}
+
+func TestDirReadWrite(t *testing.T) {
+	s := testDir(t)
+	guid := testUUID(t)
+	if _, err := Read(s, "STHostName", guid); !errors.Is(err, efivarfs.ErrVarNotExist) {
+		t.Errorf("got error %v, want %v", err, efivarfs.ErrVarNotExist)
+	}
+
+	if err := Write(s, "STHostName", guid, []byte("mullis")); err != nil {
+		t.Fatal(err)
+	}
+	attrs, b, err := efivarfs.ReadVariable(s, efivarfs.VariableDescriptor{Name: "STHostName", GUID: *guid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b, []byte("mullis"); !bytes.Equal(got, want) {
+		t.Errorf("got data %q, want %q", got, want)
+	}
+	wantAttrs := efivarfs.AttributeNonVolatile | efivarfs.AttributeBootserviceAccess | efivarfs.AttributeRuntimeAccess
+	if got, want := attrs, wantAttrs; got != want {
+		t.Errorf("got attributes %x, want %x", got, want)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(s.path, "STHostName-"+guid.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := raw, []byte("\x07\x00\x00\x00mullis"); !bytes.Equal(got, want) {
+		t.Errorf("got file content %x, want %x", got, want)
+	}
+}
+
+func TestDirTruncated(t *testing.T) {
+	s := testDir(t)
+	guid := testUUID(t)
+	if err := os.WriteFile(filepath.Join(s.path, "STHostName-"+guid.String()), []byte("\x07\x00"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Read(s, "STHostName", guid)
+	if err == nil || errors.Is(err, efivarfs.ErrVarNotExist) {
+		t.Errorf("got error %v, want a truncated variable file", err)
+	}
+}
+
+func TestDirAppendWrite(t *testing.T) {
+	s := testDir(t)
+	guid := testUUID(t)
+	if err := Write(s, "db", guid, []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteWithAttributes(s, "db", guid, efivarfs.AttributeAppendWrite, []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := Read(s, "db", guid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b, []byte("foobar"); !bytes.Equal(got, want) {
+		t.Errorf("got data %q, want %q", got, want)
+	}
+}
+
+func TestDirListRemove(t *testing.T) {
+	s := testDir(t)
+	guid := testUUID(t)
+	for _, name := range []string{"STHostName", "STHostKey"} {
+		if err := Write(s, name, guid, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(s.path, "README"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	descs, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(descs), 2; got != want {
+		t.Fatalf("got %d variables, want %d", got, want)
+	}
+	if got, want := descs[0].Name, "STHostKey"; got != want {
+		t.Errorf("got first variable %q, want %q", got, want)
+	}
+
+	desc := efivarfs.VariableDescriptor{Name: "STHostKey", GUID: *guid}
+	if err := s.Remove(desc); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(desc); !errors.Is(err, efivarfs.ErrVarNotExist) {
+		t.Errorf("got error %v, want %v", err, efivarfs.ErrVarNotExist)
+	}
+}
+
+func testDir(t *testing.T) *Dir {
+	t.Helper()
+	s, err := NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func testUUID(t *testing.T) *uuid.UUID {
+	t.Helper()
+	guid, err := uuid.Parse("f401f2c1-b005-4be0-8cee-f2e5945bcbe7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &guid
+}
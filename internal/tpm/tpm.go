@@ -0,0 +1,255 @@
+// Package tpm seals and unseals small secrets with a TPM 2.0.  A secret is
+// sealed under a primary storage key in the owner hierarchy, with a policy
+// that requires the selected PCRs to have the same values as when sealing.
+package tpm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpm2/transport/linuxtpm"
+	"github.com/google/go-tpm/tpm2/transport/tcp"
+)
+
+const (
+	DefaultDevice = "/dev/tpmrm0"
+
+	// PrefixSimulator selects a TPM simulator that implements the TCP
+	// protocol of the TCG reference implementation, e.g., "mssim:localhost:2321".
+	// The platform port is the command port plus one.
+	PrefixSimulator = "mssim:"
+
+	// BlobVersion is the version of the sealed blob format
+	BlobVersion = 1
+
+	// MaxSecretSize is the maximum number of bytes that can be sealed
+	MaxSecretSize = 128
+)
+
+// SecureBootPCR holds the Secure Boot policy.  Its value changes when Secure
+// Boot keys are provisioned, so a secret sealed to it before provisioning can
+// not be unsealed after the next boot.
+const SecureBootPCR = 7
+
+// DefaultPCRs are the PCRs that a secret is sealed to by default
+var DefaultPCRs = []uint{SecureBootPCR}
+
+// Blob is a sealed secret.  It is encoded as JSON for storage.
+type Blob struct {
+	Version int    `json:"version"`
+	PCRs    []uint `json:"pcrs"`    // SHA256 PCRs in the policy
+	Public  []byte `json:"public"`  // TPM2B_PUBLIC of the sealed object
+	Private []byte `json:"private"` // TPM2B_PRIVATE of the sealed object
+
+	// Label is an optional description of the sealed secret.  It is not
+	// interpreted by this package, and not protected by the TPM.
+	Label string `json:"label,omitempty"`
+}
+
+// Marshal encodes a sealed blob for storage
+func (b *Blob) Marshal() ([]byte, error) {
+	return json.Marshal(b)
+}
+
+// Unmarshal decodes a sealed blob
+func (b *Blob) Unmarshal(data []byte) error {
+	if err := json.Unmarshal(data, b); err != nil {
+		return err
+	}
+	if b.Version != BlobVersion {
+		return fmt.Errorf("unsupported blob version %d", b.Version)
+	}
+	if len(b.PCRs) == 0 || len(b.Public) == 0 || len(b.Private) == 0 {
+		return fmt.Errorf("incomplete blob")
+	}
+	return nil
+}
+
+// Open opens a TPM device, or a simulator if the path has PrefixSimulator.  A
+// simulator is powered on and started up.
+func Open(path string) (transport.TPMCloser, error) {
+	if !strings.HasPrefix(path, PrefixSimulator) {
+		return linuxtpm.Open(path)
+	}
+
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(path, PrefixSimulator))
+	if err != nil {
+		return nil, fmt.Errorf("simulator address: %w", err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("simulator port: %w", err)
+	}
+	sim, err := tcp.Open(tcp.Config{
+		CommandAddress:  net.JoinHostPort(host, port),
+		PlatformAddress: net.JoinHostPort(host, strconv.Itoa(p+1)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := sim.PowerOn(); err != nil {
+		sim.Close()
+		return nil, fmt.Errorf("power on: %w", err)
+	}
+	_, err = tpm2.Startup{StartupType: tpm2.TPMSUClear}.Execute(sim)
+	if err != nil && !errors.Is(err, tpm2.TPMRCInitialize) {
+		sim.Close()
+		return nil, fmt.Errorf("startup: %w", err)
+	}
+	return sim, nil
+}
+
+// ParsePCRs parses a comma-separated list of PCR indices, e.g., "0,2,7"
+func ParsePCRs(s string) ([]uint, error) {
+	var pcrs []uint
+	for _, field := range strings.Split(s, ",") {
+		pcr, err := strconv.ParseUint(strings.TrimSpace(field), 10, 32)
+		if err != nil || pcr > 23 {
+			return nil, fmt.Errorf("invalid pcr %q, must be in [0, 23]", field)
+		}
+		pcrs = append(pcrs, uint(pcr))
+	}
+	return pcrs, nil
+}
+
+// Seal seals a secret to the current values of the given SHA256 PCRs
+func Seal(t transport.TPM, secret []byte, pcrs []uint) (*Blob, error) {
+	if len(secret) == 0 || len(secret) > MaxSecretSize {
+		return nil, fmt.Errorf("secret size %d not in [1, %d]", len(secret), MaxSecretSize)
+	}
+	if len(pcrs) == 0 {
+		return nil, fmt.Errorf("no pcrs")
+	}
+	srk, err := createSRK(t)
+	if err != nil {
+		return nil, err
+	}
+	defer flush(t, srk.ObjectHandle)
+
+	policy, err := policyDigest(t, pcrs)
+	if err != nil {
+		return nil, fmt.Errorf("policy digest: %w", err)
+	}
+	rsp, err := tpm2.Create{
+		ParentHandle: tpm2.NamedHandle{Handle: srk.ObjectHandle, Name: srk.Name},
+		InSensitive: tpm2.TPM2BSensitiveCreate{
+			Sensitive: &tpm2.TPMSSensitiveCreate{
+				Data: tpm2.NewTPMUSensitiveCreate(&tpm2.TPM2BSensitiveData{Buffer: secret}),
+			},
+		},
+		InPublic: tpm2.New2B(tpm2.TPMTPublic{
+			Type:    tpm2.TPMAlgKeyedHash,
+			NameAlg: tpm2.TPMAlgSHA256,
+			ObjectAttributes: tpm2.TPMAObject{
+				FixedTPM:    true,
+				FixedParent: true,
+				NoDA:        true,
+			},
+			AuthPolicy: tpm2.TPM2BDigest{Buffer: policy},
+		}),
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+	return &Blob{
+		Version: BlobVersion,
+		PCRs:    pcrs,
+		Public:  tpm2.Marshal(rsp.OutPublic),
+		Private: tpm2.Marshal(rsp.OutPrivate),
+	}, nil
+}
+
+// Unseal unseals a secret.  It fails unless the PCRs have the same values as
+// when the secret was sealed, on the same TPM.
+func Unseal(t transport.TPM, blob *Blob) ([]byte, error) {
+	pub, err := tpm2.Unmarshal[tpm2.TPM2BPublic](blob.Public)
+	if err != nil {
+		return nil, fmt.Errorf("public: %w", err)
+	}
+	priv, err := tpm2.Unmarshal[tpm2.TPM2BPrivate](blob.Private)
+	if err != nil {
+		return nil, fmt.Errorf("private: %w", err)
+	}
+	srk, err := createSRK(t)
+	if err != nil {
+		return nil, err
+	}
+	defer flush(t, srk.ObjectHandle)
+
+	obj, err := tpm2.Load{
+		ParentHandle: tpm2.NamedHandle{Handle: srk.ObjectHandle, Name: srk.Name},
+		InPrivate:    *priv,
+		InPublic:     *pub,
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("load: %w", err)
+	}
+	defer flush(t, obj.ObjectHandle)
+
+	rsp, err := tpm2.Unseal{
+		ItemHandle: tpm2.AuthHandle{
+			Handle: obj.ObjectHandle,
+			Name:   obj.Name,
+			Auth: tpm2.Policy(tpm2.TPMAlgSHA256, 16, func(t transport.TPM, handle tpm2.TPMISHPolicy, _ tpm2.TPM2BNonce) error {
+				_, err := tpm2.PolicyPCR{PolicySession: handle, Pcrs: pcrSelection(blob.PCRs)}.Execute(t)
+				return err
+			}),
+		},
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("unseal: %w", err)
+	}
+	return rsp.OutData.Buffer, nil
+}
+
+// createSRK creates the primary storage key that secrets are sealed under.
+// It is the same on every call, because the template is fixed.
+func createSRK(t transport.TPM) (*tpm2.CreatePrimaryResponse, error) {
+	rsp, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.TPMRHOwner,
+		InPublic:      tpm2.New2B(tpm2.ECCSRKTemplate),
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("create primary: %w", err)
+	}
+	return rsp, nil
+}
+
+// policyDigest computes the digest of a PCR policy with a trial session
+func policyDigest(t transport.TPM, pcrs []uint) ([]byte, error) {
+	sess, cleanup, err := tpm2.PolicySession(t, tpm2.TPMAlgSHA256, 16, tpm2.Trial())
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	if _, err := (tpm2.PolicyPCR{PolicySession: sess.Handle(), Pcrs: pcrSelection(pcrs)}).Execute(t); err != nil {
+		return nil, err
+	}
+	rsp, err := tpm2.PolicyGetDigest{PolicySession: sess.Handle()}.Execute(t)
+	if err != nil {
+		return nil, err
+	}
+	return rsp.PolicyDigest.Buffer, nil
+}
+
+func pcrSelection(pcrs []uint) tpm2.TPMLPCRSelection {
+	return tpm2.TPMLPCRSelection{
+		PCRSelections: []tpm2.TPMSPCRSelection{
+			{
+				Hash:      tpm2.TPMAlgSHA256,
+				PCRSelect: tpm2.PCClientCompatible.PCRs(pcrs...),
+			},
+		},
+	}
+}
+
+func flush(t transport.TPM, handle tpm2.TPMHandle) {
+	tpm2.FlushContext{FlushHandle: handle}.Execute(t)
+}
@@ -0,0 +1,118 @@
+package tpm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// envSimulator selects a TPM simulator to test against, e.g., by running
+// "tpm_server" or "swtpm socket --tpm2 --server port=2321 --ctrl
+// type=tcp,port=2322" and setting STPROV_TPM_SIMULATOR=mssim:localhost:2321
+const envSimulator = "STPROV_TPM_SIMULATOR"
+
+func TestParsePCRs(t *testing.T) {
+	for _, table := range []struct {
+		desc string
+		in   string
+		want []uint
+	}{
+		{"invalid: empty", "", nil},
+		{"invalid: not a number", "seven", nil},
+		{"invalid: too large", "24", nil},
+		{"invalid: negative", "-1", nil},
+		{"valid: one", "7", []uint{7}},
+		{"valid: several", "0, 2,7", []uint{0, 2, 7}},
+	} {
+		pcrs, err := ParsePCRs(table.in)
+		if got, want := err != nil, table.want == nil; got != want {
+			t.Errorf("%s: got error %v but wanted %v: %v", table.desc, got, want, err)
+			continue
+		}
+		if got, want := pcrs, table.want; err == nil && !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v but wanted %v", table.desc, got, want)
+		}
+	}
+}
+
+func TestBlob(t *testing.T) {
+	blob := Blob{Version: BlobVersion, PCRs: []uint{7}, Public: []byte{1}, Private: []byte{2}, Label: "ed25519"}
+	b, err := blob.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Blob
+	if err := got.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, blob) {
+		t.Errorf("got %+v but wanted %+v", got, blob)
+	}
+
+	for _, table := range []struct {
+		desc string
+		in   string
+	}{
+		{"bad json", `{"version":1`},
+		{"bad version", `{"version":2,"pcrs":[7],"public":"AQ==","private":"Ag=="}`},
+		{"no pcrs", `{"version":1,"public":"AQ==","private":"Ag=="}`},
+		{"no private", `{"version":1,"pcrs":[7],"public":"AQ=="}`},
+	} {
+		if err := new(Blob).Unmarshal([]byte(table.in)); err == nil {
+			t.Errorf("%s: unmarshalled invalid blob", table.desc)
+		}
+	}
+}
+
+func TestSealUnseal(t *testing.T) {
+	path := os.Getenv(envSimulator)
+	if path == "" {
+		t.Skipf("%s is not set", envSimulator)
+	}
+	tpm, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	// PCR 16 is the debug PCR, which can be extended without side effects
+	secret := bytes.Repeat([]byte{0x01}, 32)
+	if _, err := Seal(tpm, nil, []uint{16}); err == nil {
+		t.Errorf("sealed an empty secret")
+	}
+	blob, err := Seal(tpm, secret, []uint{16})
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	got, err := Unseal(tpm, blob)
+	if err != nil {
+		t.Fatalf("unseal: %v", err)
+	}
+	if !bytes.Equal(got, secret) {
+		t.Errorf("got secret %x but wanted %x", got, secret)
+	}
+
+	extendPCR(t, tpm, 16)
+	if _, err := Unseal(tpm, blob); err == nil {
+		t.Errorf("unsealed after the pcr changed")
+	}
+}
+
+func extendPCR(t *testing.T, tpm transport.TPM, pcr uint) {
+	t.Helper()
+	digest := sha256.Sum256([]byte("stprov"))
+	_, err := tpm2.PCRExtend{
+		PCRHandle: tpm2.AuthHandle{Handle: tpm2.TPMHandle(pcr), Auth: tpm2.PasswordAuth(nil)},
+		Digests: tpm2.TPMLDigestValues{
+			Digests: []tpm2.TPMTHA{{HashAlg: tpm2.TPMAlgSHA256, Digest: digest[:]}},
+		},
+	}.Execute(tpm)
+	if err != nil {
+		t.Fatalf("extend pcr: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package abort
+
+import (
+	"fmt"
+	"net"
+
+	"system-transparency.org/stprov/internal/api"
+)
+
+func Main(args []string, optPort int, optIP, optOTP string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("trailing arguments: %v", args)
+	}
+	if len(optIP) == 0 {
+		return fmt.Errorf("ip address is a required option")
+	}
+	if len(optOTP) == 0 {
+		return fmt.Errorf("one-time password is a required option")
+	}
+	ip := net.ParseIP(optIP)
+	if ip == nil {
+		return fmt.Errorf("malformed ip address: %s", optIP)
+	}
+	if optPort < 1 || optPort > 65535 {
+		return fmt.Errorf("invalid port: %d not in [0, 65535]", optPort)
+	}
+
+	cli, err := api.NewClient(&api.ClientConfig{
+		Secret:     optOTP,
+		RemoteIP:   ip,
+		RemotePort: optPort,
+	})
+	if err != nil {
+		return fmt.Errorf("new client: %w", err)
+	}
+	state, err := cli.State()
+	if err != nil {
+		return err
+	}
+	if err := cli.Abort(); err != nil {
+		return err
+	}
+	fmt.Printf("state=%s\n", state)
+	return nil
+}
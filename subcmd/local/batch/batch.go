@@ -0,0 +1,235 @@
+package batch
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"system-transparency.org/stboot/stlog"
+	"system-transparency.org/stprov/internal/api"
+	"system-transparency.org/stprov/subcmd/local/run"
+)
+
+// Host is a single stprov remote to provision
+type Host struct {
+	IP   net.IP
+	Port int
+	OTP  string
+}
+
+func (h *Host) String() string {
+	return net.JoinHostPort(h.IP.String(), strconv.Itoa(h.Port))
+}
+
+// Result is the outcome of provisioning a single host
+type Result struct {
+	Host     Host
+	Response *api.CommitResponse // nil on failure
+	SAS      string              // short authentication string, see api.ShortAuthString()
+	Entropy  string              // hex-encoded entropy added by stprov local
+	Err      error
+}
+
+// Provisioner runs the stprov local-remote sequence against a single host
+type Provisioner func(cfg *api.ClientConfig) (*run.Result, error)
+
+func Main(args []string, optFile string, optJobs int, optOutput string, optPort int, optPKFile, optKEKFile, optDBFile, optDBXFile string, optNoUEFIMenuReboot bool) error {
+	if len(args) != 0 {
+		return fmt.Errorf("trailing arguments: %v", args)
+	}
+	if len(optFile) == 0 {
+		return fmt.Errorf("file: hosts file is a required option")
+	}
+	if optJobs < 1 {
+		return fmt.Errorf("jobs: must be at least 1")
+	}
+
+	fp, err := os.Open(optFile)
+	if err != nil {
+		return fmt.Errorf("open hosts file: %w", err)
+	}
+	defer fp.Close()
+	hosts, err := ParseHosts(fp, optPort)
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", optFile, err)
+	}
+
+	cfg := api.ClientConfig{RebootIntoUEFIMenu: !optNoUEFIMenuReboot}
+	if err := run.ReadSecureBootKeys(&cfg, optPKFile, optKEKFile, optDBFile, optDBXFile); err != nil {
+		return err
+	}
+
+	stlog.Info("provisioning %d host(s), at most %d at a time", len(hosts), optJobs)
+	results := Run(hosts, optJobs, &cfg, func(cfg *api.ClientConfig) (*run.Result, error) {
+		return run.Provision(cfg, nil, nil)
+	})
+	if err := WriteTable(os.Stdout, results); err != nil {
+		return fmt.Errorf("write result table: %w", err)
+	}
+	if len(optOutput) > 0 {
+		if err := writeOutputFile(optOutput, results); err != nil {
+			return fmt.Errorf("write output file: %w", err)
+		}
+	}
+
+	var failed int
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d host(s) failed", failed, len(results))
+	}
+	return nil
+}
+
+// ParseHosts parses a hosts file in CSV format with the columns ip, port, and
+// otp.  An empty port is replaced by defaultPort.  Lines that start with '#'
+// are ignored, and so is an initial header line that starts with "ip".
+func ParseHosts(r io.Reader, defaultPort int) ([]Host, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 3
+	cr.TrimLeadingSpace = true
+
+	var hosts []Host
+	seen := make(map[string]bool)
+	for first := true; ; first = false {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		if first && strings.EqualFold(strings.TrimSpace(record[0]), "ip") {
+			continue
+		}
+
+		h, err := parseHost(record, defaultPort)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if seen[h.String()] {
+			return nil, fmt.Errorf("line %d: duplicate host %s", line, h.String())
+		}
+		seen[h.String()] = true
+		hosts = append(hosts, *h)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no hosts")
+	}
+	return hosts, nil
+}
+
+func parseHost(record []string, defaultPort int) (*Host, error) {
+	ipStr, portStr, otp := strings.TrimSpace(record[0]), strings.TrimSpace(record[1]), record[2]
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, fmt.Errorf("malformed ip address: %q", ipStr)
+	}
+	port := defaultPort
+	if len(portStr) > 0 {
+		var err error
+		if port, err = strconv.Atoi(portStr); err != nil {
+			return nil, fmt.Errorf("malformed port: %q", portStr)
+		}
+	}
+	if port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid port: %d not in [1, 65535]", port)
+	}
+	if len(otp) == 0 {
+		return nil, fmt.Errorf("one-time password is required")
+	}
+	return &Host{IP: ip, Port: port, OTP: otp}, nil
+}
+
+// Run provisions hosts using at most jobs concurrent provisioners.  Each host
+// gets a copy of cfg with its own IP address, port, and one-time password.
+// The results are in the same order as hosts.  The short authentication string
+// and entropy of each host are logged as soon as it is committed, so that they
+// can be compared on the platform's console.
+func Run(hosts []Host, jobs int, cfg *api.ClientConfig, provision Provisioner) []Result {
+	results := make([]Result, len(hosts))
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			hostCfg := *cfg
+			hostCfg.Secret = h.OTP
+			hostCfg.RemoteIP = h.IP
+			hostCfg.RemotePort = h.Port
+			res, err := provision(&hostCfg)
+			if err != nil {
+				stlog.Warn("%s: %v", h.String(), err)
+				results[i] = Result{Host: h, Err: err}
+				return
+			}
+			entropy := hex.EncodeToString(res.Data.Entropy)
+			stlog.Info("%s: provisioned %s, short authentication string: %s, entropy: %s", h.String(), res.Commit.HostName, res.SAS, entropy)
+			results[i] = Result{Host: h, Response: res.Commit, SAS: res.SAS, Entropy: entropy}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// WriteTable writes a human-readable table with one row per host
+func WriteTable(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "HOST\tSTATUS\tHOSTNAME\tSAS\tFINGERPRINT OR ERROR\n")
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(tw, "%s\tFAIL\t-\t-\t%v\n", r.Host.String(), r.Err)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\tOK\t%s\t%s\t%s\n", r.Host.String(), r.Response.HostName, r.SAS, r.Response.Fingerprint)
+	}
+	return tw.Flush()
+}
+
+// WriteCSV writes all results in CSV format with a header line.  The columns
+// are ip, port, status, hostname, sas, entropy, fingerprint, publickey, and
+// error.
+func WriteCSV(w io.Writer, results []Result) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"ip", "port", "status", "hostname", "sas", "entropy", "fingerprint", "publickey", "error"})
+	for _, r := range results {
+		record := []string{r.Host.IP.String(), strconv.Itoa(r.Host.Port)}
+		if r.Err != nil {
+			record = append(record, "fail", "", "", "", "", "", r.Err.Error())
+		} else {
+			record = append(record, "ok", r.Response.HostName, r.SAS, r.Entropy, r.Response.Fingerprint, r.Response.PublicKey, "")
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeOutputFile(filename string, results []Result) error {
+	fp, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := WriteCSV(fp, results); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
@@ -0,0 +1,130 @@
+package batch
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"system-transparency.org/stprov/internal/api"
+	"system-transparency.org/stprov/subcmd/local/run"
+)
+
+func TestParseHosts(t *testing.T) {
+	for _, table := range []struct {
+		desc string
+		in   string
+		want []Host
+	}{
+		{"invalid: empty", "", nil},
+		{"invalid: only header", "ip,port,otp\n", nil},
+		{"invalid: too few columns", "10.0.0.1,2009\n", nil},
+		{"invalid: ip", "10.0.0.x,2009,otp\n", nil},
+		{"invalid: port", "10.0.0.1,x,otp\n", nil},
+		{"invalid: port range", "10.0.0.1,65536,otp\n", nil},
+		{"invalid: otp", "10.0.0.1,2009,\n", nil},
+		{"invalid: duplicate", "10.0.0.1,2009,a\n10.0.0.1,,b\n", nil},
+		{
+			"valid",
+			"ip,port,otp\n# comment\n10.0.0.1,,sikrit\n10.0.0.1, 2010,other sikrit\n::1,2009,x\n",
+			[]Host{
+				{net.ParseIP("10.0.0.1"), 2009, "sikrit"},
+				{net.ParseIP("10.0.0.1"), 2010, "other sikrit"},
+				{net.ParseIP("::1"), 2009, "x"},
+			},
+		},
+	} {
+		hosts, err := ParseHosts(strings.NewReader(table.in), 2009)
+		if got, want := err != nil, table.desc[:5] != "valid"; got != want {
+			t.Errorf("%s: got error %v but wanted %v: %v", table.desc, got, want, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got, want := len(hosts), len(table.want); got != want {
+			t.Errorf("%s: got %d hosts, want %d", table.desc, got, want)
+			continue
+		}
+		for i := range hosts {
+			if got, want := hosts[i], table.want[i]; !got.IP.Equal(want.IP) || got.Port != want.Port || got.OTP != want.OTP {
+				t.Errorf("%s: host %d: got %v, want %v", table.desc, i, got, want)
+			}
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	var hosts []Host
+	for i := 1; i <= 10; i++ {
+		hosts = append(hosts, Host{IP: net.ParseIP(fmt.Sprintf("10.0.0.%d", i)), Port: 2009, OTP: fmt.Sprintf("otp-%d", i)})
+	}
+
+	var mu sync.Mutex
+	var running, maxRunning int
+	const jobs = 3
+	cfg := api.ClientConfig{DB: []byte("db")}
+	results := Run(hosts, jobs, &cfg, func(cfg *api.ClientConfig) (*run.Result, error) {
+		mu.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+
+		if string(cfg.DB) != "db" {
+			return nil, fmt.Errorf("shared options not copied")
+		}
+		if cfg.Secret == "otp-5" {
+			return nil, fmt.Errorf("failed")
+		}
+		return &run.Result{
+			Data:   &api.AddDataRequest{Entropy: []byte{0xde, 0xad}},
+			Commit: &api.CommitResponse{HostName: cfg.RemoteIP.String()},
+			SAS:    "sas-" + cfg.Secret,
+		}, nil
+	})
+
+	if maxRunning > jobs {
+		t.Errorf("got %d concurrent jobs, want at most %d", maxRunning, jobs)
+	}
+	for i, r := range results {
+		if !r.Host.IP.Equal(hosts[i].IP) {
+			t.Errorf("result %d: got host %s, want %s", i, r.Host.IP, hosts[i].IP)
+		}
+		if got, want := r.Err != nil, i == 4; got != want {
+			t.Errorf("result %d: got error %v but wanted %v: %v", i, got, want, r.Err)
+			continue
+		}
+		if r.Err == nil && r.Response.HostName != hosts[i].IP.String() {
+			t.Errorf("result %d: got hostname %q, want %q", i, r.Response.HostName, hosts[i].IP)
+		}
+		if r.Err == nil && (r.SAS != "sas-"+hosts[i].OTP || r.Entropy != "dead") {
+			t.Errorf("result %d: got sas %q and entropy %q", i, r.SAS, r.Entropy)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Count(buf.String(), "\n"), len(hosts)+1; got != want {
+		t.Errorf("got %d CSV lines, want %d", got, want)
+	}
+	if want := "10.0.0.1,2009,ok,10.0.0.1,sas-otp-1,dead,"; !strings.Contains(buf.String(), want) {
+		t.Errorf("CSV output does not contain %q:\n%s", want, buf.String())
+	}
+
+	buf.Reset()
+	if err := WriteTable(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	if want := "sas-otp-1"; !strings.Contains(buf.String(), want) {
+		t.Errorf("table does not contain %q:\n%s", want, buf.String())
+	}
+}
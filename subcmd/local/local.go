@@ -4,15 +4,24 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"system-transparency.org/stboot/stlog"
 	"system-transparency.org/stprov/internal/options"
+	"system-transparency.org/stprov/internal/ssh"
+	"system-transparency.org/stprov/subcmd/local/abort"
+	"system-transparency.org/stprov/subcmd/local/batch"
 	"system-transparency.org/stprov/subcmd/local/run"
 )
 
 const usage = `Usage:
 
-  stprov local run -o OTP -i IP_ADDR [-p PORT]
+  stprov local run -o OTP -i IP_ADDR [-p PORT] [--format FORMAT]
+        [--known-hosts FILENAME [--hash-known-hosts] [--replace]]
+        [--host-ca FILENAME [--host-cert-validity DURATION]]
+        [--host-key-type TYPE] [--host-key-passphrase-file FILENAME]
+        [--derive NAME[,NAME...]]
+        [--ca FILENAME --ca-key FILENAME [--cert-validity DURATION]]
         [--pk FILENAME --kek FILENAME --db FILENAME [--dbx FILENAME] [-n]]
 
     Contributes entropy to stprov remote, which is listening on a given IP
@@ -29,24 +38,143 @@ const usage = `Usage:
     hostname=<the platform's hostname>
     ip=<the platform's IP address>
 
+    With --format json, a JSON object is output instead.  In addition to the
+    above, it holds the platform's authentication and identity strings, the
+    remote port, the hex-encoded entropy, the hex-encoded SHA256 hashes of the
+    Secure Boot files (if any), and an RFC 3339 timestamp.
+
+    With --known-hosts, the platform's SSH hostkey is also pinned in an OpenSSH
+    known_hosts file for the platform's hostname and IP address.  Existing
+    lines for the same hostname or IP address and key type are replaced, and
+    keys of other types are kept.  It is an error if a different key of the
+    same type is already pinned, unless --replace is specified.  The result is
+    output before the known_hosts file is updated, so that it is not lost if
+    the update fails.
+
+    With --host-ca, the platform's SSH hostkey is signed as an OpenSSH host
+    certificate with the platform's hostname and IP address as principals.  The
+    certificate is output as "hostcert=<certificate>", and stprov remote stores
+    it in EFI NVRAM next to the SSH hostkey.
+
+    With --host-key-type, the platform's SSH hostkey is of a different type
+    than Ed25519: "ecdsa-p256" or "rsa-3072".  Each type is derived from the
+    same secret on the platform, but the resulting keys are unrelated.
+
+    With --host-key-passphrase-file, stprov remote encrypts the platform's SSH
+    hostkey at rest with the passphrase in the given file, using OpenSSH's
+    bcrypt KDF and aes256-ctr.  A trailing newline is not part of the
+    passphrase.  The passphrase is needed to use the SSH hostkey later on.
+
+    With --derive, stprov remote also derives named keys from the same secret
+    as the platform's SSH hostkey, and writes them to EFI NVRAM.  The names are
+    comma-separated: "wireguard", "age", or "tls-client".  The public key of
+    each derived key is output as "derived_<name>=<public key>", and in the
+    "derived_keys" object with --format json.
+
+    With --ca and --ca-key, stprov remote sends a certificate signing request
+    for an ECDSA P-256 key that is derived from the same secret as the SSH
+    hostkey.  It is signed as an X.509 certificate for TLS client and server
+    authentication, with the platform's hostname and IP address as subject
+    alternative names.  The certificate is output as "x509cert=<base64-encoded
+    DER certificate>", and stprov remote stores it in EFI NVRAM with its key.
+
   Options:
 
     -o, --otp   One-time password to establish a secure connection
     -i, --ip    Remote stprov address (e.g., 10.0.2.10)
     -p, --port  Remote stprov port (Default: 2009)
+        --format
+                Output format, "text" or "json" (Default: text)
+        --known-hosts
+                Filename of a known_hosts file to add the SSH hostkey to
+        --hash-known-hosts
+                Hash the hostname and IP address in the known_hosts file
+        --replace
+                Replace keys that are already pinned in the known_hosts file
+        --host-ca
+                Filename of an unencrypted SSH CA private key to sign a host certificate
+        --host-cert-validity
+                How long the host certificate is valid (Default: 8760h)
+        --host-key-type
+                SSH hostkey type, "ed25519", "ecdsa-p256", or "rsa-3072" (Default: ed25519)
+        --host-key-passphrase-file
+                Filename of a passphrase to encrypt the SSH hostkey with
+        --derive
+                Comma-separated names of additional keys to derive, see above
+        --ca    Filename of an X.509 CA certificate in PEM format to sign an
+                identity certificate with
+        --ca-key
+                Filename of the CA's unencrypted private key in PEM format
+        --cert-validity
+                How long the X.509 certificate is valid (Default: 8760h)
         --pk    Filename to read Secure Boot PK from (.auth format), must be self-signed
         --kek   Filename to read Secure Boot KEK from (.auth format), must be signed by PK
         --db    Filename to read Secure Boot db from (.auth format), must be signed by KEK
         --dbx   Filename to read Secure Boot dbx from (.auth format), must be signed by KEK
     -n, --no-uefi-menu-reboot
                 Don't request the firmware to reboot into UEFI menu
+
+
+  stprov local batch -f FILE [-j JOBS] [--output FILE] [-p PORT]
+        [--pk FILENAME --kek FILENAME --db FILENAME [--dbx FILENAME] [-n]]
+
+    Like stprov local run, but provisions many platforms concurrently.  Each
+    line in the hosts file (-f) is on the CSV format "IP_ADDR,PORT,OTP", where
+    an empty PORT defaults to -p.  Lines starting with '#' are ignored, and so
+    is an initial header line that starts with "ip".  Secure Boot keys (if any)
+    are provisioned on all platforms.
+
+    A table with one row per platform is output on stdout, including the short
+    authentication string to compare with each stprov remote.  The short
+    authentication string and entropy of each platform are also logged as soon
+    as it is committed, e.g., for "stprov remote run --confirm hex:N".  Fails
+    if any platform fails to be provisioned.
+
+  Options:
+
+    -f, --file    Hosts file to read remotes from
+    -j, --jobs    Number of platforms to provision concurrently (Default: 4)
+        --output  File to write all results to, in CSV format with the columns
+                  ip, port, status, hostname, sas, entropy, fingerprint,
+                  publickey, and error
+    -p, --port    Remote stprov port if not in the hosts file (Default: 2009)
+        --pk      Filename to read Secure Boot PK from (.auth format), must be self-signed
+        --kek     Filename to read Secure Boot KEK from (.auth format), must be signed by PK
+        --db      Filename to read Secure Boot db from (.auth format), must be signed by KEK
+        --dbx     Filename to read Secure Boot dbx from (.auth format), must be signed by KEK
+    -n, --no-uefi-menu-reboot
+                  Don't request the firmware to reboot into UEFI menu
+
+
+  stprov local abort -o OTP -i IP_ADDR [-p PORT]
+
+    Stops stprov remote without a commit, i.e., no SSH hostkey or host
+    certificate is written.  Secure Boot keys that were already provisioned are
+    not removed.  The state that stprov remote was in is output on stdout as
+    "state=<state>".
+
+  Options:
+
+    -o, --otp   One-time password to establish a secure connection
+    -i, --ip    Remote stprov address (e.g., 10.0.2.10)
+    -p, --port  Remote stprov port (Default: 2009)
 `
 
 var (
 	optPort                                      int
 	optIP, optOTP                                string
+	optFile, optOutput, optFormat                string
+	optJobs                                      int
 	optPKFile, optKEKFile, optDBFile, optDBXFile string
 	optNoUefiMenuReboot                          bool
+	optKnownHosts                                string
+	optHashKnownHosts, optReplace                bool
+	optHostCA                                    string
+	optHostCertValidity                          time.Duration
+	optHostKeyPassphraseFile, optHostKeyType     string
+	optDerive                                    string
+	optCA, optCAKey                              string
+	optCertValidity                              time.Duration
 )
 
 func setOptions(fs *flag.FlagSet) {
@@ -57,15 +185,42 @@ func setOptions(fs *flag.FlagSet) {
 		options.AddInt(fs, &optPort, "p", "port", 2009)
 		options.AddString(fs, &optIP, "i", "ip", "")
 		options.AddString(fs, &optOTP, "o", "otp", "")
-		// Secure Boot options
-		options.AddBool(fs, &optNoUefiMenuReboot, "n", "no-uefi-menu-reboot", false)
-		fs.StringVar(&optPKFile, "pk", "", "")
-		fs.StringVar(&optKEKFile, "kek", "", "")
-		fs.StringVar(&optDBFile, "db", "", "")
-		fs.StringVar(&optDBXFile, "dbx", "", "")
+		fs.StringVar(&optFormat, "format", run.FormatText, "")
+		fs.StringVar(&optKnownHosts, "known-hosts", "", "")
+		fs.BoolVar(&optHashKnownHosts, "hash-known-hosts", false, "")
+		fs.BoolVar(&optReplace, "replace", false, "")
+		fs.StringVar(&optHostCA, "host-ca", "", "")
+		fs.DurationVar(&optHostCertValidity, "host-cert-validity", 365*24*time.Hour, "")
+		fs.StringVar(&optHostKeyPassphraseFile, "host-key-passphrase-file", "", "")
+		fs.StringVar(&optHostKeyType, "host-key-type", ssh.DefaultKeyType, "")
+		fs.StringVar(&optDerive, "derive", "", "")
+		fs.StringVar(&optCA, "ca", "", "")
+		fs.StringVar(&optCAKey, "ca-key", "", "")
+		fs.DurationVar(&optCertValidity, "cert-validity", 365*24*time.Hour, "")
+		secureBoot(fs)
+	case "batch":
+		// Connection options
+		options.AddString(fs, &optFile, "f", "file", "")
+		options.AddInt(fs, &optJobs, "j", "jobs", 4)
+		options.AddInt(fs, &optPort, "p", "port", 2009)
+		fs.StringVar(&optOutput, "output", "", "")
+		secureBoot(fs)
+	case "abort":
+		options.AddInt(fs, &optPort, "p", "port", 2009)
+		options.AddString(fs, &optIP, "i", "ip", "")
+		options.AddString(fs, &optOTP, "o", "otp", "")
 	}
 }
 
+// secureBoot adds options relating to Secure Boot
+func secureBoot(fs *flag.FlagSet) {
+	options.AddBool(fs, &optNoUefiMenuReboot, "n", "no-uefi-menu-reboot", false)
+	fs.StringVar(&optPKFile, "pk", "", "")
+	fs.StringVar(&optKEKFile, "kek", "", "")
+	fs.StringVar(&optDBFile, "db", "", "")
+	fs.StringVar(&optDBXFile, "dbx", "", "")
+}
+
 func Main(args []string) error {
 	var err error
 
@@ -75,7 +230,38 @@ func Main(args []string) error {
 	case "help", "":
 		opt.Usage()
 	case "run":
-		err = run.Main(opt.Args(), optPort, optIP, optOTP, optPKFile, optKEKFile, optDBFile, optDBXFile, optNoUefiMenuReboot)
+		err = run.Main(opt.Args(), &run.Options{
+			Format:                optFormat,
+			Port:                  optPort,
+			IP:                    optIP,
+			OTP:                   optOTP,
+			PKFile:                optPKFile,
+			KEKFile:               optKEKFile,
+			DBFile:                optDBFile,
+			DBXFile:               optDBXFile,
+			NoUEFIMenuReboot:      optNoUefiMenuReboot,
+			KnownHosts:            optKnownHosts,
+			HashKnownHosts:        optHashKnownHosts,
+			Replace:               optReplace,
+			HostCA:                optHostCA,
+			HostCertValidity:      optHostCertValidity,
+			HostKeyType:           optHostKeyType,
+			HostKeyPassphraseFile: optHostKeyPassphraseFile,
+			Derive:                optDerive,
+			CA:                    optCA,
+			CAKey:                 optCAKey,
+			CertValidity:          optCertValidity,
+		})
+		if err == nil {
+			stlog.Info("command local %q succeeded", opt.Name())
+		}
+	case "batch":
+		err = batch.Main(opt.Args(), optFile, optJobs, optOutput, optPort, optPKFile, optKEKFile, optDBFile, optDBXFile, optNoUefiMenuReboot)
+		if err == nil {
+			stlog.Info("command local %q succeeded", opt.Name())
+		}
+	case "abort":
+		err = abort.Main(opt.Args(), optPort, optIP, optOTP)
 		if err == nil {
 			stlog.Info("command local %q succeeded", opt.Name())
 		}
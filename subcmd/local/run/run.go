@@ -1,37 +1,254 @@
 package run
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"strings"
+	"time"
 
 	"system-transparency.org/stprov/internal/api"
 	"system-transparency.org/stprov/internal/hexify"
+	"system-transparency.org/stprov/internal/pki"
+	"system-transparency.org/stprov/internal/ssh"
 )
 
-func Main(args []string, optPort int, optIP, optOTP, optPKFile, optKEKFile, optDBFile, optDBXFile string, optNoUEFIMenuReboot bool) error {
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Output is the machine-readable result of provisioning a platform
+type Output struct {
+	api.CommitResponse
+	IP         string            `json:"ip"`
+	Port       int               `json:"port"`
+	Entropy    string            `json:"entropy"`               // hex-encoded entropy added by stprov local
+	SAS        string            `json:"sas"`                   // short authentication string shown by stprov remote
+	SecureBoot *SecureBootHashes `json:"secure_boot,omitempty"` // nil if no Secure Boot keys were provisioned
+	HostCert   string            `json:"host_cert,omitempty"`   // SSH host certificate, if signed
+	X509Cert   string            `json:"x509_cert,omitempty"`   // X.509 identity certificate in PEM format, if signed
+	Timestamp  string            `json:"timestamp"`             // RFC 3339, UTC
+}
+
+// SecureBootHashes are hex-encoded SHA256 hashes of the provisioned Secure Boot
+// files.  The hash of an omitted file is empty.
+type SecureBootHashes struct {
+	PK  string `json:"pk"`
+	KEK string `json:"kek"`
+	DB  string `json:"db"`
+	DBX string `json:"dbx"`
+}
+
+// Result is the outcome of provisioning a single platform
+type Result struct {
+	Data     *api.AddDataRequest
+	Commit   *api.CommitResponse
+	HostCert string // SSH host certificate in authorized_keys format, if any
+	X509Cert string // X.509 identity certificate in PEM format, if any
+	SAS      string // short authentication string, see api.ShortAuthString()
+}
+
+// Options are the options of stprov local run
+type Options struct {
+	Format string // FormatText or FormatJSON
+	Port   int    // remote port
+	IP     string // remote IP address
+	OTP    string // one-time password
+
+	// Secure Boot files in .auth format, see ReadSecureBootKeys()
+	PKFile, KEKFile, DBFile, DBXFile string
+	NoUEFIMenuReboot                 bool
+
+	KnownHosts     string // known_hosts file to pin the SSH host key in, if any
+	HashKnownHosts bool   // hash hostnames and addresses in KnownHosts
+	Replace        bool   // replace keys that are already pinned in KnownHosts
+
+	HostCA           string        // SSH CA private key file, if any
+	HostCertValidity time.Duration // how long a host certificate is valid
+
+	HostKeyType           string // see ssh.KeyTypes
+	HostKeyPassphraseFile string // passphrase to encrypt the SSH host key with, if any
+	Derive                string // comma-separated names of keys to derive, see ParseDerive()
+
+	CA, CAKey    string        // X.509 CA certificate and private key files, if any
+	CertValidity time.Duration // how long an X.509 certificate is valid
+}
+
+func Main(args []string, opts *Options) error {
 	// Parse options relating to secure connection
 	if len(args) != 0 {
 		return fmt.Errorf("trailing arguments: %v", args)
 	}
-	if len(optIP) == 0 {
+	if opts.Format != FormatText && opts.Format != FormatJSON {
+		return fmt.Errorf("format: must be %q or %q", FormatText, FormatJSON)
+	}
+	if len(opts.IP) == 0 {
 		return fmt.Errorf("ip address is a required option")
 	}
-	if len(optOTP) == 0 {
+	if len(opts.OTP) == 0 {
 		return fmt.Errorf("one-time password is a required option")
 	}
-	ip := net.ParseIP(optIP)
+	ip := net.ParseIP(opts.IP)
 	if ip == nil {
-		return fmt.Errorf("malformed ip address: %s", optIP)
+		return fmt.Errorf("malformed ip address: %s", opts.IP)
 	}
-	port := optPort
+	port := opts.Port
 	if port < 1 || port > 65535 {
-		return fmt.Errorf("invalid port: %d not in [0, 65535]", optPort)
+		return fmt.Errorf("invalid port: %d not in [0, 65535]", opts.Port)
+	}
+	otp := opts.OTP
+	if (opts.HashKnownHosts || opts.Replace) && len(opts.KnownHosts) == 0 {
+		return fmt.Errorf("--hash-known-hosts and --replace require --known-hosts")
 	}
-	otp := optOTP
 
 	// Parse options relating to Secure Boot
+	cfg := api.ClientConfig{
+		Secret:             otp,
+		RemoteIP:           ip,
+		RemotePort:         port,
+		RebootIntoUEFIMenu: !opts.NoUEFIMenuReboot,
+	}
+	if err := ReadSecureBootKeys(&cfg, opts.PKFile, opts.KEKFile, opts.DBFile, opts.DBXFile); err != nil {
+		return err
+	}
+
+	// Parse options relating to SSH host certificates
+	var ca *ssh.HostCA
+	if len(opts.HostCA) > 0 {
+		var err error
+		if ca, err = ssh.ReadHostCA(opts.HostCA, opts.HostCertValidity); err != nil {
+			return fmt.Errorf("host ca: %w", err)
+		}
+		cfg.HostCert = true
+	}
+
+	// Parse options relating to X.509 identity certificates
+	var x509CA *pki.CA
+	if len(opts.CA) > 0 || len(opts.CAKey) > 0 {
+		if len(opts.CA) == 0 || len(opts.CAKey) == 0 {
+			return fmt.Errorf("--ca and --ca-key must be used together")
+		}
+		var err error
+		if x509CA, err = pki.ReadCA(opts.CA, opts.CAKey, opts.CertValidity); err != nil {
+			return fmt.Errorf("ca: %w", err)
+		}
+		cfg.X509Cert = true
+	}
+
+	// Parse options relating to the SSH host key
+	if err := api.CheckHostKeyType(opts.HostKeyType); err != nil {
+		return fmt.Errorf("host key type: %w", err)
+	}
+	cfg.HostKeyType = opts.HostKeyType
+	if len(opts.HostKeyPassphraseFile) > 0 {
+		var err error
+		if cfg.HostKeyPassphrase, err = ReadPassphrase(opts.HostKeyPassphraseFile); err != nil {
+			return fmt.Errorf("host key passphrase: %w", err)
+		}
+	}
+
+	// Parse options relating to additional derived keys
+	derive, err := ParseDerive(opts.Derive)
+	if err != nil {
+		return fmt.Errorf("derive: %w", err)
+	}
+	cfg.Derive = derive
+
+	// Perform local-remote ping pongs
+	res, err := Provision(&cfg, ca, x509CA)
+	if err != nil {
+		return err
+	}
+	cr := res.Commit
+
+	log.Printf("added entropy\n\n%s\n", hexify.Format(res.Data.Entropy))
+	log.Printf("short authentication string: %s", res.SAS)
+	// Output before pinning in known_hosts, since the platform is already
+	// provisioned if the known_hosts file cannot be updated
+	if err := writeOutput(os.Stdout, opts.Format, &cfg, res); err != nil {
+		return err
+	}
+	if len(opts.KnownHosts) > 0 {
+		addrs := []string{opts.IP}
+		if len(cr.HostName) > 0 {
+			addrs = []string{cr.HostName, opts.IP}
+		}
+		if err := ssh.WriteKnownHost(opts.KnownHosts, addrs, cr.PublicKey, opts.HashKnownHosts, opts.Replace); err != nil {
+			return fmt.Errorf("known hosts: %w", err)
+		}
+		log.Printf("added %s to %s\n", strings.Join(addrs, ","), opts.KnownHosts)
+	}
+	return nil
+}
+
+// writeOutput writes the result of provisioning a platform in a given format
+func writeOutput(w io.Writer, format string, cfg *api.ClientConfig, res *Result) error {
+	if format == FormatJSON {
+		b, err := json.MarshalIndent(NewOutput(cfg, res, time.Now()), "", "  ")
+		if err != nil {
+			return fmt.Errorf("marshal: %w", err)
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	}
+
+	cr := res.Commit
+	var b strings.Builder
+	fmt.Fprintf(&b, "publickey=%s\n", cr.PublicKey)
+	fmt.Fprintf(&b, "fingerprint=%s\n", cr.Fingerprint)
+	fmt.Fprintf(&b, "hostname=%s\n", cr.HostName)
+	fmt.Fprintf(&b, "ip=%s\n", cfg.RemoteIP)
+	if len(res.HostCert) > 0 {
+		fmt.Fprintf(&b, "hostcert=%s\n", res.HostCert)
+	}
+	if len(res.X509Cert) > 0 {
+		cert, err := pki.ParseCertificate([]byte(res.X509Cert))
+		if err != nil {
+			return fmt.Errorf("x509 certificate: %w", err)
+		}
+		fmt.Fprintf(&b, "x509cert=%s\n", base64.StdEncoding.EncodeToString(cert.Raw))
+	}
+	for _, name := range cfg.Derive {
+		fmt.Fprintf(&b, "derived_%s=%s\n", name, cr.DerivedKeys[name])
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// NewOutput collects the result of provisioning a platform
+func NewOutput(cfg *api.ClientConfig, res *Result, now time.Time) *Output {
+	out := Output{
+		CommitResponse: *res.Commit,
+		IP:             cfg.RemoteIP.String(),
+		Port:           cfg.RemotePort,
+		Entropy:        hex.EncodeToString(res.Data.Entropy),
+		SAS:            res.SAS,
+		HostCert:       res.HostCert,
+		X509Cert:       res.X509Cert,
+		Timestamp:      now.UTC().Format(time.RFC3339),
+	}
+	if cfg.PK != nil {
+		out.SecureBoot = &SecureBootHashes{
+			PK:  hash(cfg.PK),
+			KEK: hash(cfg.KEK),
+			DB:  hash(cfg.DB),
+			DBX: hash(cfg.DBX),
+		}
+	}
+	return &out
+}
+
+// ReadSecureBootKeys reads optional Secure Boot keys into a client
+// configuration.  Either no keys or at least PK, KEK, and db must be provided.
+func ReadSecureBootKeys(cfg *api.ClientConfig, optPKFile, optKEKFile, optDBFile, optDBXFile string) error {
 	pk, err := readOptionalFile(optPKFile)
 	if err != nil {
 		return fmt.Errorf("invalid Secure Boot PK: %w", err)
@@ -54,41 +271,96 @@ func Main(args []string, optPort int, optIP, optOTP, optPKFile, optKEKFile, optD
 		return fmt.Errorf("invalid Secure Boot options: PK, KEK, and db are required")
 	}
 
-	// Perform local-remote ping pongs
-	cli, err := api.NewClient(&api.ClientConfig{
-		Secret:             otp,
-		RemoteIP:           ip,
-		RemotePort:         port,
-		PK:                 pk,
-		KEK:                kek,
-		DB:                 db,
-		DBX:                dbx,
-		RebootIntoUEFIMenu: !optNoUEFIMenuReboot,
-	})
+	cfg.PK, cfg.KEK, cfg.DB, cfg.DBX = pk, kek, db, dbx
+	return nil
+}
+
+// Provision runs the add-data, add-secure-boot (if Secure Boot keys are
+// configured), and commit sequence against a single stprov remote.  If a host
+// CA is given, the platform's SSH hostkey is also signed and sent back as a
+// host certificate.  The principals are the platform's hostname and IP address.
+// Similarly, if an X.509 CA is given, the platform's certificate signing request
+// is signed with the hostname and IP address as subject alternative names.
+func Provision(cfg *api.ClientConfig, ca *ssh.HostCA, x509CA *pki.CA) (*Result, error) {
+	cli, err := api.NewClient(cfg)
 	if err != nil {
-		return fmt.Errorf("new client: %w", err)
+		return nil, fmt.Errorf("new client: %w", err)
 	}
 	data, err := cli.AddData()
 	if err != nil {
-		return fmt.Errorf("add data: %w", err)
+		return nil, fmt.Errorf("add data: %w", err)
 	}
-	if haveSBOpts {
+	if cfg.PK != nil {
 		err = cli.AddSecureBootKeys()
 		if err != nil {
-			return fmt.Errorf("add Secure Boot keys: %w", err)
+			return nil, fmt.Errorf("add Secure Boot keys: %w", err)
 		}
 	}
 	cr, err := cli.Commit()
 	if err != nil {
-		return fmt.Errorf("commit: %w", err)
+		return nil, fmt.Errorf("commit: %w", err)
 	}
+	for _, name := range cfg.Derive {
+		if _, ok := cr.DerivedKeys[name]; !ok {
+			return nil, fmt.Errorf("commit: missing derived key %q", name)
+		}
+	}
+	res := &Result{Data: data, Commit: cr, SAS: cli.SAS()}
+	if ca != nil {
+		principals := []string{cfg.RemoteIP.String()}
+		if len(cr.HostName) > 0 {
+			principals = []string{cr.HostName, cfg.RemoteIP.String()}
+		}
+		if res.HostCert, err = ca.Sign(cr.PublicKey, principals, time.Now()); err != nil {
+			return nil, fmt.Errorf("sign host certificate: %w", err)
+		}
+		if err := cli.AddHostCert(res.HostCert); err != nil {
+			return nil, fmt.Errorf("add host certificate: %w", err)
+		}
+	}
+	if x509CA != nil {
+		if res.X509Cert, err = x509CA.Sign(cr.CSR, cr.HostName, cfg.RemoteIP, time.Now()); err != nil {
+			return nil, fmt.Errorf("sign x509 certificate: %w", err)
+		}
+		if err := cli.AddX509Cert(res.X509Cert); err != nil {
+			return nil, fmt.Errorf("add x509 certificate: %w", err)
+		}
+	}
+	return res, nil
+}
 
-	log.Printf("added entropy\n\n%s\n", hexify.Format(data.Entropy))
-	fmt.Printf("publickey=%s\n", cr.PublicKey)
-	fmt.Printf("fingerprint=%s\n", cr.Fingerprint)
-	fmt.Printf("hostname=%s\n", cr.HostName)
-	fmt.Printf("ip=%s\n", optIP)
-	return nil
+// ParseDerive parses a comma-separated list of named keys to derive, see
+// secrets.Derivations.  The empty string means no keys.
+func ParseDerive(s string) ([]string, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		names = append(names, strings.TrimSpace(name))
+	}
+	if err := api.CheckDerivations(names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// ReadPassphrase reads a passphrase from a file.  A trailing newline is not
+// part of the passphrase.
+func ReadPassphrase(filename string) ([]byte, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimSuffix(b, []byte("\n"))
+	b = bytes.TrimSuffix(b, []byte("\r"))
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty passphrase in %s", filename)
+	}
+	if len(b) > api.MaxHostKeyPassphraseSize {
+		return nil, fmt.Errorf("passphrase in %s is longer than %d bytes", filename, api.MaxHostKeyPassphraseSize)
+	}
+	return b, nil
 }
 
 func readOptionalFile(filename string) ([]byte, error) {
@@ -101,3 +373,11 @@ func readOptionalFile(filename string) ([]byte, error) {
 	}
 	return b, nil
 }
+
+func hash(b []byte) string {
+	if b == nil {
+		return ""
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
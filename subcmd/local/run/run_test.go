@@ -0,0 +1,153 @@
+package run
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"system-transparency.org/stprov/internal/api"
+)
+
+func TestNewOutput(t *testing.T) {
+	cfg := api.ClientConfig{
+		RemoteIP:   net.ParseIP("10.0.2.10"),
+		RemotePort: 2009,
+		PK:         []byte("pk"),
+		KEK:        []byte("kek"),
+		DB:         []byte("db"),
+	}
+	data := api.AddDataRequest{Entropy: []byte{0xde, 0xad}}
+	cr := api.CommitResponse{HostName: "st.example.org", Authentication: "auth", Identity: "id"}
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("", 3600))
+
+	b, err := json.Marshal(NewOutput(&cfg, &Result{Data: &data, Commit: &cr, SAS: "acid acorn actor adult agent alarm", X509Cert: "cert"}, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]any{
+		"hostname":       "st.example.org",
+		"authentication": "auth",
+		"identity":       "id",
+		"ip":             "10.0.2.10",
+		"port":           2009.0,
+		"entropy":        "dead",
+		"sas":            "acid acorn actor adult agent alarm",
+		"timestamp":      "2024-01-02T02:04:05Z",
+		"x509_cert":      "cert",
+	} {
+		if got[key] != want {
+			t.Errorf("%s: got %v, want %v", key, got[key], want)
+		}
+	}
+
+	sb, ok := got["secure_boot"].(map[string]any)
+	if !ok {
+		t.Fatalf("secure_boot: missing in %s", b)
+	}
+	if got, want := sb["pk"], "eb3102a6cb586765d01fad324523ec0bc67b9efd6a2d9589c135adfedf7922cc"; got != want {
+		t.Errorf("pk: got %v, want %v", got, want)
+	}
+	if got := sb["dbx"]; got != "" {
+		t.Errorf("dbx: got %v, want empty", got)
+	}
+}
+
+func TestWriteOutput(t *testing.T) {
+	cfg := api.ClientConfig{RemoteIP: net.ParseIP("10.0.2.10"), Derive: []string{"age"}}
+	cr := api.CommitResponse{PublicKey: "ssh-ed25519 AAAA", Fingerprint: "SHA256:abc", HostName: "st.example.org", DerivedKeys: map[string]string{"age": "age1xyz"}}
+	res := Result{Data: &api.AddDataRequest{}, Commit: &cr, HostCert: "cert"}
+
+	var buf bytes.Buffer
+	if err := writeOutput(&buf, FormatText, &cfg, &res); err != nil {
+		t.Fatal(err)
+	}
+	want := "publickey=ssh-ed25519 AAAA\nfingerprint=SHA256:abc\nhostname=st.example.org\nip=10.0.2.10\nhostcert=cert\nderived_age=age1xyz\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nbut wanted\n%s", got, want)
+	}
+
+	buf.Reset()
+	if err := writeOutput(&buf, FormatJSON, &cfg, &res); err != nil {
+		t.Fatal(err)
+	}
+	var out Output
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatalf("unmarshal json output: %v", err)
+	}
+	if got, want := out.Fingerprint, cr.Fingerprint; got != want {
+		t.Errorf("json: got fingerprint %q but wanted %q", got, want)
+	}
+
+	res.X509Cert = "not a certificate"
+	if err := writeOutput(&buf, FormatText, &cfg, &res); err == nil {
+		t.Errorf("wrote malformed x509 certificate")
+	}
+}
+
+func TestReadPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	for _, table := range []struct {
+		desc    string
+		content string
+		want    string // empty if an error is expected
+	}{
+		{"invalid: empty", "", ""},
+		{"invalid: only newline", "\n", ""},
+		{"invalid: too long", strings.Repeat("a", api.MaxHostKeyPassphraseSize+1), ""},
+		{"valid: no newline", "secret", "secret"},
+		{"valid: newline", "secret\n", "secret"},
+		{"valid: crlf", "secret\r\n", "secret"},
+		{"valid: inner whitespace", " se cret \n", " se cret "},
+	} {
+		filename := filepath.Join(dir, "passphrase")
+		if err := os.WriteFile(filename, []byte(table.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ReadPassphrase(filename)
+		if got, want := err != nil, table.want == ""; got != want {
+			t.Errorf("%s: got error %v but wanted %v: %v", table.desc, got, want, err)
+			continue
+		}
+		if got, want := string(b), table.want; err == nil && got != want {
+			t.Errorf("%s: got passphrase %q but wanted %q", table.desc, got, want)
+		}
+	}
+	if _, err := ReadPassphrase(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("read passphrase from a missing file")
+	}
+}
+
+func TestParseDerive(t *testing.T) {
+	for _, table := range []struct {
+		desc    string
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"valid: empty", "", nil, false},
+		{"valid: one", "wireguard", []string{"wireguard"}, false},
+		{"valid: several", "age, tls-client,wireguard", []string{"age", "tls-client", "wireguard"}, false},
+		{"invalid: unknown", "wireguard,ssh", nil, true},
+		{"invalid: repeated", "age,age", nil, true},
+		{"invalid: trailing comma", "age,", nil, true},
+	} {
+		names, err := ParseDerive(table.in)
+		if got, want := err != nil, table.wantErr; got != want {
+			t.Errorf("%s: got error %v but wanted %v: %v", table.desc, got, want, err)
+			continue
+		}
+		if got, want := names, table.want; err == nil && !slices.Equal(got, want) {
+			t.Errorf("%s: got %v but wanted %v", table.desc, got, want)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package apply
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+
+	"system-transparency.org/stprov/internal/options"
+)
+
+const (
+	ModeStatic = "static"
+	ModeDHCP   = "dhcp"
+
+	PrefixISO = "iso:" // reads a file from the provisioning ISO, e.g., "iso:/stprov.yaml"
+
+	maxFileSize = 1 << 20
+)
+
+// File is a declarative provisioning file.  Each key is the long name of the
+// corresponding "stprov remote static" or "stprov remote dhcp" option, and
+// omitted keys get the same default values as the options.
+type File struct {
+	Mode string `json:"mode" yaml:"mode"` // "static" or "dhcp"
+
+	IP             string   `json:"ip,omitempty" yaml:"ip,omitempty"`
+	Gateway        string   `json:"gateway,omitempty" yaml:"gateway,omitempty"`
+	TryLastGateway bool     `json:"try-last-gateway,omitempty" yaml:"try-last-gateway,omitempty"`
+	DNS            []string `json:"dns,omitempty" yaml:"dns,omitempty"`
+	MAC            string   `json:"mac,omitempty" yaml:"mac,omitempty"`
+	Interface      string   `json:"interface,omitempty" yaml:"interface,omitempty"`
+	Autodetect     bool     `json:"autodetect,omitempty" yaml:"autodetect,omitempty"`
+	Bonding        []string `json:"bonding,omitempty" yaml:"bonding,omitempty"`
+	BondingAuto    bool     `json:"bonding-auto,omitempty" yaml:"bonding-auto,omitempty"`
+	BondingMode    string   `json:"bonding-mode,omitempty" yaml:"bonding-mode,omitempty"`
+	Wait           string   `json:"wait,omitempty" yaml:"wait,omitempty"`
+	URL            []string `json:"url,omitempty" yaml:"url,omitempty"`
+	User           string   `json:"user,omitempty" yaml:"user,omitempty"`
+	Pass           string   `json:"pass,omitempty" yaml:"pass,omitempty"`
+	Host           string   `json:"host,omitempty" yaml:"host,omitempty"`
+	FullHost       string   `json:"full-host,omitempty" yaml:"full-host,omitempty"`
+	Force          bool     `json:"force,omitempty" yaml:"force,omitempty"`
+}
+
+// Load reads a provisioning file from a local path, an HTTP(S) URL, or the
+// provisioning ISO ("iso:PATH").  The ISO is mounted read-only from isoDevice
+// while the file is read.  The file is parsed as JSON if it starts with '{',
+// and as YAML otherwise.  Unknown keys are rejected.
+func Load(src string, client *http.Client, isoDevice string) (*File, error) {
+	b, err := read(src, client, isoDevice)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", src, err)
+	}
+	f, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", src, err)
+	}
+	return f, nil
+}
+
+// Parse parses and validates a provisioning file in JSON or YAML format
+func Parse(b []byte) (*File, error) {
+	var f File
+	if err := decode(b, &f); err != nil {
+		return nil, err
+	}
+	return &f, f.Check()
+}
+
+// Check checks that the provisioning file is consistent.  Static host and
+// gateway addresses are validated as by "stprov remote static".
+func (f *File) Check() error {
+	if f.Host != "" && f.FullHost != "" {
+		return fmt.Errorf("host and full-host are mutually exclusive")
+	}
+	switch f.Mode {
+	case ModeStatic:
+		ip := options.DecodeSafeCIDR(f.IP)
+		gw := options.DecodeSafeCIDR(f.Gateway)
+		if _, err := options.ValidateHostAndGateway(ip, gw, f.Force, f.TryLastGateway); err != nil {
+			return err
+		}
+	case ModeDHCP:
+		for key, set := range map[string]bool{
+			"ip":               f.IP != "",
+			"gateway":          f.Gateway != "",
+			"try-last-gateway": f.TryLastGateway,
+			"autodetect":       f.Autodetect,
+			"bonding":          len(f.Bonding) > 0,
+			"bonding-auto":     f.BondingAuto,
+			"bonding-mode":     f.BondingMode != "",
+		} {
+			if set {
+				return fmt.Errorf("%s: not supported with mode %q", key, ModeDHCP)
+			}
+		}
+	default:
+		return fmt.Errorf("mode: must be %q or %q", ModeStatic, ModeDHCP)
+	}
+	return nil
+}
+
+// Args outputs the provisioning file as arguments to "stprov remote", i.e.,
+// the subcommand followed by its options
+func (f *File) Args() []string {
+	args := []string{f.Mode}
+	str := func(name, value string) {
+		if value != "" {
+			args = append(args, "--"+name, value)
+		}
+	}
+	strs := func(name string, values []string) {
+		for _, value := range values {
+			str(name, value)
+		}
+	}
+	boolean := func(name string, value bool) {
+		if value {
+			args = append(args, "--"+name)
+		}
+	}
+
+	str("ip", f.IP)
+	str("gateway", f.Gateway)
+	boolean("try-last-gateway", f.TryLastGateway)
+	strs("dns", f.DNS)
+	str("mac", f.MAC)
+	str("interface", f.Interface)
+	boolean("autodetect", f.Autodetect)
+	strs("bonding", f.Bonding)
+	boolean("bonding-auto", f.BondingAuto)
+	str("bonding-mode", f.BondingMode)
+	str("wait", f.Wait)
+	strs("url", f.URL)
+	str("user", f.User)
+	str("pass", f.Pass)
+	str("host", f.Host)
+	str("full-host", f.FullHost)
+	boolean("force", f.Force)
+	return args
+}
+
+// decode decodes JSON if b starts with '{', and YAML otherwise.  Unknown keys
+// are rejected.
+func decode(b []byte, v any) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(v); err != nil {
+			return fmt.Errorf("json: %w", err)
+		}
+		return nil
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("yaml: %w", err)
+	}
+	return nil
+}
+
+func read(src string, client *http.Client, isoDevice string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://"):
+		rsp, err := client.Get(src)
+		if err != nil {
+			return nil, err
+		}
+		defer rsp.Body.Close()
+		if rsp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("GET returned status: %q", rsp.Status)
+		}
+		return readAll(rsp.Body)
+	case strings.HasPrefix(src, PrefixISO):
+		return readISO(isoDevice, strings.TrimPrefix(src, PrefixISO))
+	default:
+		fp, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		defer fp.Close()
+		return readAll(fp)
+	}
+}
+
+// readISO mounts an ISO 9660 file system read-only, reading a single file
+func readISO(device, path string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "stprov-iso-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dir)
+
+	if err := unix.Mount(device, dir, "iso9660", unix.MS_RDONLY, ""); err != nil {
+		return nil, fmt.Errorf("mount %s: %w", device, err)
+	}
+	defer unix.Unmount(dir, 0)
+
+	fp, err := os.Open(filepath.Join(dir, filepath.Clean("/"+path)))
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return readAll(fp)
+}
+
+func readAll(r io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, maxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxFileSize {
+		return nil, fmt.Errorf("file is larger than %d bytes", maxFileSize)
+	}
+	return b, nil
+}
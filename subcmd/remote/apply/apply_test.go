@@ -0,0 +1,110 @@
+package apply
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testYAML = `
+mode: static
+ip: 10.0.2.10m26
+full-host: host.example.org
+dns: [9.9.9.9]
+url:
+  - https://ospkg-01.example.org/os.json
+  - https://ospkg-02.example.org/os.json
+bonding: [eth0, eth1]
+`
+
+const testJSON = `{
+  "mode": "dhcp",
+  "host": "st",
+  "interface": "eth0",
+  "force": true
+}`
+
+func TestParse(t *testing.T) {
+	for _, table := range []struct {
+		desc string
+		in   string
+		want []string
+	}{
+		{"invalid: no mode", `ip: 10.0.2.10/26`, nil},
+		{"invalid: unknown mode", `mode: auto`, nil},
+		{"invalid: unknown key", "mode: dhcp\nhostname: st", nil},
+		{"invalid: unknown json key", `{"mode":"dhcp","hostname":"st"}`, nil},
+		{"invalid: static without ip", `mode: static`, nil},
+		{"invalid: static gateway outside network", "mode: static\nip: 10.0.2.10/26\ngateway: 10.0.3.1", nil},
+		{"invalid: dhcp with ip", "mode: dhcp\nip: 10.0.2.10/26", nil},
+		{"invalid: host and full-host", "mode: dhcp\nhost: st\nfull-host: st.example.org", nil},
+		{"valid: yaml", testYAML, []string{
+			"static",
+			"--ip", "10.0.2.10m26",
+			"--dns", "9.9.9.9",
+			"--bonding", "eth0", "--bonding", "eth1",
+			"--url", "https://ospkg-01.example.org/os.json",
+			"--url", "https://ospkg-02.example.org/os.json",
+			"--full-host", "host.example.org",
+		}},
+		{"valid: json", testJSON, []string{
+			"dhcp",
+			"--interface", "eth0",
+			"--host", "st",
+			"--force",
+		}},
+	} {
+		f, err := Parse([]byte(table.in))
+		if got, want := err != nil, table.want == nil; got != want {
+			t.Errorf("%s: got error %v but wanted %v: %v", table.desc, got, want, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got, want := f.Args(), table.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got args\n\t%v\nbut wanted\n\t%v", table.desc, got, want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stprov.yaml")
+	if err := os.WriteFile(path, []byte(testYAML), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stprov.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(testJSON))
+	}))
+	defer srv.Close()
+
+	for _, table := range []struct {
+		desc     string
+		src      string
+		wantMode string
+	}{
+		{"invalid: no such file", path + ".missing", ""},
+		{"invalid: not found", srv.URL + "/missing.json", ""},
+		{"valid: file", path, ModeStatic},
+		{"valid: http", srv.URL + "/stprov.json", ModeDHCP},
+	} {
+		f, err := Load(table.src, srv.Client(), "/dev/null")
+		if got, want := err != nil, table.wantMode == ""; got != want {
+			t.Errorf("%s: got error %v but wanted %v: %v", table.desc, got, want, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got, want := f.Mode, table.wantMode; got != want {
+			t.Errorf("%s: got mode %q, want %q", table.desc, got, want)
+		}
+	}
+}
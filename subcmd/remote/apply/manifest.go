@@ -0,0 +1,127 @@
+package apply
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// DMISerialFile is where Linux exposes the DMI system serial number
+const DMISerialFile = "/sys/class/dmi/id/product_serial"
+
+// Manifest lists provisioning files for many hosts
+type Manifest struct {
+	Hosts []Host `json:"hosts" yaml:"hosts"`
+}
+
+// Host is a provisioning file that applies to the platform(s) it matches
+type Host struct {
+	Match Match `json:"match" yaml:"match"`
+	File  `yaml:",inline"`
+}
+
+// Match identifies a platform by any of its MAC addresses, or by its DMI
+// system serial number
+type Match struct {
+	MAC    []string `json:"mac,omitempty" yaml:"mac,omitempty"`
+	Serial string   `json:"serial,omitempty" yaml:"serial,omitempty"`
+}
+
+// LoadManifest reads a manifest from the same sources as Load
+func LoadManifest(src string, client *http.Client, isoDevice string) (*Manifest, error) {
+	b, err := read(src, client, isoDevice)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", src, err)
+	}
+	m, err := ParseManifest(b)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", src, err)
+	}
+	return m, nil
+}
+
+// ParseManifest parses and validates a manifest in JSON or YAML format
+func ParseManifest(b []byte) (*Manifest, error) {
+	var m Manifest
+	if err := decode(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, m.Check()
+}
+
+// Check checks that every host has a matcher and a consistent provisioning file
+func (m *Manifest) Check() error {
+	if len(m.Hosts) == 0 {
+		return fmt.Errorf("no hosts")
+	}
+	for i, h := range m.Hosts {
+		if len(h.Match.MAC) == 0 && h.Match.Serial == "" {
+			return fmt.Errorf("host %d: match: mac or serial is required", i+1)
+		}
+		for _, mac := range h.Match.MAC {
+			if _, err := net.ParseMAC(mac); err != nil {
+				return fmt.Errorf("host %d: match: %w", i+1, err)
+			}
+		}
+		if err := h.File.Check(); err != nil {
+			return fmt.Errorf("host %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Lookup outputs the provisioning file of the single host that matches the
+// given MAC addresses or serial number.  An empty serial number never matches.
+func (m *Manifest) Lookup(macs []net.HardwareAddr, serial string) (*File, error) {
+	var matches []int
+	for i, h := range m.Hosts {
+		if h.Match.matches(macs, serial) {
+			matches = append(matches, i)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no host matches serial %q or MAC addresses %v", serial, macs)
+	case 1:
+		return &m.Hosts[matches[0]].File, nil
+	default:
+		return nil, fmt.Errorf("hosts %v match this platform, want exactly one", oneBased(matches))
+	}
+}
+
+func (match *Match) matches(macs []net.HardwareAddr, serial string) bool {
+	if match.Serial != "" && match.Serial == serial {
+		return true
+	}
+	for _, str := range match.MAC {
+		want, err := net.ParseMAC(str)
+		if err != nil {
+			continue
+		}
+		for _, mac := range macs {
+			if mac.String() == want.String() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DMISerial reads the platform's DMI system serial number
+func DMISerial() (string, error) {
+	b, err := os.ReadFile(DMISerialFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func oneBased(indices []int) []int {
+	var ret []int
+	for _, i := range indices {
+		ret = append(ret, i+1)
+	}
+	return ret
+}
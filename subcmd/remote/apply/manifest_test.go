@@ -0,0 +1,89 @@
+package apply
+
+import (
+	"net"
+	"testing"
+)
+
+const testManifest = `
+hosts:
+  - match:
+      mac: [aa:bb:cc:dd:ee:01, aa:bb:cc:dd:ee:02]
+    mode: static
+    ip: 10.0.2.10/26
+    full-host: st-01.example.org
+  - match:
+      serial: S3R1AL
+    mode: dhcp
+    full-host: st-02.example.org
+  - match:
+      mac: [AA:BB:CC:DD:EE:03]
+      serial: DUPL1CATE
+    mode: dhcp
+    host: st-03
+  - match:
+      serial: DUPL1CATE
+    mode: dhcp
+    host: st-04
+`
+
+func TestParseManifest(t *testing.T) {
+	for _, table := range []struct {
+		desc string
+		in   string
+	}{
+		{"invalid: no hosts", `hosts: []`},
+		{"invalid: no match", "hosts:\n  - mode: dhcp"},
+		{"invalid: bad mac", "hosts:\n  - match: {mac: [aa:bb]}\n    mode: dhcp"},
+		{"invalid: bad file", "hosts:\n  - match: {serial: S}\n    mode: static"},
+		{"invalid: unknown key", "hosts:\n  - match: {serial: S}\n    mode: dhcp\n    hostname: st"},
+		{"valid: json", `{"hosts":[{"match":{"serial":"S"},"mode":"dhcp","host":"st"}]}`},
+		{"valid: yaml", testManifest},
+	} {
+		_, err := ParseManifest([]byte(table.in))
+		if got, want := err != nil, table.desc[:5] != "valid"; got != want {
+			t.Errorf("%s: got error %v but wanted %v: %v", table.desc, got, want, err)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	m, err := ParseManifest([]byte(testManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []struct {
+		desc     string
+		macs     []string
+		serial   string
+		wantHost string
+	}{
+		{"no match", []string{"aa:bb:cc:dd:ee:ff"}, "OTHER", ""},
+		{"no match: empty serial", nil, "", ""},
+		{"ambiguous", nil, "DUPL1CATE", ""},
+		{"mac", []string{"aa:bb:cc:dd:ee:ff", "aa:bb:cc:dd:ee:02"}, "", "st-01.example.org"},
+		{"mac: case insensitive", []string{"aa:bb:cc:dd:ee:03"}, "", "st-03"},
+		{"serial", []string{"aa:bb:cc:dd:ee:ff"}, "S3R1AL", "st-02.example.org"},
+	} {
+		var macs []net.HardwareAddr
+		for _, str := range table.macs {
+			mac, err := net.ParseMAC(str)
+			if err != nil {
+				t.Fatal(err)
+			}
+			macs = append(macs, mac)
+		}
+
+		f, err := m.Lookup(macs, table.serial)
+		if got, want := err != nil, table.wantHost == ""; got != want {
+			t.Errorf("%s: got error %v but wanted %v: %v", table.desc, got, want, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got, want := f.FullHost+f.Host, table.wantHost; got != want {
+			t.Errorf("%s: got host %q, want %q", table.desc, got, want)
+		}
+	}
+}
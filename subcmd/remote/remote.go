@@ -12,18 +12,27 @@ import (
 
 	"system-transparency.org/stboot/host"
 	"system-transparency.org/stboot/stlog"
+	"system-transparency.org/stprov/internal/api"
 	"system-transparency.org/stprov/internal/network"
 	"system-transparency.org/stprov/internal/options"
+	"system-transparency.org/stprov/internal/secrets"
 	"system-transparency.org/stprov/internal/st"
+	"system-transparency.org/stprov/internal/store"
+	"system-transparency.org/stprov/internal/tpm"
 	"system-transparency.org/stprov/internal/version"
+	"system-transparency.org/stprov/subcmd/remote/apply"
 	"system-transparency.org/stprov/subcmd/remote/dhcp"
 	"system-transparency.org/stprov/subcmd/remote/run"
+	"system-transparency.org/stprov/subcmd/remote/show"
 	"system-transparency.org/stprov/subcmd/remote/static"
+	"system-transparency.org/stprov/subcmd/remote/unseal"
+	"system-transparency.org/stprov/subcmd/remote/verify"
+	"system-transparency.org/stprov/subcmd/remote/wipe"
 )
 
 const usage_string = `Usage:
 
-  stprov remote run -o OTP [-i IP_ADDR] [-p PORT] [-a ALLOWED_HOST [-a ALLOWED_HOST ...]
+  stprov remote run -o OTP [-i IP_ADDR] [-p PORT] [-a ALLOWED_HOST [-a ALLOWED_HOST ...] [--max-failures N] [--max-wait DURATION] [--confirm MODE] [--tpm-seal [--tpm-pcrs PCRS] [--tpm DEVICE]] [-s STORE]
 
     Starts a server on a given IP address (-i) and port (-o), waiting for
     commands from stprov local.  A one-time password (-o) is used to establish
@@ -32,6 +41,10 @@ const usage_string = `Usage:
 
     An SSH hostkey is written to EFI NVRAM on success.  Secure Boot objects PK,
     KEK, db, and dbx are also written to EFI NVRAM if provided by stprov local.
+    So is an SSH host certificate (STHostCert), if signed by stprov local, and
+    any keys that stprov local asks to derive (e.g., STWireGuardKey).  If
+    stprov local signs an X.509 identity certificate, it is written with its
+    key (STX509Cert and STX509Key).
 
   Options:
 
@@ -40,6 +53,53 @@ const usage_string = `Usage:
     -p, --port   Listening port (Default: 2009)
     -a, --allow  Source IP addresses allowed to connect in CIDR notation
                  (Default: %s; can be repeated)
+        --max-failures
+                 Failed authentication attempts before a permanent shutdown
+                 (Default: 10)
+        --max-wait
+                 Shut down without writing anything if stprov local has not
+                 committed within this duration, e.g., 30m (Default: 0, wait
+                 forever)
+        --confirm
+                 How to confirm a commit: "interactive" (press Enter), "auto"
+                 (no confirmation), or "hex:N" (type the first N hex characters
+                 of the entropy output by stprov local) (Default: interactive)
+        --tpm-seal
+                 Seal the SSH hostkey to the TPM instead of writing it in
+                 plaintext, see "stprov remote unseal"
+        --tpm-pcrs
+                 Comma-separated SHA256 PCRs to seal to, refusing Secure
+                 Boot keys if 7 is included (Default: 7)
+        --tpm    TPM device, or "mssim:HOST:PORT" for a TPM simulator
+                 (Default: /dev/tpmrm0)
+    -s, --store  Where to persist variables, "efi" or "dir:PATH" (Default: efi)
+
+    A source IP address that fails to authenticate must back off for 1s, 2s,
+    4s, and so on up to 1m before its next attempt.  The server shuts down
+    without provisioning anything if the total number of failed attempts
+    reaches --max-failures.
+
+    A commit is confirmed on the console before anything is written, see
+    --confirm.  Before confirming, compare the short authentication string
+    with the one output by stprov local.  With "hex:N", the received entropy
+    is not output.  Instead, the first N hex characters of the entropy output
+    by stprov local must be typed.  This ensures that the person at the
+    console compared the two.
+
+    With --tpm-seal, the secret that the SSH hostkey is derived from is sealed
+    to the TPM under a policy that requires the selected PCRs to have the same
+    values as during provisioning.  The sealed blob is written to EFI NVRAM
+    (STHostKeySealed) instead of the plaintext SSH hostkey (STHostKey).
+
+    Provisioning Secure Boot keys changes PCR 7, so a secret sealed to it
+    could never be unsealed after the next boot.  If PCR 7 is selected, Secure
+    Boot keys from stprov local are therefore refused.  To provision them in
+    the same session, select PCRs that do not change, e.g., --tpm-pcrs 0,2.
+
+    Only the SSH hostkey can be sealed.  With --tpm-seal, derived keys
+    (--derive) and X.509 identity certificates (--ca) from stprov local are
+    therefore refused, rather than writing their private keys in plaintext.
+    A host key passphrase (--host-key-passphrase-file) is also refused.
 
     If the subnet mask is omitted with the -a option, it defaults to "/32"
     (IPv4) or "/128" (IPv6).  E.g., 10.0.0.1 and 10.0.0.1/32 are equivalent.
@@ -49,10 +109,128 @@ const usage_string = `Usage:
     addresses.  This is possible for the arguments to the flags -i and -a.
 
 
+  stprov remote apply -c FILE [--iso-device DEVICE] [-s STORE]
+
+    Runs "stprov remote static" or "stprov remote dhcp" with settings from a
+    provisioning file in JSON or YAML format.  The file is read from a local
+    path, from an HTTP(S) URL, or from the provisioning ISO ("iso:PATH").
+
+    Each key in the provisioning file is the long name of a static or dhcp
+    option, and the additional key "mode" is either "static" or "dhcp".  Lists
+    are used for repeated options.  Omitted keys get default values.  Example:
+
+      mode: static
+      ip: 10.0.2.10/26
+      full-host: host.example.org
+      url: [https://ospkg-01.example.org/os.json, https://ospkg-02.example.org/os.json]
+      bonding: [eth0, eth1]
+
+  Options:
+
+    -c, --config      Provisioning file: a path, an HTTP(S) URL, or iso:PATH
+        --iso-device  Block device with the provisioning ISO (Default: /dev/sr0)
+    -s, --store       Where to persist variables, "efi" or "dir:PATH" (Default: efi)
+
+    Reading a provisioning file from an HTTP(S) URL requires a working network
+    before stprov runs, and the trust policy's TLS roots for HTTPS.
+
+
+  stprov remote auto -c FILE [--iso-device DEVICE] [-s STORE]
+
+    Like "stprov remote apply", but reads a manifest that lists provisioning
+    files for many hosts.  The single host that matches one of this platform's
+    MAC addresses, or its DMI system serial number, is applied.  Example:
+
+      hosts:
+        - match:
+            mac: [aa:bb:cc:dd:ee:01, aa:bb:cc:dd:ee:02]
+          mode: static
+          ip: 10.0.2.10/26
+          full-host: host-01.example.org
+        - match:
+            serial: ABC123
+          mode: dhcp
+          full-host: host-02.example.org
+
+  Options:
+
+    -c, --config      Manifest: a path, an HTTP(S) URL, or iso:PATH
+        --iso-device  Block device with the provisioning ISO (Default: /dev/sr0)
+    -s, --store       Where to persist variables, "efi" or "dir:PATH" (Default: efi)
+
+    It is an error if no host or more than one host matches.
+
+
+  stprov remote show [--format FORMAT] [-s STORE]
+
+    Reads back and outputs what has been provisioned: the host configuration,
+    the hostname, the public key and fingerprint of the SSH hostkey, and the
+    Secure Boot state (SetupMode, and whether PK, KEK, db, and dbx are present).
+
+    Also output, if provisioned: the key type and PCRs of a sealed SSH hostkey
+    (STHostKeySealed), the key ID, principals, and expiry of the SSH host
+    certificate (STHostCert), the subject, issuer, names, and expiry of the
+    X.509 identity certificate (STX509Cert), the public key of its key
+    (STX509Key), and the public key of each derived key (e.g., STAgeKey).
+
+  Options:
+
+        --format  Output format, "text" or "json" (Default: text)
+    -s, --store   Where to read variables from, "efi" or "dir:PATH" (Default: efi)
+
+
+  stprov remote verify [-s STORE]
+
+    Reads back the provisioned host configuration, hostname, and SSH hostkey,
+    checking that they parse, that the MAC addresses of the configured network
+    interfaces exist on this platform, that the gateway answers ping (static
+    network configurations only), and that every OS package URL can be
+    HEAD-requested.  A sealed SSH hostkey (STHostKeySealed) is checked to
+    parse without unsealing it.  Each check is listed.  Fails if any check
+    fails.
+
+  Options:
+
+    -s, --store   Where to read variables from, "efi" or "dir:PATH" (Default: efi)
+
+
+  stprov remote unseal [-o FILE] [--tpm DEVICE] [-s STORE]
+
+    Unseals the secret that "stprov remote run --tpm-seal" sealed to the TPM,
+    outputting the SSH hostkey that is derived from it as an OpenSSH private
+    key.  Fails if the PCRs have other values than during provisioning.
+
+  Options:
+
+    -o, --output  Where to write the SSH hostkey, or "-" for stdout (Default: -)
+        --tpm     TPM device, or "mssim:HOST:PORT" for a TPM simulator
+                  (Default: /dev/tpmrm0)
+    -s, --store   Where to read variables from, "efi" or "dir:PATH" (Default: efi)
+
+
+  stprov remote wipe [-v VARIABLE [-v VARIABLE ...]] [-y] [-s STORE]
+
+    Removes variables that stprov manages, e.g., before reprovisioning.  The
+    operator is asked for confirmation unless -y is specified.
+
+  Options:
+
+    -v, --var    Variable to wipe, one of STHostConfig, STHostName, STHostKey,
+                 STHostKeySealed, STHostCert, STX509Key, STX509Cert,
+                 STWireGuardKey, STAgeKey, STTLSClientKey, and OsIndications
+                 (Default: all but OsIndications; can be repeated)
+    -y, --yes    Wipe without asking for confirmation
+    -s, --store  Where to wipe variables from, "efi" or "dir:PATH" (Default: efi)
+
+    OsIndications is not removed.  Only the request to reboot into the UEFI
+    menu, which stprov local asks for when provisioning Secure Boot keys, is
+    cleared.
+
+
   stprov remote dhcp -h HOSTNAME | -H FULL_HOSTNAME
                      -r OSPKG_URL [-r OSPKG_URL ...] [-u USER] [-p PASSWORD]
                      [-m MAC | -I INTERFACE | -w WAIT]
-                     [-d DNS [-d DNS ...]]
+                     [-d DNS [-d DNS ...]] [-s STORE]
 
     Configures the network using DHCP. If none of -m and -I are specified, the
     interface is guessed.
@@ -65,7 +243,7 @@ const usage_string = `Usage:
                        [-h HOSTNAME | -H FULL_HOSTNAME]
                        [-A | -m MAC | -I INTERFACE | {-B | -b INTERFACE [-b INTERFACE ...]} [-M BONDING_MODE]] [-w WAIT]
                        [-g GATEWAY] [-x] [-f]
-                       [-d DNS [-d DNS ...]]
+                       [-d DNS [-d DNS ...]] [-s STORE]
 
     Configures a static network configuration and persist it to EFI-NVRAM.  If
     none of -m and -I are specified, the network interface is guessed.  If -A
@@ -93,6 +271,7 @@ const usage_string = `Usage:
     -x, --try-last-gateway Override default gateway and instead assume last address in HOST_ADDR's network
     -f, --force            Proceed despite failing configuration sanity checks, logging ignored issues
     -d, --dns              DNS server IP addresses (Default: %s; can be repeated)
+    -s, --store            Where to persist variables, "efi" or "dir:PATH" (Default: efi)
 
     The first occurrence of the pattern user:password in the specified OS
     package URL(s) are substituted with the values of -u and -p.  For example,
@@ -107,12 +286,21 @@ const usage_string = `Usage:
     If your input interface scrambles the '/' (slash) when typing, it is
     possible to type 'm' as a replacement for the '/' in CIDR notation
     addresses.  This is possible for the arguments to the flags -i and -g.
+
+    The store "efi" persists variables to EFI NVRAM.  The store "dir:PATH"
+    instead persists each variable as a file named NAME-GUID in directory PATH,
+    using the same file format as efivarfs.  This is possible for the
+    subcommands static, dhcp, apply, auto, run, show, verify, unseal, and wipe.
 `
 
 const (
-	efiKeyName  = "STHostKey"
-	efiHostName = "STHostName"
-	httpTimeout = 20 * time.Second
+	efiKeyName      = "STHostKey"
+	efiSealedName   = "STHostKeySealed"
+	efiHostName     = "STHostName"
+	efiCertName     = "STHostCert"
+	efiX509KeyName  = "STX509Key"
+	efiX509CertName = "STX509Cert"
+	httpTimeout     = 20 * time.Second
 
 	trustPolicyRootFile = "/etc/trust_policy/tls_roots.pem"
 )
@@ -121,10 +309,16 @@ var (
 	optMAC, optHostName, optUser, optPassword                  string
 	optHostIP, optGateway, optOTP, optFullHostName             string
 	optInterfaceWait, optInterface                             string
-	optPort                                                    int
+	optPort, optMaxFailures                                    int
 	optAutodetect, optBondingAuto, optTryLastGateway, optForce bool
+	optYes                                                     bool
 	optBondingInterfaces, optDNS, optURL, optAllowedCIDRs      options.SliceFlag
-	optBondingMode                                             string
+	optVars                                                    options.SliceFlag
+	optBondingMode, optStore, optFormat                        string
+	optConfig, optISODevice                                    string
+	optConfirm, optTPM, optTPMPCRs, optOutput                  string
+	optTPMSeal                                                 bool
+	optMaxWait                                                 time.Duration
 )
 
 func usage() {
@@ -152,6 +346,7 @@ func setOptions(fs *flag.FlagSet) {
 		options.AddStringS(fs, &optURL, "r", "url", options.DefTemplateURL)
 		options.AddString(fs, &optInterfaceWait, "w", "wait", "4s")
 		options.AddBool(fs, &optForce, "f", "force", false)
+		options.AddString(fs, &optStore, "s", "store", store.NameEFI)
 	}
 
 	switch cmd := fs.Name(); cmd {
@@ -168,11 +363,35 @@ func setOptions(fs *flag.FlagSet) {
 		options.AddString(fs, &optBondingMode, "M", "bonding-mode", options.DefBondingMode)
 	case "dhcp":
 		common()
+	case "apply", "auto":
+		options.AddString(fs, &optConfig, "c", "config", "")
+		fs.StringVar(&optISODevice, "iso-device", "/dev/sr0", "")
+		options.AddString(fs, &optStore, "s", "store", store.NameEFI)
 	case "run":
 		options.AddInt(fs, &optPort, "p", "port", 2009)
 		options.AddString(fs, &optHostIP, "i", "ip", "0.0.0.0")
 		options.AddStringS(fs, &optAllowedCIDRs, "a", "allow", options.DefAllowedNetworks)
 		options.AddString(fs, &optOTP, "o", "otp", "")
+		fs.IntVar(&optMaxFailures, "max-failures", api.DefaultMaxFailures, "")
+		fs.DurationVar(&optMaxWait, "max-wait", 0, "")
+		fs.StringVar(&optConfirm, "confirm", run.ConfirmInteractive, "")
+		fs.BoolVar(&optTPMSeal, "tpm-seal", false, "")
+		fs.StringVar(&optTPMPCRs, "tpm-pcrs", "7", "")
+		fs.StringVar(&optTPM, "tpm", tpm.DefaultDevice, "")
+		options.AddString(fs, &optStore, "s", "store", store.NameEFI)
+	case "show":
+		fs.StringVar(&optFormat, "format", show.FormatText, "")
+		options.AddString(fs, &optStore, "s", "store", store.NameEFI)
+	case "verify":
+		options.AddString(fs, &optStore, "s", "store", store.NameEFI)
+	case "unseal":
+		options.AddString(fs, &optOutput, "o", "output", "-")
+		fs.StringVar(&optTPM, "tpm", tpm.DefaultDevice, "")
+		options.AddString(fs, &optStore, "s", "store", store.NameEFI)
+	case "wipe":
+		options.AddStringS(fs, &optVars, "v", "var", "")
+		options.AddBool(fs, &optYes, "y", "yes", false)
+		options.AddString(fs, &optStore, "s", "store", store.NameEFI)
 	}
 }
 
@@ -203,6 +422,11 @@ func Main(args []string) error {
 	var interfaceWait time.Duration
 
 	opt := options.New(args, usage, setOptions)
+	if name := opt.Name(); name == "apply" || name == "auto" {
+		if opt, err = applyFile(opt); err != nil {
+			return fmtErr(err, name)
+		}
+	}
 	if optHostName != "" && optFullHostName != "" {
 		return fmtErr(fmt.Errorf("-h and -H options are mutually exclusive"), opt.Name())
 	}
@@ -241,6 +465,19 @@ func Main(args []string) error {
 	if err != nil {
 		return fmtErr(err, opt.Name())
 	}
+	efiVars := &st.EFIVariables{
+		UUID:          efiUUID,
+		HostConfig:    efiConfigName,
+		HostName:      efiHostName,
+		HostKey:       efiKeyName,
+		HostKeySealed: efiSealedName,
+		HostCert:      efiCertName,
+		X509Key:       efiX509KeyName,
+		X509Cert:      efiX509CertName,
+	}
+	for _, d := range secrets.Derivations {
+		efiVars.Derived = append(efiVars.Derived, d.EFIName)
+	}
 
 	// Decode CIDR strings encoded to avoid scrambled input.
 	optHostIP = options.DecodeSafeCIDR(optHostIP)
@@ -249,6 +486,13 @@ func Main(args []string) error {
 		optAllowedCIDRs.Values[i] = options.DecodeSafeCIDR(allowedCIDR)
 	}
 
+	var s store.Store
+	if opt.Name() == "static" || opt.Name() == "dhcp" || opt.Name() == "run" || opt.Name() == "show" || opt.Name() == "verify" || opt.Name() == "unseal" || opt.Name() == "wipe" {
+		if s, err = store.Open(optStore); err != nil {
+			return fmtErr(fmt.Errorf("store: %w", err), opt.Name())
+		}
+	}
+
 	description := formatDescription(version.Version, time.Now())
 	switch opt.Name() {
 	case "help", "":
@@ -260,7 +504,7 @@ func Main(args []string) error {
 			return fmtErr(err, opt.Name())
 		}
 		config.Description = &description
-		err = fmtErr(commitConfig(optHostName, config, optURL.Values, optUser, optPassword, optForce), opt.Name())
+		err = fmtErr(commitConfig(s, optHostName, config, optURL.Values, optUser, optPassword, optForce), opt.Name())
 		if err == nil {
 			stlog.Info("command remote %q succeeded", opt.Name())
 		}
@@ -271,13 +515,49 @@ func Main(args []string) error {
 			return fmtErr(err, opt.Name())
 		}
 		config.Description = &description
-		err = fmtErr(commitConfig(optHostName, config, optURL.Values, optUser, optPassword, optForce), opt.Name())
+		err = fmtErr(commitConfig(s, optHostName, config, optURL.Values, optUser, optPassword, optForce), opt.Name())
 		if err == nil {
 			stlog.Info("command remote %q succeeded", opt.Name())
 		}
 		return err
 	case "run":
-		err = fmtErr(run.Main(opt.Args(), optPort, optHostIP, optAllowedCIDRs.Values, optOTP, efiUUID, efiConfigName, efiKeyName, efiHostName), opt.Name())
+		err = fmtErr(run.Main(opt.Args(), s, &run.Options{
+			Port:        optPort,
+			IP:          optHostIP,
+			AllowHosts:  optAllowedCIDRs.Values,
+			OTP:         optOTP,
+			MaxFailures: optMaxFailures,
+			MaxWait:     optMaxWait,
+			Confirm:     optConfirm,
+			TPMSeal:     optTPMSeal,
+			TPM:         optTPM,
+			TPMPCRs:     optTPMPCRs,
+		}, efiVars), opt.Name())
+		if err == nil {
+			stlog.Info("command remote %q succeeded", opt.Name())
+		}
+		return err
+	case "show":
+		return fmtErr(show.Main(opt.Args(), s, os.Stdout, optFormat, efiVars), opt.Name())
+	case "verify":
+		client, err := network.NewClient(trustPolicyRootFile)
+		if err != nil {
+			return fmtErr(fmt.Errorf("configure tls client: %w", err), opt.Name())
+		}
+		prober := &verify.Platform{HEAD: func(url string) error { return checkURL(client, url) }}
+		err = fmtErr(verify.Main(opt.Args(), s, os.Stdout, prober, efiVars), opt.Name())
+		if err == nil {
+			stlog.Info("command remote %q succeeded", opt.Name())
+		}
+		return err
+	case "unseal":
+		return fmtErr(unseal.Main(opt.Args(), s, os.Stdout, optTPM, optOutput, efiUUID, efiSealedName), opt.Name())
+	case "wipe":
+		vars := optVars.Values
+		if len(vars) == 0 {
+			vars = efiVars.Names()
+		}
+		err = fmtErr(wipe.Main(opt.Args(), s, os.Stdin, vars, optYes, efiVars), opt.Name())
 		if err == nil {
 			stlog.Info("command remote %q succeeded", opt.Name())
 		}
@@ -287,6 +567,53 @@ func Main(args []string) error {
 	}
 }
 
+// applyFile loads a provisioning file, parsing its settings as options to the
+// static or dhcp subcommand.  For the auto subcommand, the provisioning file is
+// looked up in a manifest based on this platform's MAC addresses and serial.
+func applyFile(opt *flag.FlagSet) (*flag.FlagSet, error) {
+	if len(opt.Args()) != 0 {
+		return nil, fmt.Errorf("trailing arguments: %v", opt.Args())
+	}
+	if len(optConfig) == 0 {
+		return nil, fmt.Errorf("config: provisioning file is a required option")
+	}
+	client, err := network.NewClient(trustPolicyRootFile)
+	if err != nil {
+		return nil, fmt.Errorf("configure tls client: %w", err)
+	}
+	var f *apply.File
+	if opt.Name() == "auto" {
+		f, err = lookupFile(&client)
+	} else {
+		f, err = apply.Load(optConfig, &client, optISODevice)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stlog.Info("applying provisioning file %s as %q", optConfig, f.Mode)
+	return options.New(append(f.Args(), "--store", optStore), usage, setOptions), nil
+}
+
+// lookupFile loads a manifest, outputting the provisioning file that matches
+// this platform
+func lookupFile(client *http.Client) (*apply.File, error) {
+	m, err := apply.LoadManifest(optConfig, client, optISODevice)
+	if err != nil {
+		return nil, err
+	}
+	macs, err := network.HardwareAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("list local interfaces: %w", err)
+	}
+	serial, err := apply.DMISerial()
+	if err != nil {
+		stlog.Warn("dmi: unable to read system serial number: %v", err)
+	}
+	stlog.Debug("matching manifest against serial %q and MAC addresses %v", serial, macs)
+	return m.Lookup(macs, serial)
+}
+
 // parseIPs parses a list of zero or more IP addresses
 func parseIPs(ips []string) ([]*net.IP, error) {
 	var ret []*net.IP
@@ -330,7 +657,7 @@ func formatDescription(version string, timestamp time.Time) string {
 	return fmt.Sprintf("stprov version %s; timestamp %s", version, timestamp.UTC().Format(time.RFC3339))
 }
 
-func commitConfig(optHostName string, config *host.Config, optURL []string, optUser, optPassword string, optForce bool) error {
+func commitConfig(s store.Store, optHostName string, config *host.Config, optURL []string, optUser, optPassword string, optForce bool) error {
 	if len(optHostName) == 0 {
 		return fmt.Errorf("host name is a required option")
 	}
@@ -362,11 +689,11 @@ func commitConfig(optHostName string, config *host.Config, optURL []string, optU
 		return fmt.Errorf("parse efi UUID: %w", err)
 	}
 
-	if err := hostName.WriteEFI(efiGuid, efiHostName); err != nil {
+	if err := hostName.WriteEFI(s, efiGuid, efiHostName); err != nil {
 		return fmt.Errorf("persist host name: %w", err)
 	}
 	stlog.Info("efivarfs: hostname persisted")
-	if err := st.WriteHostConfigEFI(config); err != nil {
+	if err := st.WriteHostConfigEFI(s, config); err != nil {
 		return fmt.Errorf("persist host config: %w", err)
 	}
 	stlog.Info("efivarfs: host configuration persisted")
@@ -3,55 +3,154 @@ package run
 import (
 	"bufio"
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/google/go-tpm/tpm2/transport"
 	"github.com/google/uuid"
 
 	"system-transparency.org/stboot/stlog"
 	"system-transparency.org/stprov/internal/api"
 	"system-transparency.org/stprov/internal/hexify"
+	"system-transparency.org/stprov/internal/pki"
 	"system-transparency.org/stprov/internal/secrets"
 	"system-transparency.org/stprov/internal/st"
+	"system-transparency.org/stprov/internal/store"
+	"system-transparency.org/stprov/internal/tpm"
 )
 
-func Main(args []string, optPort int, optIP string, optAllowHosts []string, optOTP string, efiUUID *uuid.UUID, efiConfigName, efiKeyName, efiHostName string) error {
+const (
+	ConfirmInteractive = "interactive" // press Enter to commit
+	ConfirmAuto        = "auto"        // commit without confirmation
+	ConfirmHexPrefix   = "hex:"        // type the first N hex characters of the entropy, e.g., "hex:8"
+)
+
+// confirmation selects how the admin running stprov remote confirms a commit
+type confirmation struct {
+	mode string // ConfirmInteractive, ConfirmAuto, or ConfirmHexPrefix
+	n    int    // number of hex characters to type with ConfirmHexPrefix
+}
+
+// Options are the options of stprov remote run
+type Options struct {
+	Port        int           // listening port
+	IP          string        // listening address
+	AllowHosts  []string      // source addresses allowed to connect in CIDR notation
+	OTP         string        // one-time password
+	MaxFailures int           // failed authentication attempts before a shutdown
+	MaxWait     time.Duration // shut down without a commit after this long, or zero
+	Confirm     string        // see the Confirm* constants
+	TPMSeal     bool          // seal the unique device secret to the TPM
+	TPM         string        // TPM device, see tpm.Open()
+	TPMPCRs     string        // comma-separated PCRs to seal to
+}
+
+func Main(args []string, s store.Store, opts *Options, vars *st.EFIVariables) error {
 	if len(args) != 0 {
 		return fmt.Errorf("trailing arguments: %v", args)
 	}
-	if len(optOTP) == 0 {
+	if len(opts.OTP) == 0 {
 		return fmt.Errorf("otp: one-time password is a required option")
 	}
-	port := optPort
+	port := opts.Port
 	if port < 1 || port > 65535 {
-		return fmt.Errorf("port: invalid: %d not in [1, 65535]", optPort)
+		return fmt.Errorf("port: invalid: %d not in [1, 65535]", opts.Port)
 	}
-	ip := net.ParseIP(optIP)
+	ip := net.ParseIP(opts.IP)
 	if ip == nil {
-		return fmt.Errorf("ip: malformed ip address: %s", optIP)
+		return fmt.Errorf("ip: malformed ip address: %s", opts.IP)
+	}
+	if opts.MaxFailures < 1 {
+		return fmt.Errorf("max-failures: must be at least 1")
 	}
-	allowNets, err := parseAllowedNets(optAllowHosts)
+	if opts.MaxWait < 0 {
+		return fmt.Errorf("max-wait: must not be negative")
+	}
+	allowNets, err := parseAllowedNets(opts.AllowHosts)
 	if err != nil {
 		return err
 	}
-	otp := optOTP
+	confirm, err := parseConfirmation(opts.Confirm)
+	if err != nil {
+		return fmt.Errorf("confirm: %w", err)
+	}
+	var pcrs []uint
+	var t transport.TPMCloser
+	if opts.TPMSeal {
+		if pcrs, err = tpm.ParsePCRs(opts.TPMPCRs); err != nil {
+			return fmt.Errorf("tpm-pcrs: %w", err)
+		}
+		// Opened before listening, so that nothing is provisioned without a TPM
+		if t, err = tpm.Open(opts.TPM); err != nil {
+			return fmt.Errorf("tpm: %w", err)
+		}
+		defer t.Close()
+	}
+	otp := opts.OTP
 
 	var hostname st.HostName
-	if err := hostname.ReadEFI(efiUUID, efiHostName); err != nil {
-		return fmt.Errorf("ReadEFI: %s: %w", efiHostName, err)
+	if err := hostname.ReadEFI(s, vars.UUID, vars.HostName); err != nil {
+		return fmt.Errorf("ReadEFI: %s: %w", vars.HostName, err)
 	}
-	uds, err := listen(otp, allowNets, ip, port, hostname)
+	// Provisioning Secure Boot keys changes PCR 7, so the host key would be
+	// sealed to a value that the platform never has again after rebooting
+	noSecureBoot := slices.Contains(pcrs, tpm.SecureBootPCR)
+	if noSecureBoot {
+		stlog.Info("refusing secure boot provisioning, the ssh host key is sealed to pcr %d", tpm.SecureBootPCR)
+	}
+	// Only the ssh host key is sealed, so keys that would be written in
+	// plaintext next to it are refused
+	noPlaintextKeys := opts.TPMSeal
+	if noPlaintextKeys {
+		stlog.Info("refusing derived keys, x509 certificates and host key passphrases, only the ssh host key can be sealed to the tpm")
+	}
+	srv, err := listen(s, otp, allowNets, ip, port, opts.MaxFailures, opts.MaxWait, confirm, hostname, noSecureBoot, noPlaintextKeys)
 	if err != nil {
 		return fmt.Errorf("listen: %w", err)
 	}
-	if err := writeHostKey(uds, efiUUID, efiKeyName); err != nil {
-		return fmt.Errorf("persist host key: %w", err)
+	uds, hostCert, x509Cert, passphrase, keyType, derive := srv.UDS, srv.HostCert, srv.X509Cert, srv.HostKeyPassphrase, srv.HostKeyType, srv.Derive
+	if opts.TPMSeal {
+		if err := writeSealed(s, uds, keyType, t, pcrs, vars.UUID, vars.HostKeySealed); err != nil {
+			return fmt.Errorf("persist sealed host key: %w", err)
+		}
+		stlog.Info("efivar: ssh host key sealed to tpm pcrs %s and persisted", opts.TPMPCRs)
+	} else {
+		if len(passphrase) == 0 {
+			passphrase = nil // not encrypted
+		}
+		if err := writeHostKey(s, uds, keyType, passphrase, vars.UUID, vars.HostKey); err != nil {
+			return fmt.Errorf("persist host key: %w", err)
+		}
+		stlog.Info("efivar: ssh host key persisted (type: %s, encrypted: %v)", keyType, passphrase != nil)
+	}
+	if len(hostCert) > 0 {
+		if err := store.Write(s, vars.HostCert, vars.UUID, []byte(hostCert+"\n")); err != nil {
+			return fmt.Errorf("persist host certificate: %w", err)
+		}
+		stlog.Info("efivar: ssh host certificate persisted")
+	}
+	if len(x509Cert) > 0 {
+		if err := writeX509(s, uds, x509Cert, vars.UUID, vars.X509Key, vars.X509Cert); err != nil {
+			return fmt.Errorf("persist x509 certificate: %w", err)
+		}
+		stlog.Info("efivar: x509 key and certificate persisted")
+	}
+	for _, name := range derive {
+		efiName, err := writeDerived(s, uds, name, vars.UUID)
+		if err != nil {
+			return fmt.Errorf("persist %s key: %w", name, err)
+		}
+		stlog.Info("efivar: %s key persisted (%s)", name, efiName)
 	}
-	stlog.Info("efivar: ssh host key persisted")
 
 	return nil
 }
@@ -82,48 +181,171 @@ func parseAllowedNets(addresses []string) ([]net.IPNet, error) {
 	return allowNets, nil
 }
 
+// parseConfirmation parses a confirmation mode, see the Confirm* constants
+func parseConfirmation(mode string) (confirmation, error) {
+	switch {
+	case mode == ConfirmInteractive || mode == ConfirmAuto:
+		return confirmation{mode: mode}, nil
+	case strings.HasPrefix(mode, ConfirmHexPrefix):
+		n, err := strconv.Atoi(strings.TrimPrefix(mode, ConfirmHexPrefix))
+		if err != nil {
+			return confirmation{}, fmt.Errorf("malformed number of hex characters: %s", mode)
+		}
+		if max := 2 * secrets.EntropyBytes; n < 1 || n > max {
+			return confirmation{}, fmt.Errorf("number of hex characters %d not in [1, %d]", n, max)
+		}
+		return confirmation{mode: ConfirmHexPrefix, n: n}, nil
+	default:
+		return confirmation{}, fmt.Errorf("must be %q, %q, or \"%sN\"", ConfirmInteractive, ConfirmAuto, ConfirmHexPrefix)
+	}
+}
+
 // listen listens for incoming requests until a commit message is received.
-// The admin running stprov remote must then give confirmation to proceed.
-func listen(otp string, allowNets []net.IPNet, ip net.IP, port int, hostname st.HostName) (uds *secrets.UniqueDeviceSecret, err error) {
-	ctx, cancel := context.WithCancel(context.Background())
+// The admin running stprov remote must then compare the short authentication
+// string with stprov local's, and confirm as selected by confirm.  The
+// committed server is output, i.e., with the unique device secret and what
+// else stprov local sent.  Failed authentication attempts are summarized, also
+// if the server locked out.  The server is shut down without a commit after
+// maxWait, unless it is zero.
+func listen(s store.Store, otp string, allowNets []net.IPNet, ip net.IP, port, maxFailures int, maxWait time.Duration, confirm confirmation, hostname st.HostName, noSecureBoot, noPlaintextKeys bool) (*api.Server, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if maxWait > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), maxWait)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
 	defer cancel()
 
 	srv, err := api.NewServer(&api.ServerConfig{
-		Secret:     otp,
-		RemoteIP:   ip,
-		RemotePort: port,
-		LocalCIDR:  allowNets,
-		Deadline:   15 * time.Second,
-		Timeout:    60 * time.Second,
-		HostName:   string(hostname),
+		Secret:          otp,
+		RemoteIP:        ip,
+		RemotePort:      port,
+		LocalCIDR:       allowNets,
+		Deadline:        15 * time.Second,
+		Timeout:         60 * time.Second,
+		HostName:        string(hostname),
+		Store:           s,
+		MaxFailures:     maxFailures,
+		NoSecureBoot:    noSecureBoot,
+		NoPlaintextKeys: noPlaintextKeys,
 	})
 	if err != nil {
-		return uds, fmt.Errorf("new server: %w", err)
+		return nil, fmt.Errorf("new server: %w", err)
 	}
 	log.Printf("starting server on %s:%d", srv.RemoteIP, srv.RemotePort)
-	if err := srv.Run(ctx); err != nil {
-		return uds, fmt.Errorf("run server: %w", err)
+	err = srv.Run(ctx)
+	log.Printf("failed authentication attempts: %s", srv.Failures())
+	if errors.Is(err, context.DeadlineExceeded) {
+		stlog.Error("no commit within %v, shutting down without writing anything", maxWait)
 	}
-	log.Printf("received entropy\n\n%s\n", hexify.Format(srv.Entropy[:]))
-	if _, err := readLine("Press Enter to commit changes, ctrl+c to abort"); err != nil {
-		return uds, fmt.Errorf("read confirmation: %w", err)
+	if errors.Is(err, api.ErrAborted) {
+		stlog.Error("aborted by stprov local, shutting down without writing anything")
 	}
+	if err != nil {
+		return nil, fmt.Errorf("run server: %w", err)
+	}
+	if confirm.mode != ConfirmHexPrefix {
+		// Not output when it must be compared with stprov local's output
+		log.Printf("received entropy\n\n%s\n", hexify.Format(srv.Entropy[:]))
+	}
+	log.Printf("short authentication string: %s", srv.SAS)
+	if len(srv.HostCert) > 0 {
+		log.Printf("received ssh host certificate\n\n%s\n", srv.HostCert)
+	}
+	if len(srv.X509Cert) > 0 {
+		log.Printf("received x509 certificate\n\n%s", srv.X509Cert)
+	}
+	if err := confirmCommit(os.Stdin, confirm, srv.Entropy[:]); err != nil {
+		return nil, fmt.Errorf("read confirmation: %w", err)
+	}
+
+	return srv, nil
+}
 
-	return srv.UDS, nil
+// confirmCommit waits for the admin to confirm a commit.  With ConfirmHexPrefix,
+// the admin is prompted until the first n hex characters of the entropy that
+// stprov local output are typed correctly.  Case and whitespace are ignored.
+func confirmCommit(in io.Reader, confirm confirmation, entropy []byte) error {
+	reader := bufio.NewReader(in)
+	switch confirm.mode {
+	case ConfirmAuto:
+		log.Printf("committing changes without confirmation")
+		return nil
+	case ConfirmHexPrefix:
+		want := hex.EncodeToString(entropy)[:confirm.n]
+		for {
+			line, err := readLine(reader, fmt.Sprintf("Type the first %d hex characters of the entropy to commit changes, ctrl+c to abort: ", confirm.n))
+			if err != nil {
+				return err
+			}
+			if strings.ToLower(strings.Join(strings.Fields(line), "")) == want {
+				return nil
+			}
+			stlog.Warn("entropy does not match, compare with the output of stprov local")
+		}
+	default:
+		_, err := readLine(reader, "Compare the short authentication string with stprov local, press Enter to commit changes, ctrl+c to abort")
+		return err
+	}
 }
 
-func readLine(msg string) (string, error) {
-	reader := bufio.NewReader(os.Stdin)
+func readLine(reader *bufio.Reader, msg string) (string, error) {
 	fmt.Print(msg)
 	return reader.ReadString('\n')
 }
 
-// writeHostKey derives an SSH host key from a unique device secret, writing it
-// to EFI-NVRAM
-func writeHostKey(uds *secrets.UniqueDeviceSecret, varUUID *uuid.UUID, name string) error {
-	hk, err := uds.SSH()
+// writeHostKey derives an SSH host key of a given type from a unique device
+// secret, writing it to an EFI variable store.  The host key is encrypted
+// unless the passphrase is nil.
+func writeHostKey(s store.Store, uds *secrets.UniqueDeviceSecret, keyType string, passphrase []byte, varUUID *uuid.UUID, name string) error {
+	hk, err := uds.SSH(keyType)
+	if err != nil {
+		return err
+	}
+	return hk.WriteEFIWithPassphrase(s, varUUID, name, passphrase)
+}
+
+// writeDerived derives a named key from a unique device secret, writing its
+// private key to an EFI variable store.  The name of the written variable is
+// output, see secrets.Derivations.
+func writeDerived(s store.Store, uds *secrets.UniqueDeviceSecret, name string, varUUID *uuid.UUID) (string, error) {
+	dk, err := uds.Derive(name)
+	if err != nil {
+		return "", err
+	}
+	return dk.EFIName, store.Write(s, dk.EFIName, varUUID, dk.Private)
+}
+
+// writeX509 derives the X.509 key from a unique device secret, writing it in
+// PKCS #8 PEM format to an EFI variable store together with its certificate
+func writeX509(s store.Store, uds *secrets.UniqueDeviceSecret, cert string, varUUID *uuid.UUID, keyName, certName string) error {
+	key, err := uds.X509()
+	if err != nil {
+		return err
+	}
+	b, err := pki.MarshalPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	if err := store.Write(s, keyName, varUUID, b); err != nil {
+		return err
+	}
+	return store.Write(s, certName, varUUID, []byte(cert))
+}
+
+// writeSealed seals a unique device secret to a TPM, writing the sealed blob
+// to an EFI variable store.  The SSH host key is derived again on unseal, with
+// the key type in the blob's label.
+func writeSealed(s store.Store, uds *secrets.UniqueDeviceSecret, keyType string, t transport.TPM, pcrs []uint, varUUID *uuid.UUID, name string) error {
+	blob, err := tpm.Seal(t, uds[:], pcrs)
 	if err != nil {
 		return err
 	}
-	return hk.WriteEFI(varUUID, name)
+	blob.Label = keyType
+	b, err := blob.Marshal()
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	return store.Write(s, name, varUUID, b)
 }
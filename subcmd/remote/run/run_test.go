@@ -1,9 +1,17 @@
 package run
 
 import (
+	"bytes"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/google/uuid"
+
+	"system-transparency.org/stprov/internal/pki"
+	"system-transparency.org/stprov/internal/secrets"
+	"system-transparency.org/stprov/internal/store"
 )
 
 func TestParseAllowedNets(t *testing.T) {
@@ -34,6 +42,59 @@ func TestParseAllowedNets(t *testing.T) {
 	}
 }
 
+func TestParseConfirmation(t *testing.T) {
+	for _, table := range []struct {
+		desc string
+		mode string
+		want *confirmation
+	}{
+		{"invalid: unknown mode", "yes", nil},
+		{"invalid: hex: no number", "hex:", nil},
+		{"invalid: hex: zero", "hex:0", nil},
+		{"invalid: hex: too long", "hex:65", nil},
+		{"valid: interactive", "interactive", &confirmation{mode: ConfirmInteractive}},
+		{"valid: auto", "auto", &confirmation{mode: ConfirmAuto}},
+		{"valid: hex", "hex:8", &confirmation{mode: ConfirmHexPrefix, n: 8}},
+		{"valid: hex: all", "hex:64", &confirmation{mode: ConfirmHexPrefix, n: 64}},
+	} {
+		confirm, err := parseConfirmation(table.mode)
+		if got, want := err != nil, table.want == nil; got != want {
+			t.Errorf("%s: got error %v but wanted %v: %v", table.desc, got, want, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got, want := confirm, *table.want; got != want {
+			t.Errorf("%s: got %v but wanted %v", table.desc, got, want)
+		}
+	}
+}
+
+func TestConfirmCommit(t *testing.T) {
+	entropy := []byte{0xde, 0xad, 0xbe, 0xef}
+	for _, table := range []struct {
+		desc    string
+		confirm confirmation
+		input   string
+		wantErr bool
+	}{
+		{"valid: auto", confirmation{mode: ConfirmAuto}, "", false},
+		{"valid: interactive", confirmation{mode: ConfirmInteractive}, "\n", false},
+		{"valid: hex", confirmation{mode: ConfirmHexPrefix, n: 6}, "deadbe\n", false},
+		{"valid: hex: case and spaces", confirmation{mode: ConfirmHexPrefix, n: 6}, "DE AD BE\n", false},
+		{"valid: hex: retry", confirmation{mode: ConfirmHexPrefix, n: 6}, "deadbf\ndeadbe\n", false},
+		{"invalid: interactive: eof", confirmation{mode: ConfirmInteractive}, "", true},
+		{"invalid: hex: mismatch", confirmation{mode: ConfirmHexPrefix, n: 6}, "deadbf\n", true},
+		{"invalid: hex: too short", confirmation{mode: ConfirmHexPrefix, n: 6}, "dead\n", true},
+	} {
+		err := confirmCommit(strings.NewReader(table.input), table.confirm, entropy)
+		if got, want := err != nil, table.wantErr; got != want {
+			t.Errorf("%s: got error %v but wanted %v: %v", table.desc, got, want, err)
+		}
+	}
+}
+
 func ipNets(t *testing.T, addrs []string) (ret []net.IPNet) {
 	for _, addr := range addrs {
 		_, cidr, err := net.ParseCIDR(addr)
@@ -44,3 +105,72 @@ func ipNets(t *testing.T, addrs []string) (ret []net.IPNet) {
 	}
 	return
 }
+
+func TestWriteDerived(t *testing.T) {
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	efiUUID := uuid.MustParse("f401f2c1-b005-4be0-8cee-f2e5945bcbe7")
+	uds := secrets.UniqueDeviceSecret{1, 2, 3}
+	if _, err := writeDerived(s, &uds, "ssh", &efiUUID); err == nil {
+		t.Errorf("wrote unknown derivation")
+	}
+	for _, name := range secrets.DerivationNames() {
+		efiName, err := writeDerived(s, &uds, name, &efiUUID)
+		if err != nil {
+			t.Fatalf("%s: write: %v", name, err)
+		}
+		dk, err := uds.Derive(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := efiName, dk.EFIName; got != want {
+			t.Errorf("%s: got EFI name %s but wanted %s", name, got, want)
+		}
+		got, err := store.Read(s, efiName, &efiUUID)
+		if err != nil {
+			t.Fatalf("%s: read: %v", name, err)
+		}
+		if !bytes.Equal(got, dk.Private) {
+			t.Errorf("%s: got private key\n%s\nbut wanted\n%s", name, got, dk.Private)
+		}
+	}
+}
+
+func TestWriteX509(t *testing.T) {
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	efiUUID := uuid.MustParse("f401f2c1-b005-4be0-8cee-f2e5945bcbe7")
+	uds := secrets.UniqueDeviceSecret{1, 2, 3}
+	cert := "-----BEGIN CERTIFICATE-----\n...\n-----END CERTIFICATE-----\n"
+	if err := writeX509(s, &uds, cert, &efiUUID, "STX509Key", "STX509Cert"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	key, err := uds.X509()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := pki.MarshalPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []struct {
+		name string
+		want []byte
+	}{
+		{"STX509Key", want},
+		{"STX509Cert", []byte(cert)},
+	} {
+		got, err := store.Read(s, table.name, &efiUUID)
+		if err != nil {
+			t.Fatalf("%s: read: %v", table.name, err)
+		}
+		if !bytes.Equal(got, table.want) {
+			t.Errorf("%s: got\n%s\nbut wanted\n%s", table.name, got, table.want)
+		}
+	}
+}
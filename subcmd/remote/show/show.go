@@ -0,0 +1,354 @@
+package show
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/u-root/u-root/pkg/efivarfs"
+
+	"system-transparency.org/stboot/host"
+	"system-transparency.org/stprov/internal/pki"
+	"system-transparency.org/stprov/internal/sb"
+	"system-transparency.org/stprov/internal/secrets"
+	"system-transparency.org/stprov/internal/ssh"
+	"system-transparency.org/stprov/internal/st"
+	"system-transparency.org/stprov/internal/store"
+	"system-transparency.org/stprov/internal/tpm"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Provisioned is everything that stprov may have provisioned.  A nil pointer
+// means that the corresponding variable is absent.
+type Provisioned struct {
+	HostConfig    *host.Config   `json:"host_config"`
+	HostName      *string        `json:"hostname"`
+	HostKey       *HostKey       `json:"hostkey"`
+	HostKeySealed *SealedHostKey `json:"hostkey_sealed"`
+	HostCert      *HostCert      `json:"host_cert"`
+	X509Cert      *X509Cert      `json:"x509_cert"`
+	X509Key       *string        `json:"x509_key"` // base64-encoded DER SubjectPublicKeyInfo
+	SecureBoot    sb.State       `json:"secure_boot"`
+
+	// DerivedKeys maps the name of each provisioned derived key to its
+	// public key, see secrets.Derivations
+	DerivedKeys map[string]string `json:"derived_keys"`
+
+	// Errors lists variables that are present but could not be parsed
+	Errors []string `json:"errors,omitempty"`
+}
+
+// HostKey is the public part of a provisioned SSH host key
+type HostKey struct {
+	PublicKey   string `json:"publickey"`
+	Fingerprint string `json:"fingerprint"`
+	Encrypted   bool   `json:"encrypted"`
+}
+
+// SealedHostKey is a unique device secret that is sealed to the TPM, which an
+// SSH host key is derived from on unseal
+type SealedHostKey struct {
+	KeyType string `json:"key_type"` // see ssh.KeyTypes
+	PCRs    []uint `json:"pcrs"`
+}
+
+// HostCert is a provisioned SSH host certificate
+type HostCert struct {
+	KeyID       string   `json:"key_id"`
+	Principals  []string `json:"principals"`
+	ValidBefore string   `json:"valid_before"` // RFC 3339, UTC
+}
+
+// X509Cert is a provisioned X.509 identity certificate
+type X509Cert struct {
+	Subject  string   `json:"subject"`
+	Issuer   string   `json:"issuer"`
+	Names    []string `json:"names"`     // subject alternative names
+	NotAfter string   `json:"not_after"` // RFC 3339, UTC
+}
+
+func Main(args []string, s store.Store, w io.Writer, optFormat string, vars *st.EFIVariables) error {
+	if len(args) != 0 {
+		return fmt.Errorf("trailing arguments: %v", args)
+	}
+	if optFormat != FormatText && optFormat != FormatJSON {
+		return fmt.Errorf("format: must be %q or %q", FormatText, FormatJSON)
+	}
+
+	p := Read(s, vars)
+	if optFormat == FormatJSON {
+		b, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return fmt.Errorf("marshal: %w", err)
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	}
+	return p.writeText(w)
+}
+
+// Read reads everything that stprov may have provisioned.  Absent variables
+// are left as nil, and variables that fail to parse are listed in Errors.
+func Read(s store.Store, vars *st.EFIVariables) *Provisioned {
+	var p Provisioned
+	addErr := func(name string, err error) {
+		if !errors.Is(err, efivarfs.ErrVarNotExist) {
+			p.Errors = append(p.Errors, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	if cfg, err := st.HostConfigEFI(s); err != nil {
+		addErr("host config", err)
+	} else {
+		p.HostConfig = cfg
+	}
+
+	var hostname st.HostName
+	if err := hostname.ReadEFI(s, vars.UUID, vars.HostName); err != nil {
+		addErr(vars.HostName, err)
+	} else {
+		str := string(hostname)
+		p.HostName = &str
+	}
+
+	var hk ssh.HostKey
+	if err := hk.ReadEFI(s, vars.UUID, vars.HostKey); errors.Is(err, ssh.ErrEncrypted) {
+		if pub, fpr, err := ssh.ReadPublicKeyEFI(s, vars.UUID, vars.HostKey); err != nil {
+			addErr(vars.HostKey, err)
+		} else {
+			p.HostKey = &HostKey{PublicKey: pub, Fingerprint: fpr, Encrypted: true}
+		}
+	} else if err != nil {
+		addErr(vars.HostKey, err)
+	} else if pub, err := hk.PublicKey(); err != nil {
+		addErr(vars.HostKey, err)
+	} else if fpr, err := hk.Fingerprint(); err != nil {
+		addErr(vars.HostKey, err)
+	} else {
+		p.HostKey = &HostKey{PublicKey: pub, Fingerprint: fpr}
+	}
+
+	if b, err := store.Read(s, vars.HostKeySealed, vars.UUID); err != nil {
+		addErr(vars.HostKeySealed, err)
+	} else if sealed, err := readSealed(b); err != nil {
+		addErr(vars.HostKeySealed, err)
+	} else {
+		p.HostKeySealed = sealed
+	}
+
+	if b, err := store.Read(s, vars.HostCert, vars.UUID); err != nil {
+		addErr(vars.HostCert, err)
+	} else if cert, err := readHostCert(b); err != nil {
+		addErr(vars.HostCert, err)
+	} else {
+		p.HostCert = cert
+	}
+
+	if b, err := store.Read(s, vars.X509Cert, vars.UUID); err != nil {
+		addErr(vars.X509Cert, err)
+	} else if cert, err := readX509Cert(b); err != nil {
+		addErr(vars.X509Cert, err)
+	} else {
+		p.X509Cert = cert
+	}
+
+	if b, err := store.Read(s, vars.X509Key, vars.UUID); err != nil {
+		addErr(vars.X509Key, err)
+	} else if pub, err := readX509Key(b); err != nil {
+		addErr(vars.X509Key, err)
+	} else {
+		p.X509Key = &pub
+	}
+
+	for _, d := range secrets.Derivations {
+		if b, err := store.Read(s, d.EFIName, vars.UUID); err != nil {
+			addErr(d.EFIName, err)
+		} else if pub, err := d.PublicKey(b); err != nil {
+			addErr(d.EFIName, err)
+		} else {
+			if p.DerivedKeys == nil {
+				p.DerivedKeys = make(map[string]string)
+			}
+			p.DerivedKeys[d.Name] = pub
+		}
+	}
+
+	p.SecureBoot = sb.ReadState(s)
+	return &p
+}
+
+func (p *Provisioned) writeText(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("Host configuration:\n")
+	if p.HostConfig == nil {
+		b.WriteString("  (not provisioned)\n")
+	} else {
+		cfg, err := json.MarshalIndent(p.HostConfig, "  ", "  ")
+		if err != nil {
+			return fmt.Errorf("marshal host config: %w", err)
+		}
+		fmt.Fprintf(&b, "  %s\n", cfg)
+	}
+
+	b.WriteString("\nHost name:\n")
+	fmt.Fprintf(&b, "  %s\n", orAbsent(p.HostName))
+
+	b.WriteString("\nSSH host key:\n")
+	if p.HostKey == nil {
+		b.WriteString("  (not provisioned)\n")
+	} else {
+		fmt.Fprintf(&b, "  publickey:   %s\n", p.HostKey.PublicKey)
+		fmt.Fprintf(&b, "  fingerprint: %s\n", p.HostKey.Fingerprint)
+		fmt.Fprintf(&b, "  encrypted:   %v\n", p.HostKey.Encrypted)
+	}
+
+	b.WriteString("\nSealed SSH host key:\n")
+	if p.HostKeySealed == nil {
+		b.WriteString("  (not provisioned)\n")
+	} else {
+		fmt.Fprintf(&b, "  key type: %s\n", p.HostKeySealed.KeyType)
+		fmt.Fprintf(&b, "  pcrs:     %s\n", formatPCRs(p.HostKeySealed.PCRs))
+	}
+
+	b.WriteString("\nSSH host certificate:\n")
+	if p.HostCert == nil {
+		b.WriteString("  (not provisioned)\n")
+	} else {
+		fmt.Fprintf(&b, "  key id:       %s\n", p.HostCert.KeyID)
+		fmt.Fprintf(&b, "  principals:   %s\n", strings.Join(p.HostCert.Principals, ", "))
+		fmt.Fprintf(&b, "  valid before: %s\n", p.HostCert.ValidBefore)
+	}
+
+	b.WriteString("\nX.509 identity certificate:\n")
+	if p.X509Cert == nil {
+		b.WriteString("  (not provisioned)\n")
+	} else {
+		fmt.Fprintf(&b, "  subject:   %s\n", p.X509Cert.Subject)
+		fmt.Fprintf(&b, "  issuer:    %s\n", p.X509Cert.Issuer)
+		fmt.Fprintf(&b, "  names:     %s\n", strings.Join(p.X509Cert.Names, ", "))
+		fmt.Fprintf(&b, "  not after: %s\n", p.X509Cert.NotAfter)
+	}
+
+	b.WriteString("\nX.509 identity key:\n")
+	if p.X509Key == nil {
+		b.WriteString("  (not provisioned)\n")
+	} else {
+		fmt.Fprintf(&b, "  publickey: %s\n", *p.X509Key)
+	}
+
+	b.WriteString("\nDerived keys:\n")
+	for _, d := range secrets.Derivations {
+		pub, ok := p.DerivedKeys[d.Name]
+		if !ok {
+			pub = "(not provisioned)"
+		}
+		fmt.Fprintf(&b, "  %-11s %s\n", d.Name+":", pub)
+	}
+
+	b.WriteString("\nSecure Boot:\n")
+	setupMode := "unknown"
+	if p.SecureBoot.SetupMode != nil {
+		setupMode = fmt.Sprintf("%v", *p.SecureBoot.SetupMode)
+	}
+	fmt.Fprintf(&b, "  setup mode: %s\n", setupMode)
+	fmt.Fprintf(&b, "  PK:         %s\n", presence(p.SecureBoot.PK))
+	fmt.Fprintf(&b, "  KEK:        %s\n", presence(p.SecureBoot.KEK))
+	fmt.Fprintf(&b, "  db:         %s\n", presence(p.SecureBoot.Db))
+	fmt.Fprintf(&b, "  dbx:        %s\n", presence(p.SecureBoot.Dbx))
+
+	if len(p.Errors) > 0 {
+		b.WriteString("\nErrors:\n")
+		for _, err := range p.Errors {
+			fmt.Fprintf(&b, "  %s\n", err)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func orAbsent(s *string) string {
+	if s == nil {
+		return "(not provisioned)"
+	}
+	return *s
+}
+
+func presence(ok bool) string {
+	if ok {
+		return "present"
+	}
+	return "absent"
+}
+
+func readSealed(b []byte) (*SealedHostKey, error) {
+	var blob tpm.Blob
+	if err := blob.Unmarshal(b); err != nil {
+		return nil, err
+	}
+	keyType := blob.Label
+	if keyType == "" {
+		keyType = ssh.DefaultKeyType
+	}
+	return &SealedHostKey{KeyType: keyType, PCRs: blob.PCRs}, nil
+}
+
+func readHostCert(b []byte) (*HostCert, error) {
+	cert, err := ssh.ParseHostCert(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, err
+	}
+	return &HostCert{
+		KeyID:       cert.KeyId,
+		Principals:  cert.ValidPrincipals,
+		ValidBefore: time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339),
+	}, nil
+}
+
+func readX509Cert(b []byte) (*X509Cert, error) {
+	cert, err := pki.ParseCertificate(b)
+	if err != nil {
+		return nil, err
+	}
+	names := cert.DNSNames
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return &X509Cert{
+		Subject:  cert.Subject.String(),
+		Issuer:   cert.Issuer.String(),
+		Names:    names,
+		NotAfter: cert.NotAfter.UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// readX509Key outputs the base64-encoded DER SubjectPublicKeyInfo of a private
+// key in PEM format
+func readX509Key(b []byte) (string, error) {
+	key, err := pki.ParsePrivateKey(b)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return "", fmt.Errorf("marshal public key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(der), nil
+}
+
+func formatPCRs(pcrs []uint) string {
+	var strs []string
+	for _, pcr := range pcrs {
+		strs = append(strs, fmt.Sprintf("%d", pcr))
+	}
+	return strings.Join(strs, ",")
+}
@@ -0,0 +1,230 @@
+package show
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	xssh "golang.org/x/crypto/ssh"
+
+	"system-transparency.org/stprov/internal/pki"
+	"system-transparency.org/stprov/internal/secrets"
+	"system-transparency.org/stprov/internal/ssh"
+	"system-transparency.org/stprov/internal/st"
+	"system-transparency.org/stprov/internal/store"
+	"system-transparency.org/stprov/internal/tpm"
+)
+
+func TestRead(t *testing.T) {
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, efiUUID, err := st.HostConfigEFIVariableName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := Read(s, testVars(efiUUID))
+	if p.HostConfig != nil || p.HostName != nil || p.HostKey != nil || p.HostKeySealed != nil || p.HostCert != nil || p.X509Cert != nil || p.X509Key != nil || p.DerivedKeys != nil {
+		t.Errorf("got provisioned values in an empty store: %+v", p)
+	}
+	if len(p.Errors) != 0 {
+		t.Errorf("got errors in an empty store: %v", p.Errors)
+	}
+
+	hostname := st.HostName("mullis")
+	if err := hostname.WriteEFI(s, efiUUID, "STHostName"); err != nil {
+		t.Fatal(err)
+	}
+	hk, err := ssh.NewHostKey(rand.Reader, "testkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hk.WriteEFI(s, efiUUID, "STHostKey"); err != nil {
+		t.Fatal(err)
+	}
+	fpr, err := hk.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p = Read(s, testVars(efiUUID))
+	if p.HostName == nil || *p.HostName != "mullis" {
+		t.Errorf("got host name %v, want %q", p.HostName, "mullis")
+	}
+	if p.HostKey == nil || p.HostKey.Fingerprint != fpr {
+		t.Errorf("got host key %v, want fingerprint %s", p.HostKey, fpr)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := Main(nil, s, buf, FormatJSON, testVars(efiUUID)); err != nil {
+		t.Fatal(err)
+	}
+	var pAgain Provisioned
+	if err := json.Unmarshal(buf.Bytes(), &pAgain); err != nil {
+		t.Fatalf("unmarshal json output: %v", err)
+	}
+	if pAgain.HostKey == nil || pAgain.HostKey.Fingerprint != fpr {
+		t.Errorf("got host key %v in json output, want fingerprint %s", pAgain.HostKey, fpr)
+	}
+
+	buf.Reset()
+	if err := Main(nil, s, buf, FormatText, testVars(efiUUID)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"mullis", fpr, "(not provisioned)"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("text output does not contain %q:\n%s", want, buf.String())
+		}
+	}
+
+	if err := Main(nil, s, buf, "yaml", testVars(efiUUID)); err == nil {
+		t.Errorf("invalid format accepted")
+	}
+}
+
+func TestReadEncrypted(t *testing.T) {
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, efiUUID, err := st.HostConfigEFIVariableName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hk, err := ssh.NewHostKey(rand.Reader, "testkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hk.WriteEFIWithPassphrase(s, efiUUID, "STHostKey", []byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	fpr, err := hk.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := Read(s, testVars(efiUUID))
+	if len(p.Errors) != 0 {
+		t.Errorf("got errors: %v", p.Errors)
+	}
+	if p.HostKey == nil || p.HostKey.Fingerprint != fpr || !p.HostKey.Encrypted {
+		t.Errorf("got host key %v, want encrypted with fingerprint %s", p.HostKey, fpr)
+	}
+}
+
+func TestReadOther(t *testing.T) {
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, efiUUID, err := st.HostConfigEFIVariableName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := testVars(efiUUID)
+	uds := secrets.UniqueDeviceSecret{}
+
+	blob := tpm.Blob{Version: tpm.BlobVersion, PCRs: []uint{0, 7}, Public: []byte{1}, Private: []byte{2}, Label: ssh.KeyTypeECDSAP256}
+	b, err := blob.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, s, vars.HostKeySealed, efiUUID, b)
+
+	hk, err := uds.SSH(ssh.DefaultKeyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := hk.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, caPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := xssh.NewSignerFromKey(caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := ssh.HostCA{Signer: signer, Validity: time.Hour}
+	hostCert, err := ca.Sign(pub, []string{"st.example.org", "10.0.2.10"}, time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, s, vars.HostCert, efiUUID, []byte(hostCert+"\n"))
+
+	x509Key, err := uds.X509()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := pki.MarshalPrivateKey(x509Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, s, vars.X509Key, efiUUID, keyPEM)
+	write(t, s, vars.X509Cert, efiUUID, []byte("not a certificate"))
+
+	dk, err := uds.Derive("age")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, s, dk.EFIName, efiUUID, dk.Private)
+
+	p := Read(s, vars)
+	if p.HostKeySealed == nil || p.HostKeySealed.KeyType != ssh.KeyTypeECDSAP256 || len(p.HostKeySealed.PCRs) != 2 {
+		t.Errorf("got sealed host key %v", p.HostKeySealed)
+	}
+	if p.HostCert == nil || strings.Join(p.HostCert.Principals, ",") != "st.example.org,10.0.2.10" {
+		t.Errorf("got host certificate %v", p.HostCert)
+	}
+	if p.X509Key == nil || len(*p.X509Key) == 0 {
+		t.Errorf("got no x509 key")
+	}
+	if p.X509Cert != nil || len(p.Errors) != 1 || !strings.HasPrefix(p.Errors[0], vars.X509Cert) {
+		t.Errorf("got x509 certificate %v and errors %v, want one error", p.X509Cert, p.Errors)
+	}
+	if got, want := len(p.DerivedKeys), 1; got != want {
+		t.Errorf("got %d derived keys but wanted %d", got, want)
+	}
+	if got, want := p.DerivedKeys["age"], dk.PublicKey; got != want {
+		t.Errorf("got age public key %q but wanted %q", got, want)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := p.writeText(buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"pcrs:     0,7", "st.example.org, 10.0.2.10", dk.PublicKey, "X.509 identity key:\n  publickey: " + *p.X509Key} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("text output does not contain %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func testVars(efiUUID *uuid.UUID) *st.EFIVariables {
+	return &st.EFIVariables{
+		UUID:          efiUUID,
+		HostConfig:    "STHostConfig",
+		HostName:      "STHostName",
+		HostKey:       "STHostKey",
+		HostKeySealed: "STHostKeySealed",
+		HostCert:      "STHostCert",
+		X509Key:       "STX509Key",
+		X509Cert:      "STX509Cert",
+	}
+}
+
+func write(t *testing.T, s store.Store, name string, efiUUID *uuid.UUID, b []byte) {
+	t.Helper()
+	if err := store.Write(s, name, efiUUID, b); err != nil {
+		t.Fatal(err)
+	}
+}
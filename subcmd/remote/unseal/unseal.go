@@ -0,0 +1,81 @@
+package unseal
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/uuid"
+
+	"system-transparency.org/stprov/internal/secrets"
+	"system-transparency.org/stprov/internal/ssh"
+	"system-transparency.org/stprov/internal/store"
+	"system-transparency.org/stprov/internal/tpm"
+)
+
+func Main(args []string, s store.Store, w io.Writer, optTPM, optOutput string, efiUUID *uuid.UUID, efiSealedName string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("trailing arguments: %v", args)
+	}
+	blob, err := ReadBlob(s, efiUUID, efiSealedName)
+	if err != nil {
+		return err
+	}
+	t, err := tpm.Open(optTPM)
+	if err != nil {
+		return fmt.Errorf("tpm: %w", err)
+	}
+	defer t.Close()
+
+	b, err := HostKey(t, blob)
+	if err != nil {
+		return err
+	}
+	if optOutput == "" || optOutput == "-" {
+		_, err = w.Write(b)
+		return err
+	}
+	if err := os.WriteFile(optOutput, b, 0600); err != nil {
+		return fmt.Errorf("output: %w", err)
+	}
+	return nil
+}
+
+// ReadBlob reads a sealed blob from an EFI variable store
+func ReadBlob(s store.Store, efiUUID *uuid.UUID, name string) (*tpm.Blob, error) {
+	b, err := store.Read(s, name, efiUUID)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+	var blob tpm.Blob
+	if err := blob.Unmarshal(b); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", name, err)
+	}
+	return &blob, nil
+}
+
+// HostKey unseals a unique device secret, outputting the SSH host key that is
+// derived from it in PEM format.  The blob's label is the key type, see
+// ssh.KeyTypes, and ssh.DefaultKeyType if empty.
+func HostKey(t transport.TPM, blob *tpm.Blob) ([]byte, error) {
+	secret, err := tpm.Unseal(t, blob)
+	if err != nil {
+		return nil, err
+	}
+	var uds secrets.UniqueDeviceSecret
+	if len(secret) != len(uds) {
+		return nil, fmt.Errorf("unsealed %d bytes, expected %d", len(secret), len(uds))
+	}
+	copy(uds[:], secret)
+
+	keyType := blob.Label
+	if keyType == "" {
+		keyType = ssh.DefaultKeyType
+	}
+	hk, err := uds.SSH(keyType)
+	if err != nil {
+		return nil, fmt.Errorf("derive ssh host key: %w", err)
+	}
+	return hk.MarshalPEM()
+}
@@ -0,0 +1,90 @@
+package unseal
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"system-transparency.org/stprov/internal/secrets"
+	"system-transparency.org/stprov/internal/ssh"
+	"system-transparency.org/stprov/internal/store"
+	"system-transparency.org/stprov/internal/tpm"
+)
+
+func TestReadBlob(t *testing.T) {
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	efiUUID := uuid.MustParse("f401f2c1-b005-4be0-8cee-f2e5945bcbe7")
+	if _, err := ReadBlob(s, &efiUUID, "STHostKeySealed"); err == nil {
+		t.Errorf("read missing blob")
+	}
+
+	if err := store.Write(s, "STHostKeySealed", &efiUUID, []byte("not a blob")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadBlob(s, &efiUUID, "STHostKeySealed"); err == nil {
+		t.Errorf("read malformed blob")
+	}
+
+	want := tpm.Blob{Version: tpm.BlobVersion, PCRs: []uint{7}, Public: []byte{1}, Private: []byte{2}}
+	b, err := want.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(s, "STHostKeySealed", &efiUUID, b); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadBlob(s, &efiUUID, "STHostKeySealed")
+	if err != nil {
+		t.Fatalf("read blob: %v", err)
+	}
+	if got.Version != want.Version || !bytes.Equal(got.Public, want.Public) || !bytes.Equal(got.Private, want.Private) {
+		t.Errorf("got blob %+v but wanted %+v", got, want)
+	}
+}
+
+func TestHostKey(t *testing.T) {
+	path := os.Getenv("STPROV_TPM_SIMULATOR")
+	if path == "" {
+		t.Skip("STPROV_TPM_SIMULATOR is not set")
+	}
+	tp, err := tpm.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+
+	uds := secrets.UniqueDeviceSecret{1, 2, 3}
+	blob, err := tpm.Seal(tp, uds[:], []uint{16})
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	for _, table := range []struct {
+		label   string
+		keyType string
+	}{
+		{"", ssh.DefaultKeyType},
+		{ssh.KeyTypeECDSAP256, ssh.KeyTypeECDSAP256},
+	} {
+		blob.Label = table.label
+		got, err := HostKey(tp, blob)
+		if err != nil {
+			t.Fatalf("%q: unseal: %v", table.label, err)
+		}
+		hk, err := uds.SSH(table.keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := hk.MarshalPEM()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%q: got host key\n%s\nbut wanted\n%s", table.label, got, want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package verify
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"system-transparency.org/stboot/host"
+	"system-transparency.org/stprov/internal/network"
+	"system-transparency.org/stprov/internal/ssh"
+	"system-transparency.org/stprov/internal/st"
+	"system-transparency.org/stprov/internal/store"
+	"system-transparency.org/stprov/internal/tpm"
+)
+
+// Prober performs the checks that depend on the platform and its network
+type Prober interface {
+	HardwareAddrs() ([]net.HardwareAddr, error) // MAC addresses of local interfaces
+	Ping(gw *net.IP) error                      // succeeds if the gateway answers
+	CheckURL(url string) error                  // succeeds if the URL is reachable
+}
+
+// Platform probes the platform that stprov is running on
+type Platform struct {
+	HEAD func(url string) error // HEAD request that checks an OS package URL
+}
+
+func (p *Platform) HardwareAddrs() ([]net.HardwareAddr, error) {
+	return network.HardwareAddrs()
+}
+
+func (p *Platform) Ping(gw *net.IP) error {
+	return network.TestGateway(gw)
+}
+
+func (p *Platform) CheckURL(url string) error {
+	return p.HEAD(url)
+}
+
+// Result is the outcome of a single check
+type Result struct {
+	Name string
+	Err  error
+}
+
+func Main(args []string, s store.Store, w io.Writer, p Prober, vars *st.EFIVariables) error {
+	if len(args) != 0 {
+		return fmt.Errorf("trailing arguments: %v", args)
+	}
+
+	var failed []string
+	for _, r := range Verify(s, p, vars) {
+		if r.Err != nil {
+			fmt.Fprintf(w, "FAIL %s: %v\n", r.Name, r.Err)
+			failed = append(failed, r.Name)
+			continue
+		}
+		fmt.Fprintf(w, "OK   %s\n", r.Name)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d check(s) failed: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Verify reads back the provisioned host configuration, hostname, and SSH host
+// key, checking them for consistency and reachability.  A host key that is
+// sealed to the TPM is only checked to be a well-formed sealed blob.  Checks
+// that depend on the host configuration are only performed if it could be
+// parsed.
+func Verify(s store.Store, p Prober, vars *st.EFIVariables) []Result {
+	var results []Result
+	add := func(name string, err error) {
+		results = append(results, Result{Name: name, Err: err})
+	}
+
+	var hostname st.HostName
+	if err := hostname.ReadEFI(s, vars.UUID, vars.HostName); err != nil {
+		add("hostname", err)
+	} else if len(hostname) == 0 {
+		add("hostname", fmt.Errorf("empty"))
+	} else {
+		add("hostname", nil)
+	}
+
+	var hk ssh.HostKey
+	if b, err := store.Read(s, vars.HostKeySealed, vars.UUID); err == nil {
+		// No STHostKey is written, the host key is derived on unseal
+		var blob tpm.Blob
+		add("ssh hostkey", blob.Unmarshal(b))
+	} else if err := hk.ReadEFI(s, vars.UUID, vars.HostKey); errors.Is(err, ssh.ErrEncrypted) {
+		// Only the public part can be checked without passphrase
+		_, _, err = ssh.ReadPublicKeyEFI(s, vars.UUID, vars.HostKey)
+		add("ssh hostkey", err)
+	} else {
+		add("ssh hostkey", err)
+	}
+
+	cfg, err := st.HostConfigEFI(s)
+	add("host config", err)
+	if err != nil {
+		return results
+	}
+
+	add("network interfaces", checkInterfaces(p, cfg.NetworkInterfaces))
+	if cfg.DefaultGateway != nil {
+		add("gateway", p.Ping(cfg.DefaultGateway))
+	}
+	if cfg.OSPkgPointer == nil || len(*cfg.OSPkgPointer) == 0 {
+		add("ospkg url", fmt.Errorf("no OS package pointer"))
+		return results
+	}
+	for _, url := range strings.Split(*cfg.OSPkgPointer, ",") {
+		add("ospkg url "+url, p.CheckURL(url))
+	}
+	return results
+}
+
+// checkInterfaces checks that the MAC addresses of a host configuration's
+// network interfaces exist on the platform
+func checkInterfaces(p Prober, ifaces *[]*host.NetworkInterface) error {
+	if ifaces == nil || len(*ifaces) == 0 {
+		return fmt.Errorf("no network interfaces")
+	}
+	local, err := p.HardwareAddrs()
+	if err != nil {
+		return fmt.Errorf("list local interfaces: %w", err)
+	}
+
+	var missing []string
+	for _, iface := range *ifaces {
+		if iface == nil || iface.MACAddress == nil {
+			return fmt.Errorf("network interface without MAC address")
+		}
+		found := false
+		for _, addr := range local {
+			if addr.String() == iface.MACAddress.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, iface.MACAddress.String())
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("MAC address(es) not found on this platform: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
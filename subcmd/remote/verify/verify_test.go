@@ -0,0 +1,143 @@
+package verify
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"system-transparency.org/stboot/host"
+	"system-transparency.org/stprov/internal/ssh"
+	"system-transparency.org/stprov/internal/st"
+	"system-transparency.org/stprov/internal/store"
+	"system-transparency.org/stprov/internal/tpm"
+)
+
+type testProber struct {
+	addrs   []net.HardwareAddr
+	pingErr error
+	badURLs map[string]bool
+}
+
+func (p *testProber) HardwareAddrs() ([]net.HardwareAddr, error) { return p.addrs, nil }
+func (p *testProber) Ping(gw *net.IP) error                      { return p.pingErr }
+func (p *testProber) CheckURL(url string) error {
+	if p.badURLs[url] {
+		return fmt.Errorf("HEAD request on %q failed", url)
+	}
+	return nil
+}
+
+func TestVerify(t *testing.T) {
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, efiUUID, err := st.HostConfigEFIVariableName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := &st.EFIVariables{UUID: efiUUID, HostName: "STHostName", HostKey: "STHostKey", HostKeySealed: "STHostKeySealed"}
+	mac, err := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherMAC, err := net.ParseMAC("aa:bb:cc:dd:ee:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := Main(nil, s, buf, &testProber{}, vars); err == nil {
+		t.Errorf("empty store passed verification")
+	}
+
+	hostname := st.HostName("mullis")
+	if err := hostname.WriteEFI(s, efiUUID, "STHostName"); err != nil {
+		t.Fatal(err)
+	}
+	hk, err := ssh.NewHostKey(rand.Reader, "testkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hk.WriteEFI(s, efiUUID, "STHostKey"); err != nil {
+		t.Fatal(err)
+	}
+	mode := host.IPStatic
+	gw := net.ParseIP("10.0.0.1")
+	urls := "https://a.example.org/os.json,https://b.example.org/os.json"
+	ifname := "eth0"
+	if err := st.WriteHostConfigEFI(s, &host.Config{
+		IPAddrMode:        &mode,
+		DefaultGateway:    &gw,
+		OSPkgPointer:      &urls,
+		NetworkInterfaces: &[]*host.NetworkInterface{{InterfaceName: &ifname, MACAddress: &mac}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []struct {
+		desc   string
+		prober *testProber
+		failed []string
+	}{
+		{"valid", &testProber{addrs: []net.HardwareAddr{otherMAC, mac}}, nil},
+		{"invalid: missing mac", &testProber{addrs: []net.HardwareAddr{otherMAC}}, []string{"network interfaces"}},
+		{"invalid: no ping", &testProber{addrs: []net.HardwareAddr{mac}, pingErr: fmt.Errorf("timeout")}, []string{"gateway"}},
+		{"invalid: bad url", &testProber{addrs: []net.HardwareAddr{mac}, badURLs: map[string]bool{"https://b.example.org/os.json": true}}, []string{"ospkg url https://b.example.org/os.json"}},
+	} {
+		buf.Reset()
+		err := Main(nil, s, buf, table.prober, vars)
+		if got, want := err != nil, table.failed != nil; got != want {
+			t.Errorf("%s: got error %v but wanted %v: %v", table.desc, got, want, err)
+			continue
+		}
+		for _, name := range table.failed {
+			if !strings.Contains(buf.String(), "FAIL "+name+":") {
+				t.Errorf("%s: output does not list failed check %q:\n%s", table.desc, name, buf.String())
+			}
+		}
+	}
+}
+
+func TestVerifySealed(t *testing.T) {
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, efiUUID, err := st.HostConfigEFIVariableName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := &st.EFIVariables{UUID: efiUUID, HostName: "STHostName", HostKey: "STHostKey", HostKeySealed: "STHostKeySealed"}
+	hostKeyErr := func() error {
+		for _, r := range Verify(s, &testProber{}, vars) {
+			if r.Name == "ssh hostkey" {
+				return r.Err
+			}
+		}
+		t.Fatal("no ssh hostkey check")
+		return nil
+	}
+
+	blob := tpm.Blob{Version: tpm.BlobVersion, PCRs: []uint{0, 7}, Public: []byte{1}, Private: []byte{2}}
+	b, err := blob.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(s, "STHostKeySealed", efiUUID, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := hostKeyErr(); err != nil {
+		t.Errorf("sealed host key: %v", err)
+	}
+
+	if err := store.Write(s, "STHostKeySealed", efiUUID, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := hostKeyErr(); err == nil {
+		t.Errorf("malformed sealed host key passed verification")
+	}
+}
@@ -0,0 +1,70 @@
+package wipe
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/efivarfs"
+
+	"system-transparency.org/stboot/stlog"
+	"system-transparency.org/stprov/internal/sb"
+	"system-transparency.org/stprov/internal/st"
+	"system-transparency.org/stprov/internal/store"
+)
+
+// OSIndications selects that the reboot into UEFI menu request is cleared
+const OSIndications = "OsIndications"
+
+func Main(args []string, s store.Store, in io.Reader, optVars []string, optYes bool, vars *st.EFIVariables) error {
+	if len(args) != 0 {
+		return fmt.Errorf("trailing arguments: %v", args)
+	}
+	if len(optVars) == 0 {
+		return fmt.Errorf("var: at least one variable is required")
+	}
+	valid := append(vars.Names(), OSIndications)
+	for _, name := range optVars {
+		if !slices.Contains(valid, name) {
+			return fmt.Errorf("var: invalid variable %q, must be one of %s", name, strings.Join(valid, ", "))
+		}
+	}
+
+	log.Printf("variables to wipe: %s", strings.Join(optVars, ", "))
+	if !optYes {
+		if _, err := readLine(in, "Press Enter to wipe variables, ctrl+c to abort"); err != nil {
+			return fmt.Errorf("read confirmation: %w", err)
+		}
+	}
+
+	for _, name := range optVars {
+		if name == OSIndications {
+			if err := sb.ClearRebootIntoUEFIMenu(s); err != nil {
+				return fmt.Errorf("clear reboot into UEFI menu: %w", err)
+			}
+			stlog.Info("efivarfs: cleared request to reboot into the UEFI menu")
+			continue
+		}
+
+		err := store.Remove(s, name, vars.UUID)
+		if errors.Is(err, efivarfs.ErrVarNotExist) {
+			stlog.Info("efivarfs: %s not present", name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("remove %s: %w", name, err)
+		}
+		stlog.Info("efivarfs: %s removed", name)
+	}
+	return nil
+}
+
+func readLine(in io.Reader, msg string) (string, error) {
+	reader := bufio.NewReader(in)
+	fmt.Print(msg)
+	return reader.ReadString('\n')
+}
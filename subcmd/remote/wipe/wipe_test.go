@@ -0,0 +1,97 @@
+package wipe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/u-root/u-root/pkg/efivarfs"
+
+	"system-transparency.org/stprov/internal/sb"
+	"system-transparency.org/stprov/internal/st"
+	"system-transparency.org/stprov/internal/store"
+)
+
+func TestWipe(t *testing.T) {
+	s, err := store.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	efiUUID := testUUID(t, "f401f2c1-b005-4be0-8cee-f2e5945bcbe7")
+	for _, name := range []string{"STHostConfig", "STHostName", "STHostKey", "STAgeKey"} {
+		if err := store.Write(s, name, efiUUID, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sb.RequestRebootIntoUEFIMenu(s); err != nil {
+		t.Fatal(err)
+	}
+	efiVars := &st.EFIVariables{
+		UUID:          efiUUID,
+		HostConfig:    "STHostConfig",
+		HostName:      "STHostName",
+		HostKey:       "STHostKey",
+		HostKeySealed: "STHostKeySealed",
+		HostCert:      "STHostCert",
+		X509Key:       "STX509Key",
+		X509Cert:      "STX509Cert",
+		Derived:       []string{"STAgeKey"},
+	}
+	wipe := func(vars []string, optYes bool, in string) error {
+		return Main(nil, s, strings.NewReader(in), vars, optYes, efiVars)
+	}
+
+	if err := wipe([]string{"STHostName", "PK"}, true, ""); err == nil {
+		t.Errorf("invalid variable accepted")
+	}
+	if err := wipe([]string{"STHostName"}, false, ""); err == nil {
+		t.Errorf("wiped without confirmation")
+	}
+	if _, err := store.Read(s, "STHostName", efiUUID); err != nil {
+		t.Errorf("variable removed without confirmation: %v", err)
+	}
+
+	if err := wipe([]string{"STHostName", "STHostKey", "STAgeKey"}, false, "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := wipe([]string{"STHostKey", OSIndications}, true, ""); err != nil {
+		t.Errorf("wipe of absent variable failed: %v", err)
+	}
+	for _, table := range []struct {
+		name   string
+		wantOK bool
+	}{
+		{"STHostConfig", true},
+		{"STHostName", false},
+		{"STHostKey", false},
+		{"STAgeKey", false},
+	} {
+		_, err := store.Read(s, table.name, efiUUID)
+		if got, want := err == nil, table.wantOK; got != want {
+			t.Errorf("%s: got present %v, want %v", table.name, got, want)
+		}
+		if err != nil && !errors.Is(err, efivarfs.ErrVarNotExist) {
+			t.Errorf("%s: unexpected error: %v", table.name, err)
+		}
+	}
+
+	b, err := store.Read(s, "OsIndications", testUUID(t, "8be4df61-93ca-11d2-aa0d-00e098032b8c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b, binary.LittleEndian.AppendUint64(nil, 0); !bytes.Equal(got, want) {
+		t.Errorf("got OsIndications %x, want %x", got, want)
+	}
+}
+
+func testUUID(t *testing.T, str string) *uuid.UUID {
+	t.Helper()
+	guid, err := uuid.Parse(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &guid
+}